@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	agentSockEnv       = "SECLED_AGENT_SOCK"
+	agentDefaultIdle   = 15 * time.Minute
+	agentDialTimeout   = time.Second
+	agentRequestWindow = 5 * time.Second
+)
+
+var errNoAgent = errors.New("no agent running")
+
+// agentRequest is one line of JSON sent to the agent. Op is "key" (the
+// master key of Ledger), "status" or "stop".
+type agentRequest struct {
+	Op     string `json:"op"`
+	Ledger string `json:"ledger,omitempty"`
+}
+
+type agentResponse struct {
+	Key    []byte `json:"key,omitempty"`
+	Ledger string `json:"ledger,omitempty"`
+	Idle   string `json:"idle,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+// agentOptions are the arguments of secled agent.
+type agentOptions struct {
+	Timeout    time.Duration
+	Socket     string
+	Foreground bool
+	Serve      bool
+	Stop       bool
+	Status     bool
+}
+
+func cmdAgent(args []string) error {
+	opts, err := parseAgentArgs(args)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case opts.Stop:
+		if _, err := agentCall(opts.Socket, agentRequest{Op: "stop"}); err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stderr, "Agent stopped")
+		return nil
+	case opts.Status:
+		resp, err := agentCall(opts.Socket, agentRequest{Op: "status"})
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "ledger: %s\nsocket: %s\nidle timeout in: %s\n", resp.Ledger, opts.Socket, resp.Idle)
+		return nil
+	case opts.Serve:
+		return serveAgentFromStdin(opts)
+	}
+
+	if _, err := agentCall(opts.Socket, agentRequest{Op: "status"}); err == nil {
+		return fmt.Errorf("an agent is already running on %s (secled agent --stop)", opts.Socket)
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	password, err := requirePassword()
+	if err != nil {
+		if password, err = readPassword("Master password: "); err != nil {
+			return err
+		}
+	}
+	masterKey, err := verifyPassword(led, password)
+	if err != nil {
+		return err
+	}
+
+	if opts.Foreground {
+		key, release, err := lockedCopy(masterKey)
+		clear(masterKey)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Warning: cannot lock the key in memory:", err)
+		}
+		defer release()
+		l, err := listenAgent(opts.Socket)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, formatAgentEnv(opts.Socket))
+		return serveAgent(l, opts.Socket, path, key, opts.Timeout)
+	}
+	defer clear(masterKey)
+	return startAgent(opts, masterKey)
+}
+
+func parseAgentArgs(args []string) (agentOptions, error) {
+	opts := agentOptions{Timeout: agentDefaultIdle, Socket: agentSocketPath()}
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--timeout":
+			if i+1 >= len(args) {
+				return opts, errors.New("--timeout needs a duration (for example 30m, 0 for none)")
+			}
+			i++
+			d, err := time.ParseDuration(args[i])
+			if err != nil || d < 0 {
+				return opts, fmt.Errorf("invalid --timeout %q", args[i])
+			}
+			opts.Timeout = d
+		case "--socket":
+			if i+1 >= len(args) {
+				return opts, errors.New("--socket needs a path")
+			}
+			i++
+			opts.Socket = args[i]
+		case "--foreground":
+			opts.Foreground = true
+		case "--serve":
+			opts.Serve = true
+		case "--stop":
+			opts.Stop = true
+		case "--status":
+			opts.Status = true
+		default:
+			return opts, fmt.Errorf("unknown argument: %s", args[i])
+		}
+	}
+	return opts, nil
+}
+
+// agentSocketPath is SECLED_AGENT_SOCK or the per-user default: a socket
+// file on Unix, a named pipe on Windows.
+func agentSocketPath() string {
+	if sock := os.Getenv(agentSockEnv); sock != "" {
+		return sock
+	}
+	return defaultAgentSocket()
+}
+
+func formatAgentEnv(sock string) string {
+	if runtime.GOOS == "windows" {
+		return "$env:" + agentSockEnv + "=" + quotePowerShell(sock)
+	}
+	return "export " + agentSockEnv + "=" + quotePOSIX(sock)
+}
+
+// startAgent runs "secled agent --serve" in the background, hands it the
+// key on stdin and waits until it listens.
+func startAgent(opts agentOptions, masterKey []byte) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, "agent", "--serve", "--timeout", opts.Timeout.String(), "--socket", opts.Socket)
+	detachProcess(cmd)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	line := []byte(hex.EncodeToString(masterKey) + "\n")
+	_, err = stdin.Write(line)
+	clear(line)
+	stdin.Close()
+	if err != nil {
+		return err
+	}
+
+	status, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		_ = cmd.Wait()
+		return errors.New("agent failed to start")
+	}
+	status = strings.TrimSpace(status)
+	if msg, ok := strings.CutPrefix(status, "error: "); ok {
+		_ = cmd.Wait()
+		return errors.New(msg)
+	}
+	if msg, ok := strings.CutPrefix(status, "ready "); ok {
+		fmt.Fprintln(os.Stderr, "Warning: cannot lock the key in memory:", msg)
+	}
+	pid := cmd.Process.Pid
+	_ = cmd.Process.Release()
+
+	fmt.Fprintf(os.Stderr, "Agent started (pid %d, idle timeout %s)\n", pid, opts.Timeout)
+	fmt.Fprintln(os.Stdout, formatAgentEnv(opts.Socket))
+	return nil
+}
+
+// serveAgentFromStdin is the background agent: it reads the key from
+// stdin, reports "ready" (or "error: ...") on stdout and serves.
+func serveAgentFromStdin(opts agentOptions) error {
+	report := func(format string, a ...any) {
+		fmt.Fprintf(os.Stdout, format+"\n", a...)
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadBytes('\n')
+	if err != nil {
+		report("error: cannot read the key")
+		return err
+	}
+	line = line[:len(line)-1]
+	key, release, lockErr := lockedBuffer(hex.DecodedLen(len(line)))
+	defer release()
+	_, err = hex.Decode(key, line)
+	clear(line)
+	if err != nil {
+		report("error: invalid key")
+		return err
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		report("error: %v", err)
+		return err
+	}
+	l, err := listenAgent(opts.Socket)
+	if err != nil {
+		report("error: %v", err)
+		return err
+	}
+	if lockErr != nil {
+		report("ready %v", lockErr)
+	} else {
+		report("ready")
+	}
+	os.Stdout.Close()
+	return serveAgent(l, opts.Socket, path, key, opts.Timeout)
+}
+
+// serveAgent answers requests one at a time until stopped, signalled, or
+// idle for longer than timeout (0 means no timeout). The key is zeroed by
+// the caller's release once it returns.
+func serveAgent(l net.Listener, sock, ledger string, key []byte, timeout time.Duration) error {
+	defer l.Close()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	conns := make(chan net.Conn)
+	acceptErr := make(chan error, 1)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				acceptErr <- err
+				return
+			}
+			select {
+			case conns <- conn:
+			case <-done:
+				conn.Close()
+				return
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	lastUsed := time.Now()
+	for {
+		var conn net.Conn
+		select {
+		case <-signals:
+			return nil
+		case err := <-acceptErr:
+			return err
+		case <-ticker.C:
+			if timeout > 0 && time.Since(lastUsed) >= timeout {
+				return nil
+			}
+			continue
+		case conn = <-conns:
+		}
+
+		req, err := readAgentRequest(conn)
+		var resp agentResponse
+		stop := false
+		switch {
+		case err != nil:
+			resp.Error = err.Error()
+		case req.Op == "key" && req.Ledger != ledger:
+			resp.Error = "the agent holds the key of " + ledger
+		case req.Op == "key":
+			resp.Key = key
+			lastUsed = time.Now()
+		case req.Op == "status":
+			resp.Ledger = ledger
+			resp.Idle = "never"
+			if timeout > 0 {
+				resp.Idle = (timeout - time.Since(lastUsed)).Round(time.Second).String()
+			}
+		case req.Op == "stop":
+			stop = true
+		default:
+			resp.Error = "unknown request " + req.Op
+		}
+		_ = json.NewEncoder(conn).Encode(resp)
+		conn.Close()
+		if stop {
+			return nil
+		}
+	}
+}
+
+// readAgentRequest reads one request line. Named pipes have no deadlines,
+// so the read also gives up after agentRequestWindow by closing conn; a
+// client that never writes cannot block the agent.
+func readAgentRequest(conn net.Conn) (agentRequest, error) {
+	type result struct {
+		req agentRequest
+		err error
+	}
+	read := make(chan result, 1)
+	go func() {
+		req, err := readAgentLine(conn)
+		read <- result{req, err}
+	}()
+	select {
+	case r := <-read:
+		return r.req, r.err
+	case <-time.After(agentRequestWindow):
+		conn.Close()
+		return agentRequest{}, errors.New("incomplete request")
+	}
+}
+
+func readAgentLine(conn net.Conn) (agentRequest, error) {
+	var req agentRequest
+	_ = conn.SetDeadline(time.Now().Add(agentRequestWindow))
+	line, err := bufio.NewReader(io.LimitReader(conn, 64*1024)).ReadBytes('\n')
+	if err != nil {
+		return req, errors.New("incomplete request")
+	}
+	if err := json.Unmarshal(line, &req); err != nil {
+		return req, errors.New("invalid request")
+	}
+	return req, nil
+}
+
+// agentKey asks the agent for the master key of the ledger at path.
+func agentKey(path string) ([]byte, error) {
+	if path == "" {
+		return nil, errNoAgent
+	}
+	resp, err := agentCall(agentSocketPath(), agentRequest{Op: "key", Ledger: path})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Key) == 0 {
+		return nil, errors.New("agent returned no key")
+	}
+	return resp.Key, nil
+}
+
+func agentCall(sock string, req agentRequest) (agentResponse, error) {
+	var resp agentResponse
+	conn, err := dialAgent(sock)
+	if err != nil {
+		return resp, errNoAgent
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(agentRequestWindow))
+
+	data, err := json.Marshal(req)
+	if err != nil {
+		return resp, err
+	}
+	if _, err := conn.Write(append(data, '\n')); err != nil {
+		return resp, err
+	}
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return resp, fmt.Errorf("agent: %w", err)
+	}
+	if resp.Error != "" {
+		return resp, errors.New("agent: " + resp.Error)
+	}
+	return resp, nil
+}
+
+// lockedCopy copies key into memory from lockedBuffer.
+func lockedCopy(key []byte) ([]byte, func(), error) {
+	buf, release, err := lockedBuffer(len(key))
+	copy(buf, key)
+	return buf, release, err
+}
@@ -0,0 +1,19 @@
+//go:build !unix && !windows
+
+package main
+
+import (
+	"errors"
+	"os/exec"
+)
+
+func lockedBuffer(n int) ([]byte, func(), error) {
+	buf := make([]byte, n)
+	return buf, func() { clear(buf) }, errors.New("memory locking is not supported on this platform")
+}
+
+func detachProcess(cmd *exec.Cmd) {}
+
+func checkSocketDir(dir string) error {
+	return nil
+}
@@ -0,0 +1,50 @@
+//go:build !windows
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// defaultAgentSocket is a per-user socket in XDG_RUNTIME_DIR or the temp
+// dir.
+func defaultAgentSocket() string {
+	base := os.Getenv("XDG_RUNTIME_DIR")
+	if base == "" {
+		base = os.TempDir()
+	}
+	dir := "secled-agent"
+	if uid := os.Getuid(); uid >= 0 {
+		dir = fmt.Sprintf("secled-%d", uid)
+	}
+	return filepath.Join(base, dir, "agent.sock")
+}
+
+// listenAgent creates the socket in a directory only the user can enter
+// and removes a stale socket left by an agent that died.
+func listenAgent(sock string) (net.Listener, error) {
+	dir := filepath.Dir(sock)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	if err := checkSocketDir(dir); err != nil {
+		return nil, err
+	}
+	if _, err := os.Lstat(sock); err == nil {
+		if conn, err := dialAgent(sock); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("an agent is already running on %s", sock)
+		}
+		if err := os.Remove(sock); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", sock)
+}
+
+func dialAgent(sock string) (net.Conn, error) {
+	return net.DialTimeout("unix", sock, agentDialTimeout)
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func startTestAgent(t *testing.T, ledger string, key []byte, timeout time.Duration) (string, chan error) {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "sla")
+	if err != nil {
+		t.Fatalf("temp dir failed: %v", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	sock := filepath.Join(dir, "run", "agent.sock")
+	if runtime.GOOS == "windows" {
+		sock = `\\.\pipe\` + filepath.Base(dir)
+	}
+
+	l, err := listenAgent(sock)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- serveAgent(l, sock, ledger, key, timeout) }()
+	return sock, done
+}
+
+func TestAgentServesKey(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	sock, done := startTestAgent(t, "/ledgers/a", key, time.Minute)
+
+	resp, err := agentCall(sock, agentRequest{Op: "key", Ledger: "/ledgers/a"})
+	if err != nil || !bytes.Equal(resp.Key, key) {
+		t.Fatalf("key request = %x, %v", resp.Key, err)
+	}
+	if _, err := agentCall(sock, agentRequest{Op: "key", Ledger: "/ledgers/b"}); err == nil {
+		t.Fatalf("agent handed out the key for another ledger")
+	}
+	resp, err = agentCall(sock, agentRequest{Op: "status"})
+	if err != nil || resp.Ledger != "/ledgers/a" || len(resp.Key) != 0 {
+		t.Fatalf("status = %+v, %v", resp, err)
+	}
+
+	if _, err := listenAgent(sock); err == nil {
+		t.Fatalf("second agent started on a live socket")
+	}
+
+	if _, err := agentCall(sock, agentRequest{Op: "stop"}); err != nil {
+		t.Fatalf("stop failed: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("agent returned %v", err)
+	}
+	if _, err := agentCall(sock, agentRequest{Op: "status"}); err != errNoAgent {
+		t.Fatalf("agent still answers after stop: %v", err)
+	}
+}
+
+func TestAgentIdleTimeout(t *testing.T) {
+	_, done := startTestAgent(t, "/ledgers/a", []byte("k"), 50*time.Millisecond)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("agent returned %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("agent did not stop after its idle timeout")
+	}
+}
+
+func TestUnlockLedgerUsesAgent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	master := writeTestLedger(t, path, map[string]string{"a": "1"})
+	led, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+
+	sock, _ := startTestAgent(t, led.path, master, time.Minute)
+	t.Setenv(agentSockEnv, sock)
+	t.Setenv("SECLED_MASTER", "")
+
+	got, err := unlockLedger(led)
+	if err != nil || !bytes.Equal(got, master) {
+		t.Fatalf("unlock through the agent = %x, %v", got, err)
+	}
+
+	// A key that does not open the ledger falls back to SECLED_MASTER.
+	other, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	other.path = "/elsewhere"
+	if _, err := unlockLedger(other); err == nil {
+		t.Fatalf("unlock without agent key or password succeeded")
+	}
+	t.Setenv("SECLED_MASTER", "password")
+	if _, err := unlockLedger(other); err != nil {
+		t.Fatalf("fallback to SECLED_MASTER failed: %v", err)
+	}
+}
+
+func TestParseAgentArgs(t *testing.T) {
+	t.Setenv(agentSockEnv, "/run/s.sock")
+	opts, err := parseAgentArgs([]string{"--timeout", "30m", "--foreground"})
+	if err != nil || opts.Timeout != 30*time.Minute || !opts.Foreground || opts.Socket != "/run/s.sock" {
+		t.Fatalf("parseAgentArgs = %+v, %v", opts, err)
+	}
+	for _, args := range [][]string{{"--timeout"}, {"--timeout", "-1s"}, {"--bogus"}} {
+		if _, err := parseAgentArgs(args); err == nil {
+			t.Fatalf("expected error for %q", args)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// lockedBuffer returns n bytes outside the Go heap, locked into RAM so the
+// key is never swapped out. If mlock fails (RLIMIT_MEMLOCK) the buffer is
+// still usable and the error says why it is not locked. release zeroes and
+// frees it.
+func lockedBuffer(n int) ([]byte, func(), error) {
+	buf, err := unix.Mmap(-1, 0, n, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_ANON|unix.MAP_PRIVATE)
+	if err != nil {
+		buf = make([]byte, n)
+		return buf, func() { clear(buf) }, err
+	}
+	lockErr := unix.Mlock(buf)
+	release := func() {
+		clear(buf)
+		if lockErr == nil {
+			_ = unix.Munlock(buf)
+		}
+		_ = unix.Munmap(buf)
+	}
+	return buf, release, lockErr
+}
+
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+}
+
+// checkSocketDir makes sure nobody else can reach the socket: the directory
+// must belong to the user and have no group or other permissions.
+func checkSocketDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok {
+		return fmt.Errorf("%s is not a directory", dir)
+	}
+	if int(st.Uid) != os.Getuid() {
+		return fmt.Errorf("%s belongs to another user", dir)
+	}
+	if info.Mode().Perm()&0o077 != 0 {
+		return fmt.Errorf("%s must not be accessible by others (chmod 700)", dir)
+	}
+	return nil
+}
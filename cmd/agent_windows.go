@@ -0,0 +1,272 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// lockedBuffer returns n bytes locked into RAM with VirtualLock. If locking
+// fails the buffer is still usable and the error says why. release zeroes
+// it.
+func lockedBuffer(n int) ([]byte, func(), error) {
+	buf := make([]byte, n)
+	if n == 0 {
+		return buf, func() {}, nil
+	}
+	addr := uintptr(unsafe.Pointer(&buf[0]))
+	lockErr := windows.VirtualLock(addr, uintptr(n))
+	release := func() {
+		clear(buf)
+		if lockErr == nil {
+			_ = windows.VirtualUnlock(addr, uintptr(n))
+		}
+	}
+	return buf, release, lockErr
+}
+
+func detachProcess(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		CreationFlags: windows.DETACHED_PROCESS | windows.CREATE_NEW_PROCESS_GROUP,
+		HideWindow:    true,
+	}
+}
+
+// agentPipePrefix is the namespace of local named pipes. AF_UNIX sockets on
+// Windows only get the permissions of their directory, so the agent uses a
+// named pipe whose security descriptor admits the user alone.
+const agentPipePrefix = `\\.\pipe\`
+
+func defaultAgentSocket() string {
+	sid, err := currentUserSID()
+	if err != nil {
+		return agentPipePrefix + "secled-agent"
+	}
+	return agentPipePrefix + "secled-agent-" + sid.String()
+}
+
+func currentUserSID() (*windows.SID, error) {
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return nil, err
+	}
+	return user.User.Sid, nil
+}
+
+// listenAgent creates the first instance of the pipe. The descriptor makes
+// the user owner and the only one granted access, remote clients are
+// rejected, and FILE_FLAG_FIRST_PIPE_INSTANCE fails if anyone (another
+// agent or a squatter) already holds the name.
+func listenAgent(sock string) (net.Listener, error) {
+	if !strings.HasPrefix(sock, agentPipePrefix) {
+		return nil, fmt.Errorf("%s is not a named pipe (%s...)", sock, agentPipePrefix)
+	}
+	sid, err := currentUserSID()
+	if err != nil {
+		return nil, err
+	}
+	sd, err := windows.SecurityDescriptorFromString("O:" + sid.String() + "D:P(A;;GA;;;" + sid.String() + ")")
+	if err != nil {
+		return nil, err
+	}
+	l := &pipeListener{
+		name: sock,
+		sid:  sid,
+		sa: &windows.SecurityAttributes{
+			Length:             uint32(unsafe.Sizeof(windows.SecurityAttributes{})),
+			SecurityDescriptor: sd,
+		},
+	}
+	h, err := l.create(windows.FILE_FLAG_FIRST_PIPE_INSTANCE)
+	if err != nil {
+		if errors.Is(err, windows.ERROR_ACCESS_DENIED) || errors.Is(err, windows.ERROR_PIPE_BUSY) {
+			return nil, fmt.Errorf("an agent is already running on %s", sock)
+		}
+		return nil, err
+	}
+	l.next = h
+	return l, nil
+}
+
+// pipeListener accepts one client per pipe instance; the next instance is
+// created before the connected one is handed out, so the name never lapses.
+type pipeListener struct {
+	name string
+	sid  *windows.SID
+	sa   *windows.SecurityAttributes
+
+	mu     sync.Mutex
+	next   windows.Handle
+	closed bool
+}
+
+func (l *pipeListener) create(flags uint32) (windows.Handle, error) {
+	name, err := windows.UTF16PtrFromString(l.name)
+	if err != nil {
+		return windows.InvalidHandle, err
+	}
+	return windows.CreateNamedPipe(name,
+		windows.PIPE_ACCESS_DUPLEX|flags,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT|windows.PIPE_REJECT_REMOTE_CLIENTS,
+		windows.PIPE_UNLIMITED_INSTANCES, 4096, 4096, 0, l.sa)
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	for {
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		h := l.next
+		l.mu.Unlock()
+
+		err := windows.ConnectNamedPipe(h, nil)
+		if err != nil && !errors.Is(err, windows.ERROR_PIPE_CONNECTED) {
+			return nil, err
+		}
+
+		l.mu.Lock()
+		if l.closed {
+			l.mu.Unlock()
+			return nil, net.ErrClosed
+		}
+		next, err := l.create(0)
+		if err != nil {
+			l.mu.Unlock()
+			return nil, err
+		}
+		l.next = next
+		l.mu.Unlock()
+
+		if !l.sameUser(h) {
+			_ = windows.DisconnectNamedPipe(h)
+			windows.CloseHandle(h)
+			continue
+		}
+		return &pipeConn{File: os.NewFile(uintptr(h), l.name), name: l.name}, nil
+	}
+}
+
+// sameUser checks the client process on top of the descriptor, so a
+// handle passed to another user's process is not served either.
+func (l *pipeListener) sameUser(h windows.Handle) bool {
+	var pid uint32
+	if err := windows.GetNamedPipeClientProcessId(h, &pid); err != nil {
+		return false
+	}
+	sid, err := processSID(pid)
+	return err == nil && sid.Equals(l.sid)
+}
+
+// Close stops Accept: a blocked ConnectNamedPipe returns once a client
+// connects, so the listener connects to itself.
+func (l *pipeListener) Close() error {
+	l.mu.Lock()
+	if l.closed {
+		l.mu.Unlock()
+		return nil
+	}
+	l.closed = true
+	h := l.next
+	l.mu.Unlock()
+
+	if conn, err := openPipe(l.name); err == nil {
+		conn.Close()
+	}
+	return windows.CloseHandle(h)
+}
+
+func (l *pipeListener) Addr() net.Addr { return pipeAddr(l.name) }
+
+type pipeAddr string
+
+func (a pipeAddr) Network() string { return "pipe" }
+func (a pipeAddr) String() string  { return string(a) }
+
+// pipeConn is a connected pipe instance. Deadlines are not supported on
+// synchronous handles; serveAgent does not rely on them.
+type pipeConn struct {
+	*os.File
+	name string
+}
+
+func (c *pipeConn) LocalAddr() net.Addr  { return pipeAddr(c.name) }
+func (c *pipeConn) RemoteAddr() net.Addr { return pipeAddr(c.name) }
+
+func processSID(pid uint32) (*windows.SID, error) {
+	p, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, pid)
+	if err != nil {
+		return nil, err
+	}
+	defer windows.CloseHandle(p)
+	var token windows.Token
+	if err := windows.OpenProcessToken(p, windows.TOKEN_QUERY, &token); err != nil {
+		return nil, err
+	}
+	defer token.Close()
+	user, err := token.GetTokenUser()
+	if err != nil {
+		return nil, err
+	}
+	return user.User.Sid.Copy()
+}
+
+// openPipe connects to a pipe instance, waiting while all instances are
+// busy. SECURITY_IDENTIFICATION keeps the server from acting as the client.
+func openPipe(sock string) (*pipeConn, error) {
+	name, err := windows.UTF16PtrFromString(sock)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(agentDialTimeout)
+	for {
+		h, err := windows.CreateFile(name, windows.GENERIC_READ|windows.GENERIC_WRITE, 0, nil,
+			windows.OPEN_EXISTING, windows.SECURITY_SQOS_PRESENT|windows.SECURITY_IDENTIFICATION, 0)
+		if err == nil {
+			return &pipeConn{File: os.NewFile(uintptr(h), sock), name: sock}, nil
+		}
+		if !errors.Is(err, windows.ERROR_PIPE_BUSY) || time.Now().After(deadline) {
+			return nil, err
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// dialAgent connects and makes sure the pipe is served by a process of the
+// same user, so a pipe created first by someone else never gets the key
+// request.
+func dialAgent(sock string) (net.Conn, error) {
+	conn, err := openPipe(sock)
+	if err != nil {
+		return nil, err
+	}
+	var pid uint32
+	if err := windows.GetNamedPipeServerProcessId(windows.Handle(conn.Fd()), &pid); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	sid, err := processSID(pid)
+	if err == nil {
+		var self *windows.SID
+		if self, err = currentUserSID(); err == nil && !sid.Equals(self) {
+			err = fmt.Errorf("%s is served by another user", sock)
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
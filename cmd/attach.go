@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+const (
+	attachmentMagic     = "SECLEDA1"
+	attachmentChunkSize = 64 * 1024
+	maxAttachmentChunk  = 16 * 1024 * 1024
+	streamPrefixSize    = 7
+	fileKeySize         = 32
+
+	typeAttachment = "attachment"
+	metaAttachment = "attachment"
+	metaFilename   = "filename"
+	metaMode       = "mode"
+	metaSize       = "size"
+)
+
+var errStreamCorrupt = errors.New("attachment is corrupted or truncated")
+
+// Attachments are stored outside the ledger, one file per attachment in
+// <ledger>.attachments/<id>. The ledger entry holds a random file key as
+// its value and the id, file name, mode and size as metadata.
+func attachmentsDir(ledgerPath string) string {
+	return ledgerPath + ".attachments"
+}
+
+func attachmentPath(ledgerPath string, e entry) string {
+	return filepath.Join(attachmentsDir(ledgerPath), filepath.Base(e.Meta[metaAttachment]))
+}
+
+func isAttachment(e entry) bool {
+	return e.Meta[metaType] == typeAttachment
+}
+
+func cmdAttach(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: secled attach <key> <file>")
+	}
+	key, file := args[0], args[1]
+	if key == reservedInitialKey {
+		return errors.New("key 'initial' is reserved")
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockLedger(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	if _, exists := led.Entries[key]; exists {
+		return errors.New("key already exists (remove it first)")
+	}
+
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", file)
+	}
+
+	fileKey := make([]byte, fileKeySize)
+	idBytes := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, fileKey); err != nil {
+		return err
+	}
+	if _, err := io.ReadFull(rand.Reader, idBytes); err != nil {
+		return err
+	}
+	id := hex.EncodeToString(idBytes)
+
+	blobPath, size, err := writeAttachment(path, id, fileKey, in)
+	if err != nil {
+		return err
+	}
+
+	if err := storeEntry(led, masterKey, key, fileKey); err != nil {
+		_ = os.Remove(blobPath)
+		return err
+	}
+	meta := led.Entries[key].Meta
+	meta[metaType] = typeAttachment
+	meta[metaAttachment] = id
+	meta[metaFilename] = filepath.Base(file)
+	meta[metaMode] = fmt.Sprintf("%04o", info.Mode().Perm())
+	meta[metaSize] = strconv.FormatInt(size, 10)
+
+	if err := saveLedger(path, led, masterKey); err != nil {
+		_ = os.Remove(blobPath)
+		return err
+	}
+	return nil
+}
+
+func cmdExtract(args []string) error {
+	key, out, force, err := parseExtractArgs(args)
+	if err != nil {
+		return err
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	e, ok := led.Entries[key]
+	if !ok {
+		return errors.New("key not found")
+	}
+	if !isAttachment(e) {
+		return errors.New("key is not an attachment (use get)")
+	}
+	p := ttyPrompter()
+	defer p.close()
+	if err := checkPolicy(led, masterKey, key, p.prompter); err != nil {
+		return err
+	}
+	fileKey, err := decryptEntry(masterKey, key, e)
+	if err != nil {
+		return errors.New("invalid password or corrupted entry")
+	}
+
+	blob, err := os.Open(attachmentPath(path, e))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	if out == "" {
+		return decryptStream(os.Stdout, blob, fileKey, e.Meta[metaAttachment])
+	}
+
+	mode, err := strconv.ParseUint(e.Meta[metaMode], 8, 32)
+	if err != nil {
+		mode = 0o600
+	}
+	write := func(w io.Writer) error {
+		return decryptStream(w, blob, fileKey, e.Meta[metaAttachment])
+	}
+	if force {
+		return writeFileAtomic(out, os.FileMode(mode), write)
+	}
+	return writeFileExclusive(out, os.FileMode(mode), write)
+}
+
+func parseExtractArgs(args []string) (string, string, bool, error) {
+	key, out, force := "", "", false
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--out":
+			if i+1 >= len(args) {
+				return "", "", false, errors.New("--out needs a file name")
+			}
+			i++
+			out = args[i]
+		case args[i] == "--force":
+			force = true
+		case key != "":
+			return "", "", false, errors.New("key must be a single argument (use quotes for spaces)")
+		default:
+			key = args[i]
+		}
+	}
+	if key == "" {
+		return "", "", false, errors.New("usage: secled extract <key> [--out file [--force]]")
+	}
+	return key, out, force, nil
+}
+
+// writeAttachment encrypts r into <ledger>.attachments/<id> and returns the
+// blob path and the plaintext size.
+func writeAttachment(ledgerPath string, id string, fileKey []byte, r io.Reader) (string, int64, error) {
+	dir := attachmentsDir(ledgerPath)
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", 0, err
+	}
+	blobPath := filepath.Join(dir, id)
+
+	var size int64
+	err := writeFileAtomic(blobPath, 0o600, func(w io.Writer) error {
+		var err error
+		size, err = encryptStream(w, r, fileKey, id)
+		return err
+	})
+	return blobPath, size, err
+}
+
+// writeFileAtomic writes path through a temp file in the same directory,
+// so a failed write never leaves a partial file behind.
+func writeFileAtomic(path string, mode os.FileMode, write func(io.Writer) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer func() {
+		tmp.Close()
+		_ = os.Remove(tmpPath)
+	}()
+
+	bw := bufio.NewWriter(tmp)
+	if err := write(bw); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	_ = os.Chmod(tmpPath, mode)
+	return os.Rename(tmpPath, path)
+}
+
+// writeFileExclusive creates a new file and fails if path exists, so an
+// extract cannot overwrite a file by mistake. A partly written file is
+// removed.
+func writeFileExclusive(path string, mode os.FileMode, write func(io.Writer) error) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists (use --force to replace it)", path)
+	}
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	err = write(bw)
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(path)
+	}
+	return err
+}
+
+// encryptStream encrypts r in chunks, in the style of the STREAM
+// construction used by age: every chunk is sealed with AES-256-GCM under
+// nonce = prefix(7) || counter(4) || last(1). The counter fixes the order
+// and the last flag marks the final chunk, so reordered, dropped or
+// truncated chunks fail authentication. The header and the attachment id
+// are the AAD of every chunk.
+func encryptStream(w io.Writer, r io.Reader, fileKey []byte, id string) (int64, error) {
+	gcm, err := newGCM(fileKey)
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, 0, len(attachmentMagic)+4+streamPrefixSize)
+	header = append(header, attachmentMagic...)
+	header = binary.BigEndian.AppendUint32(header, attachmentChunkSize)
+	prefix := make([]byte, streamPrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return 0, err
+	}
+	header = append(header, prefix...)
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+	aad := append([]byte(id), header...)
+
+	br := bufio.NewReaderSize(r, attachmentChunkSize)
+	buf := make([]byte, attachmentChunkSize)
+	sealed := make([]byte, 0, attachmentChunkSize+gcm.Overhead())
+	var total int64
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return total, err
+		}
+		last := n < attachmentChunkSize
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return total, err
+			}
+		}
+
+		sealed = gcm.Seal(sealed[:0], streamNonce(prefix, counter, last), buf[:n], aad)
+		if _, err := w.Write(sealed); err != nil {
+			return total, err
+		}
+		total += int64(n)
+		if last {
+			return total, nil
+		}
+		if counter == ^uint32(0) {
+			return total, errors.New("file is too large")
+		}
+	}
+}
+
+// decryptStream reverses encryptStream, writing each chunk only after it
+// has been authenticated.
+func decryptStream(w io.Writer, r io.Reader, fileKey []byte, id string) error {
+	gcm, err := newGCM(fileKey)
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, len(attachmentMagic)+4+streamPrefixSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return errStreamCorrupt
+	}
+	if string(header[:len(attachmentMagic)]) != attachmentMagic {
+		return errors.New("not a secled attachment")
+	}
+	chunkSize := int(binary.BigEndian.Uint32(header[len(attachmentMagic):]))
+	if chunkSize == 0 || chunkSize > maxAttachmentChunk {
+		return errStreamCorrupt
+	}
+	prefix := header[len(attachmentMagic)+4:]
+	aad := append([]byte(id), header...)
+
+	br := bufio.NewReaderSize(r, chunkSize+gcm.Overhead())
+	buf := make([]byte, chunkSize+gcm.Overhead())
+	plain := make([]byte, 0, chunkSize)
+	for counter := uint32(0); ; counter++ {
+		n, err := io.ReadFull(br, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		last := n < len(buf)
+		if !last {
+			if _, err := br.Peek(1); err == io.EOF {
+				last = true
+			} else if err != nil {
+				return err
+			}
+		}
+
+		plain, err = gcm.Open(plain[:0], streamNonce(prefix, counter, last), buf[:n], aad)
+		if err != nil {
+			return errStreamCorrupt
+		}
+		if _, err := w.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+		if counter == ^uint32(0) {
+			return errStreamCorrupt
+		}
+	}
+}
+
+func streamNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, 0, nonceSize)
+	nonce = append(nonce, prefix...)
+	nonce = binary.BigEndian.AppendUint32(nonce, counter)
+	if last {
+		return append(nonce, 1)
+	}
+	return append(nonce, 0)
+}
+
+// copyAttachments copies the blobs of led's attachment entries from the
+// directory of one ledger to another, skipping blobs that already exist.
+func copyAttachments(fromLedger, toLedger string, led *ledger) error {
+	for _, e := range led.Entries {
+		if !isAttachment(e) {
+			continue
+		}
+		dst := attachmentPath(toLedger, e)
+		if _, err := os.Stat(dst); err == nil {
+			continue
+		}
+		src, err := os.Open(attachmentPath(fromLedger, e))
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(attachmentsDir(toLedger), 0o700); err != nil {
+			src.Close()
+			return err
+		}
+		err = writeFileAtomic(dst, 0o600, func(w io.Writer) error {
+			_, err := io.Copy(w, src)
+			return err
+		})
+		src.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pruneAttachments removes blobs that no entry of led refers to any more.
+// Errors are ignored: a leftover blob is harmless.
+func pruneAttachments(ledgerPath string, led *ledger) {
+	dirEntries, err := os.ReadDir(attachmentsDir(ledgerPath))
+	if err != nil {
+		return
+	}
+	used := make(map[string]bool)
+	for _, e := range led.Entries {
+		if isAttachment(e) {
+			used[e.Meta[metaAttachment]] = true
+		}
+	}
+	for _, d := range dirEntries {
+		if !used[d.Name()] {
+			_ = os.Remove(filepath.Join(attachmentsDir(ledgerPath), d.Name()))
+		}
+	}
+}
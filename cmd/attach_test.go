@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStreamRoundTrip(t *testing.T) {
+	fileKey := make([]byte, fileKeySize)
+	sizes := []int{0, 1, attachmentChunkSize - 1, attachmentChunkSize, attachmentChunkSize + 1, 3 * attachmentChunkSize}
+
+	for _, size := range sizes {
+		plain := make([]byte, size)
+		if _, err := io.ReadFull(rand.Reader, plain); err != nil {
+			t.Fatalf("rand failed: %v", err)
+		}
+
+		var blob bytes.Buffer
+		n, err := encryptStream(&blob, bytes.NewReader(plain), fileKey, "id")
+		if err != nil {
+			t.Fatalf("size %d: encrypt failed: %v", size, err)
+		}
+		if n != int64(size) {
+			t.Fatalf("size %d: encrypt reported %d bytes", size, n)
+		}
+
+		var out bytes.Buffer
+		if err := decryptStream(&out, bytes.NewReader(blob.Bytes()), fileKey, "id"); err != nil {
+			t.Fatalf("size %d: decrypt failed: %v", size, err)
+		}
+		if !bytes.Equal(out.Bytes(), plain) {
+			t.Fatalf("size %d: round trip mismatch", size)
+		}
+	}
+}
+
+func TestStreamDetectsTampering(t *testing.T) {
+	fileKey := make([]byte, fileKeySize)
+	plain := bytes.Repeat([]byte("x"), 2*attachmentChunkSize+10)
+
+	var blob bytes.Buffer
+	if _, err := encryptStream(&blob, bytes.NewReader(plain), fileKey, "id"); err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	data := blob.Bytes()
+	headerLen := len(attachmentMagic) + 4 + streamPrefixSize
+	chunkLen := attachmentChunkSize + gcmTagSize
+
+	flipped := bytes.Clone(data)
+	flipped[len(flipped)-1] ^= 1
+	swapped := bytes.Clone(data)
+	copy(swapped[headerLen:], data[headerLen+chunkLen:headerLen+2*chunkLen])
+	copy(swapped[headerLen+chunkLen:], data[headerLen:headerLen+chunkLen])
+
+	cases := map[string]struct {
+		data []byte
+		id   string
+	}{
+		"flipped byte":       {data: flipped, id: "id"},
+		"swapped chunks":     {data: swapped, id: "id"},
+		"truncated at chunk": {data: data[:headerLen+2*chunkLen], id: "id"},
+		"other attachment":   {data: data, id: "other"},
+	}
+	for name, tc := range cases {
+		err := decryptStream(io.Discard, bytes.NewReader(tc.data), fileKey, tc.id)
+		if !errors.Is(err, errStreamCorrupt) {
+			t.Fatalf("%s: expected errStreamCorrupt, got %v", name, err)
+		}
+	}
+}
+
+func TestAttachmentBlobs(t *testing.T) {
+	dir := t.TempDir()
+	ours := filepath.Join(dir, "a", "ledger.encrypted")
+	theirs := filepath.Join(dir, "b", "ledger.encrypted")
+	fileKey := make([]byte, fileKeySize)
+
+	blobPath, size, err := writeAttachment(theirs, "0123", fileKey, bytes.NewReader([]byte("kubeconfig")))
+	if err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if size != int64(len("kubeconfig")) {
+		t.Fatalf("unexpected size %d", size)
+	}
+
+	led := newLedger(testParams())
+	led.Entries["kube"] = entry{Meta: map[string]string{metaType: typeAttachment, metaAttachment: "0123"}}
+	if err := copyAttachments(theirs, ours, led); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	copied := attachmentPath(ours, led.Entries["kube"])
+	if _, err := os.Stat(copied); err != nil {
+		t.Fatalf("expected copied blob: %v", err)
+	}
+
+	delete(led.Entries, "kube")
+	pruneAttachments(theirs, led)
+	if _, err := os.Stat(blobPath); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected unused blob to be pruned, got %v", err)
+	}
+}
+
+func TestParseExtractArgs(t *testing.T) {
+	key, out, force, err := parseExtractArgs([]string{"kube", "--out", "config"})
+	if err != nil || key != "kube" || out != "config" || force {
+		t.Fatalf("unexpected result %q %q %v %v", key, out, force, err)
+	}
+	if _, _, force, err := parseExtractArgs([]string{"kube", "--out", "config", "--force"}); err != nil || !force {
+		t.Fatalf("expected --force, got %v %v", force, err)
+	}
+	if _, _, _, err := parseExtractArgs([]string{"--out"}); err == nil {
+		t.Fatalf("expected error for missing file name")
+	}
+	if _, _, _, err := parseExtractArgs([]string{"a", "b"}); err == nil {
+		t.Fatalf("expected error for two keys")
+	}
+}
+
+func TestWriteFileExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	if err := os.WriteFile(path, []byte("keep"), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	write := func(w io.Writer) error {
+		_, err := io.WriteString(w, "new")
+		return err
+	}
+	if err := writeFileExclusive(path, 0o600, write); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Fatalf("expected existing file to be refused, got %v", err)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "keep" {
+		t.Fatalf("existing file was changed: %q", data)
+	}
+
+	fresh := filepath.Join(filepath.Dir(path), "fresh")
+	if err := writeFileExclusive(fresh, 0o600, func(io.Writer) error { return errors.New("boom") }); err == nil {
+		t.Fatalf("expected write error")
+	}
+	if _, err := os.Stat(fresh); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected partial file to be removed, got %v", err)
+	}
+	if err := writeFileExclusive(fresh, 0o600, write); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if data, _ := os.ReadFile(fresh); string(data) != "new" {
+		t.Fatalf("unexpected content %q", data)
+	}
+}
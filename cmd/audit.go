@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const auditLogEnv = "SECLED_AUDIT_LOG"
+
+// auditedCommands are logged with the key they touch.
+var auditedCommands = map[string]bool{
+	"get": true, "add": true, "update": true, "remove": true, "rm": true,
+	"generate-uuid": true, "generate-64hex": true, "gen": true,
+	"extract": true, "attach": true, "mv": true, "rename": true,
+	"copy-key": true, "policy": true, "lockout": true, "recover": true,
+	"audit-strength": true, "dupes": true, "grep": true,
+	"scan": true, "redact": true,
+}
+
+// auditRecord is one line of the audit log. Hash is SHA-256 over the JSON
+// of the record with Hash empty; Prev is the Hash of the record before, so
+// a removed or edited record breaks the chain. The chain is not keyed:
+// records are also written when the ledger is not unlocked (a wrong
+// password), so someone who can edit the log can recompute it, and only the
+// heads remembered on this machine catch that.
+type auditRecord struct {
+	Seq     uint64 `json:"seq"`
+	Time    string `json:"time"`
+	Command string `json:"command"`
+	Key     string `json:"key,omitempty"`
+	Result  string `json:"result"`
+	Error   string `json:"error,omitempty"`
+	Parent  string `json:"parent,omitempty"`
+	Prev    string `json:"prev"`
+	Hash    string `json:"hash"`
+}
+
+// auditLogPath is SECLED_AUDIT_LOG or ledger.audit next to the ledger.
+func auditLogPath(ledgerPath string) string {
+	if p := os.Getenv(auditLogEnv); p != "" {
+		return p
+	}
+	return strings.TrimSuffix(ledgerPath, ".encrypted") + ".audit"
+}
+
+// auditKeyOf finds the key an audited command works on, using the same
+// parsing as the command itself.
+func auditKeyOf(command string, args []string) string {
+	var key string
+	switch command {
+	case "get":
+		key, _, _ = parseGetArgs(args)
+	case "add", "update":
+		key, _, _ = parseKeyFieldArgs(args)
+	case "remove", "rm":
+		key, _, _ = parseRemoveArgs(args)
+	case "generate-uuid", "generate-64hex":
+		key, _, _ = parseGenerateArgs(args)
+	case "gen":
+		if len(args) > 0 {
+			key, _, _ = parseGenerateArgs(args[1:])
+		}
+	case "extract":
+		key, _, _, _ = parseExtractArgs(args)
+	case "mv", "rename", "copy-key":
+		if len(args) == 2 {
+			key = args[0] + " -> " + args[1]
+		}
+	case "attach", "policy":
+		if len(args) > 0 {
+			key = args[0]
+		}
+	}
+	return key
+}
+
+// auditPrivateKey stands for a key of a private ledger that was not
+// unlocked, such as after a wrong password.
+const auditPrivateKey = "private"
+
+// auditKeys holds the audit subkey of every ledger this process unlocked,
+// by ledgerID; verifyKey fills it.
+var auditKeys = make(map[string][]byte)
+
+func noteAuditKey(led *ledger, masterKey []byte) {
+	if sub, err := deriveSubkey(masterKey, "audit key"); err == nil {
+		auditKeys[ledgerID(led)] = sub
+	}
+}
+
+// auditKeyRef is how a key appears in the log. Key names of a private
+// ledger are sensitive, so they are replaced by an HMAC under a subkey of
+// the master key, which secled audit --key can still match after unlock.
+// The salt is in the header, so a plain hash could be guessed offline.
+func auditKeyRef(led *ledger, key string) string {
+	if key == "" || led == nil || !led.Private {
+		return key
+	}
+	sub, ok := auditKeys[ledgerID(led)]
+	if !ok {
+		return auditPrivateKey
+	}
+	if from, to, ok := strings.Cut(key, " -> "); ok {
+		return auditKeyRef(led, from) + " -> " + auditKeyRef(led, to)
+	}
+	m := hmac.New(sha256.New, sub)
+	m.Write([]byte(key))
+	return "hmac:" + hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+// logAudit appends a record for an audited command. The log must not
+// change what the command did, so problems only print a warning.
+func logAudit(command string, args []string, cmdErr error) {
+	path, err := ledgerPath()
+	if err != nil {
+		return
+	}
+	led, _ := loadLedger(path)
+	if led == nil {
+		// Without a readable ledger the key might be a private name.
+		args = nil
+	}
+	if err := appendAudit(auditLogPath(path), led, command, auditKeyOf(command, args), cmdErr); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: cannot write audit log:", err)
+	}
+}
+
+func appendAudit(logPath string, led *ledger, command, key string, cmdErr error) error {
+	unlock, err := lockLedger(logPath)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	f, err := os.OpenFile(logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	last, err := lastAuditRecord(f)
+	if err != nil {
+		return err
+	}
+	rec := auditRecord{
+		Seq:     last.Seq + 1,
+		Time:    time.Now().UTC().Format(time.RFC3339Nano),
+		Command: command,
+		Key:     auditKeyRef(led, key),
+		Result:  "ok",
+		Parent:  parentProcessName(),
+		Prev:    last.Hash,
+	}
+	if cmdErr != nil {
+		rec.Result = "error"
+		rec.Error = cmdErr.Error()
+	}
+	if rec.Hash, err = auditHash(rec); err != nil {
+		return err
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	noteAuditHead(logPath, rec)
+	return nil
+}
+
+func auditHash(rec auditRecord) (string, error) {
+	rec.Hash = ""
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// lastAuditRecord reads the record at the end of the log (a zero record
+// for an empty log).
+func lastAuditRecord(f *os.File) (auditRecord, error) {
+	var rec auditRecord
+	info, err := f.Stat()
+	if err != nil || info.Size() == 0 {
+		return rec, err
+	}
+	const tail = 64 * 1024
+	offset := max(info.Size()-tail, 0)
+	buf := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(buf, offset); err != nil && !errors.Is(err, io.EOF) {
+		return rec, err
+	}
+	buf = bytes.TrimRight(buf, "\n")
+	if i := bytes.LastIndexByte(buf, '\n'); i >= 0 {
+		buf = buf[i+1:]
+	}
+	if err := json.Unmarshal(buf, &rec); err != nil {
+		return rec, errors.New("the last audit record is damaged (see secled audit)")
+	}
+	return rec, nil
+}
+
+// auditHeadPath is a per-user file that remembers the newest record per
+// audit log, so records cut off the end of the log are noticed too.
+func auditHeadPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "secled", "audit-heads"), nil
+}
+
+func auditLogID(logPath string) string {
+	if abs, err := filepath.Abs(logPath); err == nil {
+		logPath = abs
+	}
+	sum := sha256.Sum256([]byte(logPath))
+	return hex.EncodeToString(sum[:8])
+}
+
+// readAuditHeads returns id -> "seq hash" from the head file.
+func readAuditHeads() map[string]string {
+	heads := make(map[string]string)
+	headPath, err := auditHeadPath()
+	if err != nil {
+		return heads
+	}
+	data, err := os.ReadFile(headPath)
+	if err != nil {
+		return heads
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if id, head, ok := strings.Cut(line, " "); ok {
+			heads[id] = head
+		}
+	}
+	return heads
+}
+
+// noteAuditHead records rec as the newest record of the log. Failures are
+// ignored like in noteGeneration.
+func noteAuditHead(logPath string, rec auditRecord) {
+	headPath, err := auditHeadPath()
+	if err != nil {
+		return
+	}
+	heads := readAuditHeads()
+	heads[auditLogID(logPath)] = fmt.Sprintf("%d %s", rec.Seq, rec.Hash)
+
+	var buf bytes.Buffer
+	for id, head := range heads {
+		fmt.Fprintf(&buf, "%s %s\n", id, head)
+	}
+	if err := os.MkdirAll(filepath.Dir(headPath), 0o700); err != nil {
+		return
+	}
+	_ = os.WriteFile(headPath, buf.Bytes(), 0o600)
+}
+
+// verifyAudit reads the whole log and checks the chain. It returns the
+// records and a list of problems found.
+func verifyAudit(r io.Reader, head string) ([]auditRecord, []string) {
+	var records []auditRecord
+	var problems []string
+	prev := auditRecord{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			problems = append(problems, fmt.Sprintf("line %d: unreadable record", lineNo))
+			continue
+		}
+		if hash, err := auditHash(rec); err != nil || hash != rec.Hash {
+			problems = append(problems, fmt.Sprintf("record %d: modified (hash mismatch)", rec.Seq))
+		}
+		if rec.Prev != prev.Hash || rec.Seq != prev.Seq+1 {
+			problems = append(problems, fmt.Sprintf("record %d: chain broken after record %d (records removed or reordered)", rec.Seq, prev.Seq))
+		}
+		records = append(records, rec)
+		prev = rec
+	}
+	if err := scanner.Err(); err != nil {
+		problems = append(problems, fmt.Sprintf("line %d: %v", lineNo+1, err))
+	}
+
+	if seqStr, hash, ok := strings.Cut(head, " "); ok {
+		seq, _ := strconv.ParseUint(seqStr, 10, 64)
+		switch {
+		case seq > prev.Seq:
+			problems = append(problems, fmt.Sprintf("records %d to %d were removed from the end", prev.Seq+1, seq))
+		case seq > 0 && seq <= uint64(len(records)) && records[seq-1].Seq == seq && records[seq-1].Hash != hash:
+			problems = append(problems, fmt.Sprintf("record %d differs from the one written on this machine", seq))
+		}
+	}
+	return records, problems
+}
+
+func cmdAudit(args []string) error {
+	key, since, err := parseAuditArgs(args)
+	if err != nil {
+		return err
+	}
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	logPath := auditLogPath(path)
+
+	f, err := os.Open(logPath)
+	if errors.Is(err, os.ErrNotExist) {
+		fmt.Fprintln(os.Stderr, "No audit log yet:", logPath)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	records, problems := verifyAudit(f, readAuditHeads()[auditLogID(logPath)])
+
+	keyRef := key
+	if key != "" {
+		led, _ := loadLedger(path)
+		if led != nil && led.Private {
+			if _, err := unlockLedger(led); err != nil {
+				return err
+			}
+		}
+		keyRef = auditKeyRef(led, key)
+	}
+	var cutoff time.Time
+	if since > 0 {
+		cutoff = time.Now().Add(-since)
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, rec := range records {
+		if keyRef != "" && !auditKeyMatches(rec.Key, keyRef) {
+			continue
+		}
+		if t, err := time.Parse(time.RFC3339Nano, rec.Time); err == nil && t.Before(cutoff) {
+			continue
+		}
+		result := rec.Result
+		if rec.Error != "" {
+			result += ": " + rec.Error
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", rec.Seq, rec.Time, rec.Command, rec.Key, result, rec.Parent)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	if len(problems) > 0 {
+		for _, p := range problems {
+			fmt.Fprintln(os.Stderr, "TAMPERED:", p)
+		}
+		return &exitError{code: exitCorrupt, err: errors.New("audit log chain is broken")}
+	}
+	fmt.Fprintf(os.Stderr, "audit log: %d records, chain OK (%s)\n", len(records), logPath)
+	return nil
+}
+
+// auditKeyMatches matches a key, also as either side of a rename.
+func auditKeyMatches(recKey, key string) bool {
+	if recKey == key {
+		return true
+	}
+	from, to, ok := strings.Cut(recKey, " -> ")
+	return ok && (from == key || to == key)
+}
+
+func parseAuditArgs(args []string) (string, time.Duration, error) {
+	key := ""
+	var since time.Duration
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--key":
+			if i+1 >= len(args) {
+				return "", 0, errors.New("--key needs a key")
+			}
+			i++
+			key = args[i]
+		case "--since":
+			if i+1 >= len(args) {
+				return "", 0, errors.New("--since needs a duration (for example 24h or 7d)")
+			}
+			i++
+			d, err := parseDuration(args[i])
+			if err != nil {
+				return "", 0, err
+			}
+			since = d
+		default:
+			return "", 0, fmt.Errorf("unknown argument: %s", args[i])
+		}
+	}
+	return key, since, nil
+}
+
+// parseDuration is time.ParseDuration plus a plain "<n>d" for days.
+func parseDuration(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid duration %q", s)
+	}
+	return d, nil
+}
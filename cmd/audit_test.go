@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeTestAudit(t *testing.T, n int) (string, []byte) {
+	t.Helper()
+	isolateUserConfig(t)
+	logPath := filepath.Join(t.TempDir(), "ledger.audit")
+	for i := 0; i < n; i++ {
+		var cmdErr error
+		if i%2 == 1 {
+			cmdErr = errors.New("key not found")
+		}
+		if err := appendAudit(logPath, nil, "get", fmt.Sprintf("key%d", i), cmdErr); err != nil {
+			t.Fatalf("append failed: %v", err)
+		}
+	}
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	return logPath, data
+}
+
+func TestAuditChain(t *testing.T) {
+	logPath, data := writeTestAudit(t, 4)
+	head := readAuditHeads()[auditLogID(logPath)]
+
+	records, problems := verifyAudit(bytes.NewReader(data), head)
+	if len(problems) != 0 || len(records) != 4 {
+		t.Fatalf("fresh log: %d records, problems %q", len(records), problems)
+	}
+	if records[1].Result != "error" || records[1].Error != "key not found" || records[3].Seq != 4 {
+		t.Fatalf("unexpected records %+v", records)
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+	tampered := map[string]string{
+		"edited":    strings.Join(lines[:1], "") + strings.Replace(lines[1], "key1", "keyX", 1) + strings.Join(lines[2:], ""),
+		"deleted":   lines[0] + strings.Join(lines[2:], ""),
+		"truncated": strings.Join(lines[:3], ""),
+		"reordered": lines[1] + lines[0] + strings.Join(lines[2:], ""),
+	}
+	for name, log := range tampered {
+		if _, problems := verifyAudit(strings.NewReader(log), head); len(problems) == 0 {
+			t.Fatalf("%s log was not detected", name)
+		}
+	}
+}
+
+func TestAuditKeyRef(t *testing.T) {
+	t.Cleanup(func() { clear(auditKeys) })
+	led, master := newTestLedger(t, nil)
+	if got := auditKeyRef(led, "customer-acme"); got != "customer-acme" {
+		t.Fatalf("public ledger key = %q", got)
+	}
+	led.Private = true
+	if got := auditKeyRef(led, "customer-acme"); got != auditPrivateKey {
+		t.Fatalf("key of a ledger that was not unlocked = %q", got)
+	}
+
+	noteAuditKey(led, master)
+	ref := auditKeyRef(led, "customer-acme")
+	if !strings.HasPrefix(ref, "hmac:") || strings.Contains(ref, "acme") {
+		t.Fatalf("private ledger key = %q", ref)
+	}
+	if auditKeyRef(led, "customer-acme") != ref {
+		t.Fatalf("key ref is not stable")
+	}
+
+	// the salt is public, so the reference must not follow from it alone
+	h := sha256.Sum256(append(bytes.Clone(led.Params.Salt), "customer-acme"...))
+	if strings.Contains(ref, hex.EncodeToString(h[:8])) {
+		t.Fatalf("key ref %q is a plain hash of salt and key", ref)
+	}
+	noteAuditKey(led, deriveKey("another password", led.Params))
+	if auditKeyRef(led, "customer-acme") == ref {
+		t.Fatalf("key ref does not depend on the master key")
+	}
+}
+
+func TestAuditKeyOf(t *testing.T) {
+	cases := []struct {
+		command string
+		args    []string
+		want    string
+	}{
+		{"get", []string{"ghcr", "--field", "password"}, "ghcr"},
+		{"add", []string{"ghcr", "--field", "user=x"}, "ghcr"},
+		{"rm", []string{"-r", "myapp"}, "myapp/"},
+		{"generate-uuid", []string{"-o", "id"}, "id"},
+		{"gen", []string{"64hex", "jwt"}, "jwt"},
+		{"extract", []string{"cfg", "--out", "f"}, "cfg"},
+		{"rename", []string{"a", "b"}, "a -> b"},
+	}
+	for _, c := range cases {
+		if got := auditKeyOf(c.command, c.args); got != c.want {
+			t.Fatalf("auditKeyOf(%s, %q) = %q, want %q", c.command, c.args, got, c.want)
+		}
+	}
+	if !auditKeyMatches("a -> b", "b") || auditKeyMatches("ab", "a") {
+		t.Fatalf("auditKeyMatches is wrong")
+	}
+}
+
+func TestParseDuration(t *testing.T) {
+	cases := map[string]time.Duration{"24h": 24 * time.Hour, "7d": 7 * 24 * time.Hour, "90m": 90 * time.Minute}
+	for s, want := range cases {
+		if got, err := parseDuration(s); err != nil || got != want {
+			t.Fatalf("parseDuration(%q) = %v, %v", s, got, err)
+		}
+	}
+	for _, s := range []string{"", "d", "-1d", "soon", "-5h"} {
+		if _, err := parseDuration(s); err == nil {
+			t.Fatalf("expected error for %q", s)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// completionCommands are the subcommands offered by the completion
+// scripts. __complete is left out on purpose.
+var completionCommands = []string{
+	"login", "logout", "list", "tree", "add", "get", "update", "remove", "rm",
+	"mv", "rename", "copy-key", "generate-uuid", "generate-64hex", "verify",
+	"convert", "salvage", "merge", "merge-driver", "attach", "extract", "pick", "shell", "agent", "policy", "audit", "audit-strength", "dupes", "grep", "scan", "redact", "git-credential", "due", "status", "lockout", "recover", "completion",
+}
+
+// keyCommands take an existing key as their first argument, so their
+// arguments complete to key names.
+var keyCommands = []string{
+	"get", "update", "remove", "rm", "mv", "rename", "copy-key", "extract",
+	"policy",
+}
+
+const bashCompletion = `# secled bash completion: eval "$(secled completion bash)"
+_secled() {
+    local cur=${COMP_WORDS[COMP_CWORD]}
+    if [ "$COMP_CWORD" -eq 1 ]; then
+        COMPREPLY=($(compgen -W "@COMMANDS@" -- "$cur"))
+        return
+    fi
+    case ${COMP_WORDS[1]} in
+    @KEYCMDS_PIPE@)
+        local IFS=$'\n'
+        COMPREPLY=($(@EXE@ __complete bash "$cur" 2>/dev/null))
+        ;;
+    esac
+}
+complete -o default -F _secled secled
+`
+
+const zshCompletion = `# secled zsh completion: source <(secled completion zsh)
+_secled() {
+    if (( CURRENT == 2 )); then
+        compadd -- @COMMANDS@
+        return
+    fi
+    case $words[2] in
+    (@KEYCMDS_PIPE@)
+        local -a keys
+        keys=("${(@f)$(@EXE@ __complete zsh 2>/dev/null)}")
+        compadd -- $keys
+        ;;
+    (*)
+        _files
+        ;;
+    esac
+}
+compdef _secled secled
+`
+
+const fishCompletion = `# secled fish completion: secled completion fish | source
+function __secled_keys
+    @EXE@ __complete fish 2>/dev/null
+end
+complete -c secled -f
+complete -c secled -n __fish_use_subcommand -a '@COMMANDS@'
+complete -c secled -n '__fish_seen_subcommand_from @KEYCMDS@' -a '(__secled_keys)'
+complete -c secled -n '__fish_seen_subcommand_from attach salvage merge' -F
+`
+
+const powershellCompletion = `# secled PowerShell completion: secled completion powershell | Out-String | Invoke-Expression
+Register-ArgumentCompleter -Native -CommandName secled, secled.exe -ScriptBlock {
+    param($wordToComplete, $commandAst, $cursorPosition)
+    $words = @($commandAst.CommandElements | ForEach-Object { $_.ToString() })
+    if ($words.Count -lt 2 -or ($words.Count -eq 2 -and $wordToComplete -ne '')) {
+        @(@COMMANDS_PS@) | Where-Object { $_ -like "$wordToComplete*" } | ForEach-Object {
+            [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+        }
+        return
+    }
+    if (@(@KEYCMDS_PS@) -contains $words[1]) {
+        & @EXE@ __complete powershell $wordToComplete 2>$null | ForEach-Object {
+            [System.Management.Automation.CompletionResult]::new($_, $_, 'ParameterValue', $_)
+        }
+    }
+}
+`
+
+func cmdCompletion(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: secled completion bash|zsh|fish|powershell")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if resolved, err := filepath.EvalSymlinks(exe); err == nil {
+		exe = resolved
+	}
+
+	script, err := completionScript(args[0], exe)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprint(os.Stdout, script)
+	return err
+}
+
+// completionScript fills in a completion script. The scripts call the
+// binary by its absolute path because secled is usually an alias or a
+// function, which the shells do not expand inside completion functions.
+func completionScript(shell, exe string) (string, error) {
+	var script, exeQuoted string
+	switch shell {
+	case "bash":
+		script, exeQuoted = bashCompletion, quotePOSIX(exe)
+	case "zsh":
+		script, exeQuoted = zshCompletion, quotePOSIX(exe)
+	case "fish":
+		script, exeQuoted = fishCompletion, quoteFish(exe)
+	case "powershell":
+		script, exeQuoted = powershellCompletion, quotePowerShell(exe)
+	default:
+		return "", fmt.Errorf("unsupported shell %q (use bash, zsh, fish or powershell)", shell)
+	}
+
+	r := strings.NewReplacer(
+		"@EXE@", exeQuoted,
+		"@COMMANDS@", strings.Join(completionCommands, " "),
+		"@COMMANDS_PS@", quotePowerShellList(completionCommands),
+		"@KEYCMDS@", strings.Join(keyCommands, " "),
+		"@KEYCMDS_PIPE@", strings.Join(keyCommands, "|"),
+		"@KEYCMDS_PS@", quotePowerShellList(keyCommands),
+	)
+	return r.Replace(script), nil
+}
+
+// cmdComplete is the hidden "__complete <shell> [word]" command used by the
+// completion scripts. It prints the keys starting with word, quoted for the
+// shell where the shell does not quote them itself. Like list it needs no
+// password; errors print nothing so that a tab press never shows them.
+func cmdComplete(args []string) error {
+	if len(args) == 0 || len(args) > 2 {
+		return nil
+	}
+	word := ""
+	if len(args) == 2 {
+		word = args[1]
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return nil
+	}
+	led, err := loadCompletionLedger(path)
+	if err != nil {
+		return nil
+	}
+	for _, k := range completeKeys(sortedKeys(led.Entries), args[0], word) {
+		fmt.Fprintln(os.Stdout, k)
+	}
+	return nil
+}
+
+// loadCompletionLedger is loadListableLedger for Tab presses. A private
+// ledger is opened with the agent's key or SECLED_MASTER like elsewhere, but
+// a key that does not fit is not counted as a failed unlock: nobody typed
+// it, and a stale SECLED_MASTER must not throttle or lock the ledger.
+func loadCompletionLedger(path string) (*ledger, error) {
+	led, err := loadLedger(path)
+	if err != nil || !led.Private {
+		return led, err
+	}
+	if masterKey, err := agentKey(led.path); err == nil && verifyKey(led, masterKey) == nil {
+		return led, nil
+	}
+	password, err := requirePassword()
+	if err != nil {
+		return nil, err
+	}
+	if err := verifyKey(led, deriveKey(password, led.Params)); err != nil {
+		return nil, err
+	}
+	return led, nil
+}
+
+func completeKeys(keys []string, shell, word string) []string {
+	// The word may still carry the opening quote of a quoted key.
+	word = strings.TrimLeft(word, `'"`)
+	var out []string
+	for _, k := range keys {
+		if !strings.HasPrefix(k, word) || strings.ContainsAny(k, "\n\r") {
+			continue
+		}
+		switch {
+		case shellSafe(k):
+		case shell == "bash":
+			k = quotePOSIX(k)
+		case shell == "powershell":
+			k = quotePowerShell(k)
+		}
+		out = append(out, k)
+	}
+	return out
+}
+
+// shellSafe reports whether a key can be typed as is in every shell.
+func shellSafe(key string) bool {
+	if key == "" {
+		return false
+	}
+	for _, r := range key {
+		ok := (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || strings.ContainsRune("-_./:@+,", r)
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func quoteFish(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, "'", `\'`).Replace(value) + "'"
+}
+
+func quotePowerShellList(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = quotePowerShell(v)
+	}
+	return strings.Join(quoted, ", ")
+}
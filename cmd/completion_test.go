@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+var placeholder = regexp.MustCompile(`@[A-Z_]+@`)
+
+func TestCompleteKeys(t *testing.T) {
+	keys := []string{"ghcr-password", "it's mine", "my key", "myapp/prod/db", "line\nbreak"}
+
+	cases := []struct {
+		shell, word string
+		want        []string
+	}{
+		{"bash", "my", []string{"'my key'", "myapp/prod/db"}},
+		{"bash", "'my", []string{"'my key'", "myapp/prod/db"}},
+		{"bash", "it", []string{`'it'"'"'s mine'`}},
+		{"powershell", "it", []string{"'it''s mine'"}},
+		{"zsh", "my ", []string{"my key"}},
+		{"fish", "", []string{"ghcr-password", "it's mine", "my key", "myapp/prod/db"}},
+	}
+	for _, c := range cases {
+		got := completeKeys(keys, c.shell, c.word)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Fatalf("completeKeys(%s, %q) = %q, want %q", c.shell, c.word, got, c.want)
+		}
+	}
+}
+
+func TestCompletionScript(t *testing.T) {
+	for _, shell := range []string{"bash", "zsh", "fish", "powershell"} {
+		script, err := completionScript(shell, "/opt/my bin/secled")
+		if err != nil {
+			t.Fatalf("%s: %v", shell, err)
+		}
+		if placeholder.MatchString(script) {
+			t.Fatalf("%s: unreplaced placeholder in script:\n%s", shell, script)
+		}
+		if !strings.Contains(script, "__complete "+shell) {
+			t.Fatalf("%s: script does not call __complete", shell)
+		}
+		if !strings.Contains(script, "'/opt/my bin/secled'") {
+			t.Fatalf("%s: executable path is not quoted", shell)
+		}
+		if !strings.Contains(script, "generate-64hex") {
+			t.Fatalf("%s: script is missing commands", shell)
+		}
+	}
+	if _, err := completionScript("tcsh", "secled"); err == nil {
+		t.Fatalf("expected error for unsupported shell")
+	}
+}
+
+func TestCompletionDoesNotCountFailedUnlocks(t *testing.T) {
+	isolateUserConfig(t)
+	t.Setenv(agentSockEnv, filepath.Join(t.TempDir(), "no-agent.sock"))
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	led, master := newTestLedger(t, map[string]string{reservedInitialKey: initialValue(), "alpha": "secret"})
+	led.Private = true
+	if err := saveLedger(path, led, master); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	t.Setenv("SECLED_MASTER", "stale")
+	for i := 0; i < 5; i++ {
+		if _, err := loadCompletionLedger(path); err == nil {
+			t.Fatalf("completion opened the ledger with a wrong password")
+		}
+	}
+	if _, err := os.Stat(unlockStatePath(path)); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("failed completions were recorded: %v", err)
+	}
+
+	t.Setenv("SECLED_MASTER", "password")
+	got, err := loadCompletionLedger(path)
+	if err != nil {
+		t.Fatalf("completion with the right password failed: %v", err)
+	}
+	if _, ok := got.Entries["alpha"]; !ok {
+		t.Fatalf("private index not opened: %v", sortedKeys(got.Entries))
+	}
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"crypto/aes"
 	"crypto/cipher"
+	"crypto/hkdf"
 	"crypto/rand"
+	"crypto/sha256"
 	"errors"
 	"io"
 
@@ -37,12 +39,16 @@ func deriveKey(password string, params kdfParams) []byte {
 	return argon2.IDKey([]byte(password), params.Salt, params.Time, params.Memory, params.Threads, params.KeyLen)
 }
 
-func encryptEntry(masterKey []byte, key string, plaintext []byte) (entry, error) {
-	block, err := aes.NewCipher(masterKey)
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
 	if err != nil {
-		return entry{}, err
+		return nil, err
 	}
-	gcm, err := cipher.NewGCM(block)
+	return cipher.NewGCM(block)
+}
+
+func encryptEntry(masterKey []byte, key string, plaintext []byte) (entry, error) {
+	gcm, err := newGCM(masterKey)
 	if err != nil {
 		return entry{}, err
 	}
@@ -59,11 +65,7 @@ func decryptEntry(masterKey []byte, key string, e entry) ([]byte, error) {
 	if len(e.Nonce) != nonceSize {
 		return nil, errors.New("invalid nonce size")
 	}
-	block, err := aes.NewCipher(masterKey)
-	if err != nil {
-		return nil, err
-	}
-	gcm, err := cipher.NewGCM(block)
+	gcm, err := newGCM(masterKey)
 	if err != nil {
 		return nil, err
 	}
@@ -73,3 +75,9 @@ func decryptEntry(masterKey []byte, key string, e entry) ([]byte, error) {
 	}
 	return plaintext, nil
 }
+
+// deriveSubkey derives an independent key for one purpose (MAC, index
+// encryption, ...) so the master key itself is only used for entries.
+func deriveSubkey(masterKey []byte, purpose string) ([]byte, error) {
+	return hkdf.Key(sha256.New, masterKey, nil, "secled "+purpose, 32)
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// groupValues groups values that are equal after normalize (nil compares
+// them as they are). Every value is in one group, groups are in the order
+// of their first value.
+func groupValues(values []storedValue, normalize func([]byte) []byte) [][]storedValue {
+	var groups [][]storedValue
+	index := make(map[[sha256.Size]byte]int)
+	for _, v := range values {
+		value := v.Value
+		if normalize != nil {
+			value = normalize(value)
+		}
+		sum := sha256.Sum256(value)
+		i, ok := index[sum]
+		if !ok {
+			i = len(groups)
+			index[sum] = i
+			groups = append(groups, nil)
+		}
+		groups[i] = append(groups[i], v)
+	}
+	return groups
+}
+
+// normalizeValue drops what is usually added by accident when a value is
+// pasted: surrounding whitespace and line breaks, and one pair of quotes.
+func normalizeValue(value []byte) []byte {
+	value = bytes.TrimSpace(value)
+	if len(value) >= 2 {
+		first, last := value[0], value[len(value)-1]
+		if first == last && (first == '"' || first == '\'' || first == '`') {
+			value = bytes.TrimSpace(value[1 : len(value)-1])
+		}
+	}
+	return value
+}
+
+// duplicateGroups returns the groups of more than one value that are equal
+// after normalizeValue; exact is false for a group whose values differ
+// before it.
+func duplicateGroups(values []storedValue) (groups [][]storedValue, exact []bool) {
+	for _, group := range groupValues(values, normalizeValue) {
+		if len(group) < 2 || len(normalizeValue(group[0].Value)) == 0 {
+			continue
+		}
+		same := true
+		for _, v := range group[1:] {
+			same = same && bytes.Equal(v.Value, group[0].Value)
+		}
+		groups = append(groups, group)
+		exact = append(exact, same)
+	}
+	return groups, exact
+}
+
+func cmdDupes(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: secled dupes")
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	// Policies are not asked: only key names are printed.
+	values, _, err := decryptValues(led, masterKey, isSecretField, nil)
+	if err != nil {
+		return err
+	}
+	defer clearValues(values)
+
+	groups, exact := duplicateGroups(values)
+	for i, group := range groups {
+		names := make([]string, len(group))
+		for j, v := range group {
+			names[j] = v.Name()
+		}
+		line := strings.Join(names, ", ")
+		if !exact[i] {
+			line += "  (differ only in surrounding whitespace or quotes)"
+		}
+		fmt.Fprintln(os.Stdout, line)
+	}
+	if len(groups) > 0 {
+		return fmt.Errorf("keys share a value (%d groups)", len(groups))
+	}
+	return nil
+}
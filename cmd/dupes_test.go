@@ -0,0 +1,97 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNormalizeValue(t *testing.T) {
+	cases := map[string]string{
+		"token":       "token",
+		"token\n":     "token",
+		"  token\r\n": "token",
+		"\"token\"":   "token",
+		"' token '\n": "token",
+		"\"token'":    "\"token'",
+		"\"":          "\"",
+		"to ken":      "to ken",
+		"`token`":     "token",
+		"\"\"":        "",
+	}
+	for in, want := range cases {
+		if got := string(normalizeValue([]byte(in))); got != want {
+			t.Fatalf("normalizeValue(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestDuplicateGroups(t *testing.T) {
+	values := []storedValue{
+		{Key: "prod/jwt", Value: []byte("abc")},
+		{Key: "sandbox/jwt", Value: []byte("abc")},
+		{Key: "api", Value: []byte("tok")},
+		{Key: "api-copy", Value: []byte("tok\n")},
+		{Key: "ghcr", Field: "password", Value: []byte("\"tok\"")},
+		{Key: "unique", Value: []byte("xyz")},
+		{Key: "blank1", Value: []byte(" ")},
+		{Key: "blank2", Value: []byte("  ")},
+	}
+	groups, exact := duplicateGroups(values)
+	var got []string
+	for i, group := range groups {
+		var names []string
+		for _, v := range group {
+			names = append(names, v.Name())
+		}
+		line := strings.Join(names, ",")
+		if exact[i] {
+			line += "=exact"
+		}
+		got = append(got, line)
+	}
+	want := "prod/jwt,sandbox/jwt=exact api,api-copy,ghcr.password"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("groups = %v, want %s", got, want)
+	}
+}
+
+func TestRevealValues(t *testing.T) {
+	led, master := newTestLedger(t, map[string]string{"plain": "v1", "locked": "v2"})
+	led.Entries["locked"].Meta[metaPolicy] = "confirm"
+	fields := encodeFields(map[string][]byte{"username": []byte("bob"), "api_token": []byte("v3")})
+	if err := storeEntry(led, master, "svc", fields); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	led.Entries["svc"].Meta[metaType] = typeFields
+
+	values, skipped, err := revealValues(led, master, prompter{}, nil)
+	if err != nil {
+		t.Fatalf("reveal failed: %v", err)
+	}
+	var got []string
+	for _, v := range values {
+		got = append(got, v.Name()+"="+string(v.Value))
+	}
+	if strings.Join(got, " ") != "plain=v1 svc.api_token=v3 svc.username=bob" {
+		t.Fatalf("values = %v", got)
+	}
+	if strings.Join(skipped, ",") != "locked" {
+		t.Fatalf("skipped = %v", skipped)
+	}
+
+	// scan, redact and dupes never print values, so they do not skip
+	values, skipped, err = decryptValues(led, master, nil, nil)
+	if err != nil || len(values) != 4 || len(skipped) != 0 || values[0].Key != "locked" {
+		t.Fatalf("decryptValues = %+v, %v, %v", values, skipped, err)
+	}
+	clearValues(values)
+
+	values, _, _ = revealValues(led, master, prompter{}, isSecretField)
+	if len(values) != 2 || values[1].Name() != "svc.api_token" {
+		t.Fatalf("secret fields = %+v", values)
+	}
+	clearValues(values)
+	if string(values[0].Value) != "\x00\x00" {
+		t.Fatalf("value not cleared: %q", values[0].Value)
+	}
+}
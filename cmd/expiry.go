@@ -0,0 +1,213 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// Metadata for secrets with a limited life: expires_at is a fixed time
+// (RFC3339), rotate_after a period counted from the last write of the
+// value (updated_at).
+const (
+	metaExpiresAt   = "expires_at"
+	metaRotateAfter = "rotate_after"
+
+	// expiryNone as --expires or --rotate-every removes the setting.
+	expiryNone = "none"
+)
+
+// expiryOptions are --expires and --rotate-every of add, update and
+// generate. "none" removes the setting.
+type expiryOptions struct {
+	Expires     string
+	RotateAfter string
+}
+
+// parseExpiryArgs takes --expires and --rotate-every out of args and
+// returns the rest for the command's own parser.
+func parseExpiryArgs(args []string, now time.Time) ([]string, expiryOptions, error) {
+	var opts expiryOptions
+	var rest []string
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--expires":
+			if i+1 >= len(args) {
+				return nil, opts, errors.New("--expires needs a duration (90d) or a date (2026-12-31)")
+			}
+			i++
+			expires, err := parseExpiry(args[i], now)
+			if err != nil {
+				return nil, opts, err
+			}
+			opts.Expires = expires
+		case "--rotate-every":
+			if i+1 >= len(args) {
+				return nil, opts, errors.New("--rotate-every needs a duration (for example 90d)")
+			}
+			i++
+			if args[i] != expiryNone {
+				if d, err := parseDuration(args[i]); err != nil || d == 0 {
+					return nil, opts, fmt.Errorf("invalid --rotate-every %q", args[i])
+				}
+			}
+			opts.RotateAfter = args[i]
+		default:
+			rest = append(rest, args[i])
+		}
+	}
+	return rest, opts, nil
+}
+
+// parseExpiry turns "90d", "2026-12-31" or an RFC3339 time into the
+// stored RFC3339 form.
+func parseExpiry(s string, now time.Time) (string, error) {
+	if s == expiryNone {
+		return s, nil
+	}
+	if d, err := parseDuration(s); err == nil && d > 0 {
+		return now.Add(d).UTC().Format(time.RFC3339), nil
+	}
+	if t, err := time.Parse(time.DateOnly, s); err == nil {
+		return t.UTC().Format(time.RFC3339), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t.UTC().Format(time.RFC3339), nil
+	}
+	return "", fmt.Errorf("invalid --expires %q (use a duration like 90d or a date like 2026-12-31)", s)
+}
+
+func (opts expiryOptions) apply(e entry) {
+	set := func(name, value string) {
+		switch value {
+		case "":
+		case expiryNone:
+			delete(e.Meta, name)
+		default:
+			e.Meta[name] = value
+		}
+	}
+	set(metaExpiresAt, opts.Expires)
+	set(metaRotateAfter, opts.RotateAfter)
+}
+
+// dueItem is one reason why a secret needs attention.
+type dueItem struct {
+	Key  string
+	What string // "expires" or "rotate"
+	When time.Time
+}
+
+// dueDates returns when the entry expires and when it is due for rotation
+// (zero when not set or unreadable).
+func dueDates(e entry) (time.Time, time.Time) {
+	var expires, rotate time.Time
+	if v := e.Meta[metaExpiresAt]; v != "" {
+		expires, _ = time.Parse(time.RFC3339, v)
+	}
+	if v := e.Meta[metaRotateAfter]; v != "" {
+		d, err := parseDuration(v)
+		if updated := updatedAt(e); err == nil && !updated.IsZero() {
+			rotate = updated.Add(d)
+		}
+	}
+	return expires, rotate
+}
+
+// dueEntries lists what expires or needs rotation before now+within,
+// soonest first.
+func dueEntries(entries map[string]entry, now time.Time, within time.Duration) []dueItem {
+	limit := now.Add(within)
+	var items []dueItem
+	for _, key := range sortedKeys(entries) {
+		expires, rotate := dueDates(entries[key])
+		if !expires.IsZero() && !expires.After(limit) {
+			items = append(items, dueItem{key, "expires", expires})
+		}
+		if !rotate.IsZero() && !rotate.After(limit) {
+			items = append(items, dueItem{key, "rotate", rotate})
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].When.Before(items[j].When)
+	})
+	return items
+}
+
+func describeDue(item dueItem, now time.Time) string {
+	date := item.When.Local().Format(time.DateOnly)
+	past := !item.When.After(now)
+	switch {
+	case item.What == "expires" && past:
+		return "expired on " + date
+	case item.What == "expires":
+		return fmt.Sprintf("expires on %s (in %s)", date, daysUntil(now, item.When))
+	case past:
+		return "rotation overdue since " + date
+	default:
+		return fmt.Sprintf("rotate by %s (in %s)", date, daysUntil(now, item.When))
+	}
+}
+
+func daysUntil(now, t time.Time) string {
+	days := int(math.Round(t.Sub(now).Hours() / 24))
+	if days == 1 {
+		return "1 day"
+	}
+	if days < 1 {
+		return "less than a day"
+	}
+	return fmt.Sprintf("%d days", days)
+}
+
+// expiryWarning is the warning get prints for an expired or overdue
+// secret, or "".
+func expiryWarning(key string, e entry, now time.Time) string {
+	var warnings []string
+	for _, item := range dueEntries(map[string]entry{key: e}, now, 0) {
+		warnings = append(warnings, describeDue(item, now))
+	}
+	if len(warnings) == 0 {
+		return ""
+	}
+	return fmt.Sprintf("Warning: %s %s", key, strings.Join(warnings, ", "))
+}
+
+func cmdDue(args []string) error {
+	within, err := parseDueArgs(args)
+	if err != nil {
+		return err
+	}
+	led, err := loadListableLedger()
+	if err != nil {
+		return err
+	}
+	return writeDue(os.Stdout, led.Entries, time.Now(), within)
+}
+
+func parseDueArgs(args []string) (time.Duration, error) {
+	switch {
+	case len(args) == 0:
+		return 0, nil
+	case len(args) == 2 && args[0] == "--within":
+		return parseDuration(args[1])
+	default:
+		return 0, errors.New("usage: secled due [--within 14d]")
+	}
+}
+
+// writeDue prints one line per expired secret or overdue rotation, and
+// with within also those coming up in that time.
+func writeDue(w io.Writer, entries map[string]entry, now time.Time, within time.Duration) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, item := range dueEntries(entries, now, within) {
+		fmt.Fprintf(tw, "%s\t%s\n", item.Key, describeDue(item, now))
+	}
+	return tw.Flush()
+}
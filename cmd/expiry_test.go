@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseExpiryArgs(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	rest, opts, err := parseExpiryArgs([]string{"-o", "--expires", "90d", "api-key", "--rotate-every", "30d"}, now)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if strings.Join(rest, " ") != "-o api-key" {
+		t.Fatalf("rest = %q", rest)
+	}
+	if opts.Expires != "2026-04-01T12:00:00Z" || opts.RotateAfter != "30d" {
+		t.Fatalf("opts = %+v", opts)
+	}
+
+	if _, opts, _ := parseExpiryArgs([]string{"--expires", "2026-12-31"}, now); opts.Expires != "2026-12-31T00:00:00Z" {
+		t.Fatalf("date expiry = %q", opts.Expires)
+	}
+	if _, opts, _ := parseExpiryArgs([]string{"--expires", "none"}, now); opts.Expires != expiryNone {
+		t.Fatalf("none expiry = %q", opts.Expires)
+	}
+	for _, bad := range [][]string{{"--expires"}, {"--expires", "soon"}, {"--rotate-every", "0s"}, {"--rotate-every", "monthly"}} {
+		if _, _, err := parseExpiryArgs(bad, now); err == nil {
+			t.Fatalf("expected error for %q", bad)
+		}
+	}
+}
+
+func TestExpiryApply(t *testing.T) {
+	e := entry{Meta: map[string]string{metaExpiresAt: "2026-01-01T00:00:00Z"}}
+	expiryOptions{RotateAfter: "90d"}.apply(e)
+	if e.Meta[metaExpiresAt] == "" || e.Meta[metaRotateAfter] != "90d" {
+		t.Fatalf("meta = %v", e.Meta)
+	}
+	expiryOptions{Expires: expiryNone}.apply(e)
+	if _, ok := e.Meta[metaExpiresAt]; ok {
+		t.Fatalf("expires_at not removed: %v", e.Meta)
+	}
+}
+
+func TestDueEntries(t *testing.T) {
+	defer func(local *time.Location) { time.Local = local }(time.Local)
+	time.Local = time.UTC // dates are printed in local time
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	entries := map[string]entry{
+		"expired": {Meta: map[string]string{metaExpiresAt: "2026-05-01T00:00:00Z"}},
+		"soon":    {Meta: map[string]string{metaExpiresAt: "2026-06-10T00:00:00Z"}},
+		"later":   {Meta: map[string]string{metaExpiresAt: "2027-01-01T00:00:00Z"}},
+		"stale": {Meta: map[string]string{
+			metaUpdatedAt:   "2026-01-01T00:00:00Z",
+			metaRotateAfter: "90d",
+		}},
+		"fresh": {Meta: map[string]string{
+			metaUpdatedAt:   "2026-05-30T00:00:00Z",
+			metaRotateAfter: "90d",
+		}},
+		"plain": {Meta: map[string]string{metaUpdatedAt: "2020-01-01T00:00:00Z"}},
+	}
+
+	var got []string
+	for _, item := range dueEntries(entries, now, 0) {
+		got = append(got, item.Key+":"+item.What)
+	}
+	if strings.Join(got, " ") != "stale:rotate expired:expires" {
+		t.Fatalf("due now = %v", got)
+	}
+
+	got = nil
+	for _, item := range dueEntries(entries, now, 14*24*time.Hour) {
+		got = append(got, item.Key)
+	}
+	if strings.Join(got, " ") != "stale expired soon" {
+		t.Fatalf("due within 14d = %v", got)
+	}
+
+	var out bytes.Buffer
+	if err := writeDue(&out, entries, now, 14*24*time.Hour); err != nil {
+		t.Fatalf("writeDue failed: %v", err)
+	}
+	for _, want := range []string{"rotation overdue since 2026-04-01", "expired on 2026-05-01", "expires on 2026-06-10 (in 9 days)"} {
+		if !strings.Contains(out.String(), want) {
+			t.Fatalf("output misses %q:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestExpiryWarning(t *testing.T) {
+	now := time.Date(2026, 6, 1, 0, 0, 0, 0, time.UTC)
+	e := entry{Meta: map[string]string{metaExpiresAt: "2026-05-01T00:00:00Z"}}
+	if got := expiryWarning("api", e, now); !strings.HasPrefix(got, "Warning: api expired on") {
+		t.Fatalf("warning = %q", got)
+	}
+	e.Meta[metaExpiresAt] = "2026-07-01T00:00:00Z"
+	if got := expiryWarning("api", e, now); got != "" {
+		t.Fatalf("unexpected warning %q", got)
+	}
+}
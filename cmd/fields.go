@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+const (
+	typeFields = "fields"
+	maxFields  = 64
+)
+
+// fieldArg is one --field name=value argument. A value of "-" is read
+// like a secret (from the TTY without echo, or from stdin).
+type fieldArg struct {
+	Name   string
+	Value  string
+	Prompt bool
+}
+
+func isFields(e entry) bool {
+	return e.Meta[metaType] == typeFields
+}
+
+// parseKeyFieldArgs parses "<key> [--field name=value ...]".
+func parseKeyFieldArgs(args []string) (string, []fieldArg, error) {
+	key := ""
+	var fields []fieldArg
+	seen := make(map[string]bool)
+	for i := 0; i < len(args); i++ {
+		if args[i] != "--field" {
+			if key != "" {
+				return "", nil, errors.New("key must be a single argument (use quotes for spaces)")
+			}
+			key = args[i]
+			continue
+		}
+		if i+1 >= len(args) {
+			return "", nil, errors.New("--field needs name=value")
+		}
+		i++
+		name, value, ok := strings.Cut(args[i], "=")
+		if !ok {
+			return "", nil, fmt.Errorf("invalid --field %q (use name=value or name=-)", args[i])
+		}
+		if err := checkFieldName(name); err != nil {
+			return "", nil, err
+		}
+		if seen[name] {
+			return "", nil, fmt.Errorf("field %s given twice", name)
+		}
+		seen[name] = true
+		fields = append(fields, fieldArg{Name: name, Value: value, Prompt: value == "-"})
+	}
+	if key == "" {
+		return "", nil, errors.New("missing key")
+	}
+	if len(fields) > maxFields {
+		return "", nil, errors.New("too many fields")
+	}
+	return key, fields, nil
+}
+
+// checkFieldName keeps field names to letters, digits, '_' and '-' so that
+// "key.field" in get is unambiguous.
+func checkFieldName(name string) error {
+	if name == "" {
+		return errors.New("field name cannot be empty")
+	}
+	for _, r := range name {
+		ok := r == '_' || r == '-' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+		if !ok {
+			return fmt.Errorf("invalid field name %q (use letters, digits, '_' and '-')", name)
+		}
+	}
+	return nil
+}
+
+// checkFieldPrompts fails when more than one "-" field would have to be
+// read from stdin that is not a TTY.
+func checkFieldPrompts(args []fieldArg) error {
+	prompts := 0
+	for _, f := range args {
+		if f.Prompt {
+			prompts++
+		}
+	}
+	if prompts > 1 && !term.IsTerminal(int(os.Stdin.Fd())) {
+		return errors.New("only one --field can be read from stdin when it is not a terminal")
+	}
+	return nil
+}
+
+// readFieldValues sets the values of fields, asking read for those given
+// as "-".
+func readFieldValues(args []fieldArg, fields map[string][]byte, read secretReader) error {
+	for _, f := range args {
+		if !f.Prompt {
+			fields[f.Name] = []byte(f.Value)
+			continue
+		}
+		value, err := read("Value for " + f.Name + ": ")
+		if err != nil {
+			return err
+		}
+		fields[f.Name] = value
+	}
+	return nil
+}
+
+// encodeFields stores the fields of a structured entry as one blob:
+// count uint32, then (nameLen uint32, name, valueLen uint32, value) sorted
+// by name.
+func encodeFields(fields map[string][]byte) []byte {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	writeUint32(&buf, uint32(len(names)))
+	for _, name := range names {
+		writeString(&buf, name)
+		writeUint32(&buf, uint32(len(fields[name])))
+		buf.Write(fields[name])
+	}
+	return buf.Bytes()
+}
+
+func decodeFields(data []byte) (map[string][]byte, error) {
+	r := bytes.NewReader(data)
+	count, err := readUint32(r)
+	if err != nil || count > maxFields {
+		return nil, errors.New("invalid structured entry")
+	}
+	fields := make(map[string][]byte, count)
+	for i := uint32(0); i < count; i++ {
+		name, err := readString(r)
+		if err != nil {
+			return nil, errors.New("invalid structured entry")
+		}
+		n, err := readUint32(r)
+		if err != nil || int64(n) > int64(r.Len()) {
+			return nil, errors.New("invalid structured entry")
+		}
+		value := make([]byte, n)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, errors.New("invalid structured entry")
+		}
+		fields[name] = value
+	}
+	if r.Len() != 0 {
+		return nil, errors.New("invalid structured entry")
+	}
+	return fields, nil
+}
+
+// formatFields prints all fields as name=value lines, like the initial
+// entry.
+func formatFields(fields map[string][]byte) []byte {
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var buf bytes.Buffer
+	for _, name := range names {
+		buf.WriteString(name)
+		buf.WriteByte('=')
+		buf.Write(fields[name])
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// parseGetArgs parses "<key> [--field name]".
+func parseGetArgs(args []string) (string, string, error) {
+	key, field := "", ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--field":
+			if i+1 >= len(args) {
+				return "", "", errors.New("--field needs a field name")
+			}
+			i++
+			field = args[i]
+		case key != "":
+			return "", "", errors.New("key must be a single argument (use quotes for spaces)")
+		default:
+			key = args[i]
+		}
+	}
+	if key == "" {
+		return "", "", errors.New("missing key")
+	}
+	return key, field, nil
+}
+
+// resolveField maps "ghcr.password" to key "ghcr", field "password" when
+// no entry has the full name and "ghcr" is a structured entry.
+func resolveField(entries map[string]entry, key, field string) (string, string) {
+	if _, ok := entries[key]; ok || field != "" {
+		return key, field
+	}
+	i := strings.LastIndex(key, ".")
+	if i <= 0 {
+		return key, field
+	}
+	if e, ok := entries[key[:i]]; ok && isFields(e) {
+		return key[:i], key[i+1:]
+	}
+	return key, field
+}
+
+// selectField returns what get prints for an entry: the plaintext of a
+// plain entry, one field, or all fields of a structured entry.
+func selectField(e entry, plaintext []byte, field string) ([]byte, error) {
+	if !isFields(e) {
+		if field != "" {
+			return nil, errors.New("key has no fields")
+		}
+		return plaintext, nil
+	}
+	fields, err := decodeFields(plaintext)
+	if err != nil {
+		return nil, err
+	}
+	if field == "" {
+		return formatFields(fields), nil
+	}
+	value, ok := fields[field]
+	if !ok {
+		return nil, fmt.Errorf("field not found: %s", field)
+	}
+	return value, nil
+}
+
+// secretFieldWords are parts of field names whose values are secrets;
+// user names and servers are not.
+var secretFieldWords = []string{"pass", "pwd", "secret", "token", "key", "pin"}
+
+// isSecretField tells whether a field holds a secret by its name.
+func isSecretField(name string) bool {
+	name = strings.ToLower(name)
+	for _, word := range secretFieldWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
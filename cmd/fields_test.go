@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFieldsRoundTrip(t *testing.T) {
+	fields := map[string][]byte{
+		"username": []byte("exampleusername"),
+		"password": []byte("p@ss\nword"),
+		"empty":    {},
+	}
+	got, err := decodeFields(encodeFields(fields))
+	if err != nil {
+		t.Fatalf("decode failed: %v", err)
+	}
+	if len(got) != len(fields) {
+		t.Fatalf("got %d fields, want %d", len(got), len(fields))
+	}
+	for name, value := range fields {
+		if !bytes.Equal(got[name], value) {
+			t.Fatalf("field %s = %q, want %q", name, got[name], value)
+		}
+	}
+
+	if _, err := decodeFields([]byte("not fields")); err == nil {
+		t.Fatalf("expected error for garbage")
+	}
+	blob := encodeFields(fields)
+	if _, err := decodeFields(blob[:len(blob)-1]); err == nil {
+		t.Fatalf("expected error for truncated blob")
+	}
+}
+
+func TestParseKeyFieldArgs(t *testing.T) {
+	key, fields, err := parseKeyFieldArgs([]string{"ghcr", "--field", "username=bob", "--field", "password=-"})
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if key != "ghcr" || len(fields) != 2 {
+		t.Fatalf("got key %q, %d fields", key, len(fields))
+	}
+	if fields[0].Name != "username" || fields[0].Value != "bob" || fields[0].Prompt {
+		t.Fatalf("unexpected first field %+v", fields[0])
+	}
+	if fields[1].Name != "password" || !fields[1].Prompt {
+		t.Fatalf("unexpected second field %+v", fields[1])
+	}
+
+	bad := [][]string{
+		{"ghcr", "--field"},
+		{"ghcr", "--field", "novalue"},
+		{"ghcr", "--field", "bad.name=x"},
+		{"ghcr", "--field", "a=1", "--field", "a=2"},
+		{"--field", "a=1"},
+	}
+	for _, args := range bad {
+		if _, _, err := parseKeyFieldArgs(args); err == nil {
+			t.Fatalf("expected error for %q", args)
+		}
+	}
+}
+
+func TestResolveField(t *testing.T) {
+	entries := map[string]entry{
+		"ghcr":       {Meta: map[string]string{metaType: typeFields}},
+		"plain":      {Meta: map[string]string{}},
+		"ghcr.token": {Meta: map[string]string{}},
+	}
+	cases := []struct {
+		key, field         string
+		wantKey, wantField string
+	}{
+		{"ghcr.password", "", "ghcr", "password"},
+		{"ghcr.token", "", "ghcr.token", ""},
+		{"plain.x", "", "plain.x", ""},
+		{"ghcr", "username", "ghcr", "username"},
+	}
+	for _, c := range cases {
+		k, f := resolveField(entries, c.key, c.field)
+		if k != c.wantKey || f != c.wantField {
+			t.Fatalf("resolveField(%q, %q) = %q, %q", c.key, c.field, k, f)
+		}
+	}
+}
+
+func TestSelectField(t *testing.T) {
+	e := entry{Meta: map[string]string{metaType: typeFields}}
+	blob := encodeFields(map[string][]byte{"b": []byte("2"), "a": []byte("1")})
+
+	all, err := selectField(e, blob, "")
+	if err != nil || string(all) != "a=1\nb=2\n" {
+		t.Fatalf("all fields = %q, %v", all, err)
+	}
+	one, err := selectField(e, blob, "b")
+	if err != nil || string(one) != "2" {
+		t.Fatalf("field b = %q, %v", one, err)
+	}
+	if _, err := selectField(e, blob, "c"); err == nil {
+		t.Fatalf("expected error for missing field")
+	}
+	if _, err := selectField(entry{}, []byte("x"), "a"); err == nil {
+		t.Fatalf("expected error for field of a plain entry")
+	}
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// gitCredentialPrefix is the namespace of the entries of the git
+// credential helper: git/<host>/<username>, with the fields protocol,
+// host, username and password.
+const gitCredentialPrefix = "git" + namespaceSep
+
+// gitHelperName is the program name git runs for credential.helper secled.
+const gitHelperName = "git-credential-secled"
+
+// isGitHelper tells whether secled was started as git-credential-secled
+// (a link to the binary).
+func isGitHelper(arg0 string) bool {
+	name := strings.TrimSuffix(filepath.Base(arg0), ".exe")
+	return name == gitHelperName
+}
+
+// gitCredential is a request or answer of the git credential protocol.
+type gitCredential struct {
+	Protocol string
+	Host     string
+	Path     string
+	Username string
+	Password string
+	Expiry   string // password_expiry_utc, unix seconds
+}
+
+// readGitCredential reads key=value lines up to an empty line or EOF;
+// attributes secled does not use are ignored.
+func readGitCredential(r io.Reader) (gitCredential, error) {
+	var c gitCredential
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSuffix(scanner.Text(), "\r")
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, "=")
+		if !ok {
+			return c, errors.New("invalid credential line (expected name=value)")
+		}
+		switch name {
+		case "protocol":
+			c.Protocol = value
+		case "host":
+			c.Host = value
+		case "path":
+			c.Path = value
+		case "username":
+			c.Username = value
+		case "password":
+			c.Password = value
+		case "password_expiry_utc":
+			c.Expiry = value
+		case "url":
+			u, err := url.Parse(value)
+			if err != nil {
+				return c, fmt.Errorf("invalid credential url: %w", err)
+			}
+			c.Protocol, c.Host, c.Path = u.Scheme, u.Host, strings.TrimPrefix(u.Path, "/")
+			if u.User != nil {
+				c.Username = u.User.Username()
+			}
+		}
+	}
+	return c, scanner.Err()
+}
+
+func writeGitCredential(w io.Writer, c gitCredential) error {
+	var b bytes.Buffer
+	for _, attr := range [][2]string{
+		{"protocol", c.Protocol},
+		{"host", c.Host},
+		{"username", c.Username},
+		{"password", c.Password},
+		{"password_expiry_utc", c.Expiry},
+	} {
+		if attr[1] != "" {
+			fmt.Fprintf(&b, "%s=%s\n", attr[0], attr[1])
+		}
+	}
+	_, err := w.Write(b.Bytes())
+	return err
+}
+
+// gitCredentialKey is the entry of a host and user; both are escaped like
+// URL path segments, so a / in them cannot add a namespace level.
+func gitCredentialKey(host, username string) string {
+	return gitCredentialPrefix + url.PathEscape(host) + namespaceSep + url.PathEscape(username)
+}
+
+// findGitCredential returns the entry for the request: the one of its user,
+// or without a user the most recently written entry of the host. A stored
+// protocol must match the requested one.
+func findGitCredential(led *ledger, masterKey []byte, req gitCredential) (string, map[string][]byte, error) {
+	var candidates []string
+	if req.Username != "" {
+		candidates = []string{gitCredentialKey(req.Host, req.Username)}
+	} else {
+		candidates = keysUnder(sortedKeys(led.Entries), gitCredentialPrefix+url.PathEscape(req.Host)+namespaceSep)
+	}
+
+	var key string
+	var fields map[string][]byte
+	for _, k := range candidates {
+		e, ok := led.Entries[k]
+		if !ok || !isFields(e) {
+			continue
+		}
+		if key != "" && !updatedAt(e).After(updatedAt(led.Entries[key])) {
+			continue
+		}
+		plaintext, err := decryptEntry(masterKey, k, e)
+		if err != nil {
+			return "", nil, errors.New("invalid password or corrupted entry")
+		}
+		decoded, err := decodeFields(plaintext)
+		if err != nil {
+			return "", nil, err
+		}
+		if p := string(decoded["protocol"]); p != "" && req.Protocol != "" && p != req.Protocol {
+			clearFields(decoded)
+			continue
+		}
+		clearFields(fields)
+		key, fields = k, decoded
+	}
+	return key, fields, nil
+}
+
+func cmdGitCredential(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: secled git-credential get|store|erase")
+	}
+	op := args[0]
+	if op != "get" && op != "store" && op != "erase" {
+		// git may add operations; unknown ones are ignored as the protocol asks
+		return nil
+	}
+
+	req, err := readGitCredential(os.Stdin)
+	if err != nil {
+		return err
+	}
+	if req.Host == "" {
+		return nil
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	if op != "get" {
+		unlock, err := lockLedger(path)
+		if err != nil {
+			return err
+		}
+		defer unlock()
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	var key string
+	switch op {
+	case "get":
+		key, err = gitCredentialGet(led, masterKey, req, os.Stdout)
+	case "store":
+		key, err = gitCredentialStore(path, led, masterKey, req)
+	case "erase":
+		key, err = gitCredentialErase(path, led, masterKey, req)
+	}
+	if key != "" {
+		if auditErr := appendAudit(auditLogPath(path), led, "git-credential "+op, key, err); auditErr != nil {
+			fmt.Fprintln(os.Stderr, "Warning: cannot write audit log:", auditErr)
+		}
+	}
+	return err
+}
+
+// gitCredentialGet answers a get request; nothing is written when no entry
+// fits, so git asks the user.
+func gitCredentialGet(led *ledger, masterKey []byte, req gitCredential, w io.Writer) (string, error) {
+	key, fields, err := findGitCredential(led, masterKey, req)
+	if err != nil || key == "" {
+		return key, err
+	}
+	defer clearFields(fields)
+
+	p := ttyPrompter()
+	defer p.close()
+	if err := checkPolicy(led, masterKey, key, p.prompter); err != nil {
+		return key, err
+	}
+	if warning := expiryWarning(key, led.Entries[key], time.Now()); warning != "" {
+		fmt.Fprintln(os.Stderr, warning)
+	}
+
+	answer := gitCredential{
+		Protocol: req.Protocol,
+		Host:     req.Host,
+		Username: string(fields["username"]),
+		Password: string(fields["password"]),
+	}
+	expires, _ := dueDates(led.Entries[key])
+	if !expires.IsZero() {
+		answer.Expiry = strconv.FormatInt(expires.Unix(), 10)
+	}
+	return key, writeGitCredential(w, answer)
+}
+
+// gitCredentialStore saves the credential git just used successfully. Git
+// does this after every use, so an unchanged credential is not written.
+func gitCredentialStore(path string, led *ledger, masterKey []byte, req gitCredential) (string, error) {
+	if req.Username == "" || req.Password == "" {
+		return "", nil
+	}
+	key := gitCredentialKey(req.Host, req.Username)
+	fieldArgs := []fieldArg{
+		{Name: "host", Value: req.Host},
+		{Name: "username", Value: req.Username},
+		{Name: "password", Value: req.Password},
+	}
+	if req.Protocol != "" {
+		fieldArgs = append(fieldArgs, fieldArg{Name: "protocol", Value: req.Protocol})
+	}
+
+	e, exists := led.Entries[key]
+	if exists {
+		if !isFields(e) {
+			return key, fmt.Errorf("%s exists and has no fields", key)
+		}
+		plaintext, err := decryptEntry(masterKey, key, e)
+		if err != nil {
+			return key, errors.New("invalid password or corrupted entry")
+		}
+		fields, err := decodeFields(plaintext)
+		if err != nil {
+			return key, err
+		}
+		unchanged := true
+		for _, f := range fieldArgs {
+			unchanged = unchanged && string(fields[f.Name]) == f.Value
+		}
+		newPassword := string(fields["password"]) != req.Password
+		clearFields(fields)
+		if unchanged {
+			return "", nil
+		}
+		if err := updateValue(led, masterKey, key, fieldArgs, nil); err != nil {
+			return key, err
+		}
+		if newPassword {
+			// the expiry belonged to the old token
+			delete(led.Entries[key].Meta, metaExpiresAt)
+		}
+	} else if err := addValue(led, masterKey, key, fieldArgs, nil); err != nil {
+		return key, err
+	}
+
+	if req.Expiry != "" {
+		if unix, err := strconv.ParseInt(req.Expiry, 10, 64); err == nil {
+			led.Entries[key].Meta[metaExpiresAt] = time.Unix(unix, 0).UTC().Format(time.RFC3339)
+		}
+	}
+	return key, saveLedger(path, led, masterKey)
+}
+
+// gitCredentialErase removes the entry git reports as rejected. When the
+// request has a password the entry is only removed if it still holds that
+// password, so a token that was replaced meanwhile stays.
+func gitCredentialErase(path string, led *ledger, masterKey []byte, req gitCredential) (string, error) {
+	key, fields, err := findGitCredential(led, masterKey, req)
+	if err != nil || key == "" {
+		return key, err
+	}
+	same := req.Password == "" || string(fields["password"]) == req.Password
+	clearFields(fields)
+	if !same {
+		return "", nil
+	}
+	deleteEntry(led, key)
+	return key, saveLedger(path, led, masterKey)
+}
+
+func clearFields(fields map[string][]byte) {
+	for _, value := range fields {
+		clear(value)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReadGitCredential(t *testing.T) {
+	input := "protocol=https\r\nhost=github.com\nusername=octo\npassword=ghp_x=y\ncapability[]=authtype\n\nignored=1\n"
+	c, err := readGitCredential(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if c != (gitCredential{Protocol: "https", Host: "github.com", Username: "octo", Password: "ghp_x=y"}) {
+		t.Fatalf("credential = %+v", c)
+	}
+
+	c, err = readGitCredential(strings.NewReader("url=https://octo@ghcr.io:443/org/repo.git\n"))
+	if err != nil || c.Protocol != "https" || c.Host != "ghcr.io:443" || c.Username != "octo" || c.Path != "org/repo.git" {
+		t.Fatalf("url credential = %+v, %v", c, err)
+	}
+
+	if _, err := readGitCredential(strings.NewReader("no-equals-sign\n")); err == nil {
+		t.Fatal("expected error for a line without =")
+	}
+}
+
+func TestGitCredentialKey(t *testing.T) {
+	if got := gitCredentialKey("github.com", "octo"); got != "git/github.com/octo" {
+		t.Fatalf("key = %q", got)
+	}
+	if got := gitCredentialKey("example.com:8443", "a/b"); got != "git/example.com:8443/a%2Fb" {
+		t.Fatalf("escaped key = %q", got)
+	}
+	for _, arg0 := range []string{"git-credential-secled", "/usr/local/bin/git-credential-secled", "git-credential-secled.exe"} {
+		if !isGitHelper(arg0) {
+			t.Fatalf("%q not recognised", arg0)
+		}
+	}
+	if isGitHelper("secled") {
+		t.Fatal("secled taken for the git helper")
+	}
+}
+
+func TestGitCredentialStoreGetErase(t *testing.T) {
+	isolateUserConfig(t)
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	led, master := newTestLedger(t, nil)
+	req := gitCredential{Protocol: "https", Host: "github.com", Username: "octo", Password: "ghp_one"}
+
+	key, err := gitCredentialStore(path, led, master, req)
+	if err != nil || key != "git/github.com/octo" {
+		t.Fatalf("store = %q, %v", key, err)
+	}
+	if !isFields(led.Entries[key]) {
+		t.Fatal("credential not stored as fields")
+	}
+	if key, err := gitCredentialStore(path, led, master, req); err != nil || key != "" {
+		t.Fatalf("unchanged store = %q, %v", key, err)
+	}
+
+	var out bytes.Buffer
+	if _, err := gitCredentialGet(led, master, gitCredential{Protocol: "https", Host: "github.com"}, &out); err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	want := "protocol=https\nhost=github.com\nusername=octo\npassword=ghp_one\n"
+	if out.String() != want {
+		t.Fatalf("get wrote %q, want %q", out.String(), want)
+	}
+
+	out.Reset()
+	if key, err := gitCredentialGet(led, master, gitCredential{Protocol: "http", Host: "github.com"}, &out); err != nil || key != "" || out.Len() != 0 {
+		t.Fatalf("get for another protocol = %q, %q, %v", key, out.String(), err)
+	}
+
+	req.Expiry = "1893456000"
+	req.Password = "ghp_two"
+	if _, err := gitCredentialStore(path, led, master, req); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if got := led.Entries[key].Meta[metaExpiresAt]; got != "2030-01-01T00:00:00Z" {
+		t.Fatalf("expires_at = %q", got)
+	}
+
+	req.Expiry = ""
+	req.Password = "ghp_three"
+	if _, err := gitCredentialStore(path, led, master, req); err != nil {
+		t.Fatalf("update failed: %v", err)
+	}
+	if got, ok := led.Entries[key].Meta[metaExpiresAt]; ok {
+		t.Fatalf("expires_at of the old token kept: %q", got)
+	}
+	out.Reset()
+	if _, err := gitCredentialGet(led, master, gitCredential{Protocol: "https", Host: "github.com"}, &out); err != nil || strings.Contains(out.String(), "password_expiry_utc") {
+		t.Fatalf("get after a new token = %q, %v", out.String(), err)
+	}
+
+	old := req
+	old.Password = "ghp_one"
+	if key, err := gitCredentialErase(path, led, master, old); err != nil || key != "" {
+		t.Fatalf("erase with an old password = %q, %v", key, err)
+	}
+	if key, err := gitCredentialErase(path, led, master, req); err != nil || key != "git/github.com/octo" {
+		t.Fatalf("erase = %q, %v", key, err)
+	}
+	if _, ok := led.Entries["git/github.com/octo"]; ok {
+		t.Fatal("entry not erased")
+	}
+	reloaded, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if _, ok := reloaded.Entries["git/github.com/octo"]; ok {
+		t.Fatal("erase not saved")
+	}
+}
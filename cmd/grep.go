@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// grepContext is how many characters around a match the snippet covers;
+// they are shown as *.
+const grepContext = 6
+
+type grepOptions struct {
+	Pattern    string
+	Regex      bool
+	IgnoreCase bool
+	NamesOnly  bool
+}
+
+func parseGrepArgs(args []string) (grepOptions, error) {
+	var opts grepOptions
+	usage := errors.New("usage: secled grep [--regex] [-i] [-l] <pattern>")
+	pattern := false
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--" && !pattern && i == len(args)-2:
+			opts.Pattern, pattern = args[i+1], true
+			i++
+		case arg == "--regex":
+			opts.Regex = true
+		case arg == "-i":
+			opts.IgnoreCase = true
+		case arg == "-l":
+			opts.NamesOnly = true
+		case strings.HasPrefix(arg, "-") && arg != "-":
+			return opts, fmt.Errorf("unknown option %s (use -- before a pattern that starts with -)", arg)
+		case pattern:
+			return opts, usage
+		default:
+			opts.Pattern, pattern = arg, true
+		}
+	}
+	if !pattern || opts.Pattern == "" {
+		return opts, usage
+	}
+	return opts, nil
+}
+
+// compile turns the pattern into a regular expression; a plain pattern
+// matches literally.
+func (opts grepOptions) compile() (*regexp.Regexp, error) {
+	expr := opts.Pattern
+	if !opts.Regex {
+		expr = regexp.QuoteMeta(expr)
+	}
+	if opts.IgnoreCase {
+		expr = "(?i)" + expr
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %w", err)
+	}
+	return re, nil
+}
+
+// grepHit is a value that matched, with a snippet that does not reveal
+// more than the pattern.
+type grepHit struct {
+	Name    string
+	Snippet string
+}
+
+// grepValues returns the values re matches. The snippet shows the match
+// between masked context; a regex match is masked too except its first
+// and last two characters, since it can cover more than was typed.
+func grepValues(values []storedValue, re *regexp.Regexp, regex bool) []grepHit {
+	var hits []grepHit
+	for _, v := range values {
+		loc := re.FindIndex(v.Value)
+		if loc == nil {
+			continue
+		}
+		match := []rune(string(v.Value[loc[0]:loc[1]]))
+		if regex {
+			match = maskMiddle(match, 2)
+		}
+		before := utf8.RuneCount(v.Value[:loc[0]])
+		after := utf8.RuneCount(v.Value[loc[1]:])
+
+		var b strings.Builder
+		if before > grepContext {
+			b.WriteString("…")
+		}
+		b.WriteString(strings.Repeat("*", min(before, grepContext)))
+		for _, r := range match {
+			if !unicode.IsPrint(r) {
+				r = '.'
+			}
+			b.WriteRune(r)
+		}
+		b.WriteString(strings.Repeat("*", min(after, grepContext)))
+		if after > grepContext {
+			b.WriteString("…")
+		}
+		hits = append(hits, grepHit{Name: v.Name(), Snippet: b.String()})
+	}
+	return hits
+}
+
+// maskMiddle replaces all but keep runes at each end with *.
+func maskMiddle(r []rune, keep int) []rune {
+	out := append([]rune(nil), r...)
+	for i := keep; i < len(out)-keep; i++ {
+		out[i] = '*'
+	}
+	if len(out) <= 2*keep {
+		for i := range out {
+			out[i] = '*'
+		}
+	}
+	return out
+}
+
+func cmdGrep(args []string) error {
+	opts, err := parseGrepArgs(args)
+	if err != nil {
+		return err
+	}
+	re, err := opts.compile()
+	if err != nil {
+		return err
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	p := ttyPrompter()
+	defer p.close()
+	values, skipped, err := revealValues(led, masterKey, p.prompter, nil)
+	if err != nil {
+		return err
+	}
+	defer clearValues(values)
+
+	hits := grepValues(values, re, opts.Regex)
+	for _, hit := range hits {
+		if opts.NamesOnly {
+			fmt.Fprintln(os.Stdout, hit.Name)
+		} else {
+			fmt.Fprintf(os.Stdout, "%s: %s\n", hit.Name, hit.Snippet)
+		}
+	}
+	for _, key := range skipped {
+		fmt.Fprintf(os.Stderr, "Skipped %s (policy)\n", key)
+	}
+	if len(hits) == 0 {
+		return errors.New("no value matches")
+	}
+	return nil
+}
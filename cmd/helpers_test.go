@@ -0,0 +1,78 @@
+package main
+
+import (
+	"sort"
+	"testing"
+)
+
+// isolateUserConfig points os.UserConfigDir at a temporary directory.
+func isolateUserConfig(t *testing.T) {
+	t.Helper()
+	dir := t.TempDir()
+	t.Setenv("XDG_CONFIG_HOME", dir)
+	t.Setenv("HOME", dir)
+	t.Setenv("AppData", dir)
+}
+
+func testParams() kdfParams {
+	return kdfParams{
+		Time:    1,
+		Memory:  8 * 1024,
+		Threads: 1,
+		KeyLen:  32,
+		Salt:    []byte("1234567890abcdef"),
+	}
+}
+
+// writeTestLedger saves a ledger with an initial entry and the given values.
+func writeTestLedger(t *testing.T, path string, values map[string]string) []byte {
+	t.Helper()
+	isolateUserConfig(t)
+
+	led := newLedger(testParams())
+	master := deriveKey("password", led.Params)
+	values[reservedInitialKey] = initialValue()
+	for k, v := range values {
+		e, err := encryptEntry(master, k, []byte(v))
+		if err != nil {
+			t.Fatalf("encrypt failed: %v", err)
+		}
+		led.Entries[k] = e
+	}
+	if err := saveLedger(path, led, master); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	return master
+}
+
+// newTestLedger returns an in-memory ledger holding values, and its master
+// key.
+func newTestLedger(t *testing.T, values map[string]string) (*ledger, []byte) {
+	t.Helper()
+	led := newLedger(testParams())
+	master := deriveKey("password", led.Params)
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := storeEntry(led, master, k, []byte(values[k])); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+	}
+	return led, master
+}
+
+func mustValue(t *testing.T, led *ledger, masterKey []byte, key string) string {
+	t.Helper()
+	e, ok := led.Entries[key]
+	if !ok {
+		t.Fatalf("missing key %q", key)
+	}
+	v, err := decryptEntry(masterKey, key, e)
+	if err != nil {
+		t.Fatalf("decrypt %q failed: %v", key, err)
+	}
+	return string(v)
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	macSize = sha256.Size
+
+	// integrityMarker is appended to the initial entry once a ledger has a
+	// whole-file MAC. The initial entry is authenticated by GCM, so stripping
+	// the MAC and rewriting the file as version 1 is detected.
+	integrityMarker = "integrity=hmac-sha256\n"
+)
+
+var errIntegrity = errors.New("ledger integrity check failed (file was modified outside secled)")
+
+func ledgerMAC(masterKey []byte, body []byte) ([]byte, error) {
+	macKey, err := deriveSubkey(masterKey, "ledger mac")
+	if err != nil {
+		return nil, err
+	}
+	m := hmac.New(sha256.New, macKey)
+	m.Write(body)
+	return m.Sum(nil), nil
+}
+
+// checkIntegrity verifies the whole-file MAC. initial is the decrypted
+// initial entry, used to detect a downgrade to the MAC-less format.
+func checkIntegrity(led *ledger, masterKey []byte, initial []byte) error {
+	if led.MAC == nil {
+		if bytes.Contains(initial, []byte(integrityMarker)) {
+			return fmt.Errorf("%w: integrity data is missing", errIntegrity)
+		}
+		return nil
+	}
+
+	want, err := ledgerMAC(masterKey, led.signed)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(want, led.MAC) {
+		return errIntegrity
+	}
+
+	if last := noteGeneration(led); last > led.Generation {
+		fmt.Fprintf(os.Stderr, "Warning: ledger generation %d is older than generation %d seen before on this machine (rolled back copy?)\n", led.Generation, last)
+	}
+	noteKeyCheck(led, masterKey)
+	return nil
+}
+
+// markIntegrity adds integrityMarker to the initial entry if it is missing.
+// Ledgers without an initial entry are left alone.
+func markIntegrity(led *ledger, masterKey []byte) error {
+	e, ok := led.Entries[reservedInitialKey]
+	if !ok {
+		return nil
+	}
+	plaintext, err := decryptEntry(masterKey, reservedInitialKey, e)
+	if err != nil {
+		return errWrongPassword
+	}
+	if bytes.Contains(plaintext, []byte(integrityMarker)) {
+		return nil
+	}
+	plaintext = append(plaintext, integrityMarker...)
+	enc, err := encryptEntry(masterKey, reservedInitialKey, plaintext)
+	if err != nil {
+		return err
+	}
+	enc.Meta = e.Meta
+	led.Entries[reservedInitialKey] = enc
+	return nil
+}
+
+// ledgerID identifies one copy of a ledger by its KDF salt and absolute
+// path. Copies share the salt but drift apart on purpose (see merge), so
+// each path keeps its own generation.
+func ledgerID(led *ledger) string {
+	h := sha256.New()
+	h.Write(led.Params.Salt)
+	if abs, err := filepath.Abs(led.path); err == nil {
+		h.Write([]byte(abs))
+	}
+	return hex.EncodeToString(h.Sum(nil)[:8])
+}
+
+// seenGenerationsPath is a per-user file (outside the ledger directory, which
+// may be a USB stick) that remembers the newest generation seen per ledger.
+func seenGenerationsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "secled", "generations"), nil
+}
+
+// noteGeneration is rememberGeneration on the per-user file. Failures are
+// ignored: a read-only home directory must not break secled.
+func noteGeneration(led *ledger) uint64 {
+	if led.path == "" {
+		return 0
+	}
+	seenPath, err := seenGenerationsPath()
+	if err != nil {
+		return 0
+	}
+	last, _ := rememberGeneration(seenPath, led)
+	return last
+}
+
+// rememberGeneration records the ledger's generation and returns the
+// highest generation seen before for the same ledger.
+func rememberGeneration(seenPath string, led *ledger) (uint64, error) {
+	id := ledgerID(led)
+	seen := make(map[string]uint64)
+
+	if data, err := os.ReadFile(seenPath); err == nil {
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) != 2 {
+				continue
+			}
+			gen, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				continue
+			}
+			seen[fields[0]] = gen
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+
+	last := seen[id]
+	if led.Generation <= last {
+		return last, nil
+	}
+	seen[id] = led.Generation
+
+	var buf bytes.Buffer
+	for k, v := range seen {
+		fmt.Fprintf(&buf, "%s %d\n", k, v)
+	}
+	if err := os.MkdirAll(filepath.Dir(seenPath), 0o700); err != nil {
+		return last, err
+	}
+	return last, os.WriteFile(seenPath, buf.Bytes(), 0o600)
+}
+
+// keyChecksPath is a per-user file that remembers, per private ledger, a
+// check value of the master key that opened it last. verify uses it to tell
+// a damaged sealed index from a wrong password; both fail the same way.
+func keyChecksPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "secled", "keychecks"), nil
+}
+
+// keyCheck is a one-way value of the master key. Testing a password against
+// it costs the same key derivation as testing it against the ledger.
+func keyCheck(masterKey []byte) (string, error) {
+	sub, err := deriveSubkey(masterKey, "ledger key check")
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(sub[:16]), nil
+}
+
+func readKeyChecks(checksPath string) (map[string]string, error) {
+	checks := make(map[string]string)
+	data, err := os.ReadFile(checksPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return checks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 2 {
+			checks[fields[0]] = fields[1]
+		}
+	}
+	return checks, nil
+}
+
+// noteKeyCheck records the key check of an unlocked private ledger.
+// Failures are ignored like in noteGeneration.
+func noteKeyCheck(led *ledger, masterKey []byte) {
+	if led.path == "" || !led.Private {
+		return
+	}
+	checksPath, err := keyChecksPath()
+	if err != nil {
+		return
+	}
+	checks, err := readKeyChecks(checksPath)
+	if err != nil {
+		return
+	}
+	check, err := keyCheck(masterKey)
+	if err != nil || checks[ledgerID(led)] == check {
+		return
+	}
+	checks[ledgerID(led)] = check
+
+	var buf bytes.Buffer
+	for id, check := range checks {
+		fmt.Fprintf(&buf, "%s %s\n", id, check)
+	}
+	if err := os.MkdirAll(filepath.Dir(checksPath), 0o700); err != nil {
+		return
+	}
+	_ = os.WriteFile(checksPath, buf.Bytes(), 0o600)
+}
+
+// knownKey tells whether masterKey is the key that last opened the ledger
+// on this machine.
+func knownKey(led *ledger, masterKey []byte) bool {
+	checksPath, err := keyChecksPath()
+	if err != nil {
+		return false
+	}
+	checks, err := readKeyChecks(checksPath)
+	if err != nil {
+		return false
+	}
+	check, err := keyCheck(masterKey)
+	stored, ok := checks[ledgerID(led)]
+	return err == nil && ok && hmac.Equal([]byte(stored), []byte(check))
+}
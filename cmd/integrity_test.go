@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIntegrityRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	writeTestLedger(t, path, map[string]string{"alpha": "secret"})
+
+	led, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if led.Version != ledgerVersion || led.Generation != 1 {
+		t.Fatalf("unexpected version %d generation %d", led.Version, led.Generation)
+	}
+	if _, err := verifyPassword(led, "password"); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+}
+
+func TestIntegrityDetectsRemovedEntry(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	writeTestLedger(t, path, map[string]string{"alpha": "a", "beta": "b"})
+
+	led, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+
+	// Drop an entry but keep the old MAC, as an attacker without the
+	// master key would have to.
+	mac := led.MAC
+	delete(led.Entries, "beta")
+	body, err := encodeLedger(led, nil)
+	if err != nil {
+		t.Fatalf("encode failed: %v", err)
+	}
+	if err := os.WriteFile(path, append(body, mac...), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	tampered, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if _, err := verifyPassword(tampered, "password"); !errors.Is(err, errIntegrity) {
+		t.Fatalf("expected integrity error, got %v", err)
+	}
+}
+
+func TestIntegrityDetectsTrailingData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	writeTestLedger(t, path, map[string]string{})
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if _, err := parseLedger(append(data, 0)); err == nil {
+		t.Fatalf("expected error for trailing data")
+	}
+}
+
+func TestIntegrityDetectsDowngrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	writeTestLedger(t, path, map[string]string{})
+
+	led, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	led.Version = 1
+	led.MAC = nil
+	if _, err := verifyPassword(led, "password"); !errors.Is(err, errIntegrity) {
+		t.Fatalf("expected integrity error, got %v", err)
+	}
+}
+
+func TestRememberGeneration(t *testing.T) {
+	seenPath := filepath.Join(t.TempDir(), "secled", "generations")
+	led := newLedger(testParams())
+	led.path = "ledger.encrypted"
+
+	led.Generation = 5
+	last, err := rememberGeneration(seenPath, led)
+	if err != nil {
+		t.Fatalf("remember failed: %v", err)
+	}
+	if last != 0 {
+		t.Fatalf("expected 0, got %d", last)
+	}
+
+	led.Generation = 3
+	last, err = rememberGeneration(seenPath, led)
+	if err != nil {
+		t.Fatalf("remember failed: %v", err)
+	}
+	if last != 5 {
+		t.Fatalf("expected 5, got %d", last)
+	}
+
+	data, err := os.ReadFile(seenPath)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if !bytes.Contains(data, []byte(" 5\n")) {
+		t.Fatalf("expected generation 5 to be kept, got %q", data)
+	}
+}
@@ -1,24 +1,53 @@
 package main
 
 import (
+	"bytes"
+	"encoding/base64"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 const (
 	ledgerMagic   = "SECLED1"
-	ledgerVersion = uint8(1)
+	ledgerVersion = uint8(3)
+
+	// textMagic starts the line-oriented serialization, which is meant for
+	// ledgers kept in git: a diff shows which keys changed.
+	textMagic = "SECLED-TEXT"
+
+	formatBinary = "binary"
+	formatText   = "text"
 
 	nonceSize = 12
 
-	maxKeyLen   = 8 * 1024
-	maxValueLen = 10 * 1024 * 1024
+	maxKeyLen     = 8 * 1024
+	maxValueLen   = 10 * 1024 * 1024
+	maxMetaFields = 64
+
+	metaUpdatedAt = "updated_at"
+	metaType      = "type"
+
+	// flagPrivateIndex marks a ledger whose key names are encrypted. Only
+	// the entry count is readable without the master password.
+	flagPrivateIndex = uint8(0x01)
+)
+
+var (
+	errBadHeader = errors.New("unreadable ledger header")
+	errTruncated = errors.New("ledger is truncated")
+	// errWrongPassword is what a wrong master password looks like; a
+	// damaged file can fail the same way.
+	errWrongPassword = errors.New("invalid password or corrupted ledger")
 )
 
 type kdfParams struct {
@@ -32,11 +61,41 @@ type kdfParams struct {
 type entry struct {
 	Nonce      []byte
 	Ciphertext []byte
+
+	// Meta holds plaintext attributes such as updated_at. It is not
+	// encrypted but is covered by the whole-file MAC (version 3).
+	Meta map[string]string
 }
 
 type ledger struct {
-	Params  kdfParams
-	Entries map[string]entry
+	Version    uint8
+	Format     string
+	Params     kdfParams
+	Private    bool
+	Generation uint64
+	Entries    map[string]entry
+
+	// Deleted holds tombstones: when a key was removed, so merge does not
+	// bring it back from another copy.
+	Deleted map[string]time.Time
+
+	// Count is the number of entries in the file. For a private ledger it
+	// is all that is known until unlockIndex decrypts sealedIndex.
+	Count       int
+	sealedIndex []byte
+	indexAAD    []byte
+
+	// path is where the ledger was loaded from or saved to.
+	path string
+
+	// trailing counts unparsed bytes after the entries of a version 1 file,
+	// which has no MAC to mark the end.
+	trailing int
+
+	// MAC is the whole-file MAC read from disk (nil for version 1 files) and
+	// signed holds the bytes it covers, so it can be checked after unlock.
+	MAC    []byte
+	signed []byte
 }
 
 func ledgerPath() (string, error) {
@@ -50,51 +109,83 @@ func ledgerPath() (string, error) {
 
 func newLedger(params kdfParams) *ledger {
 	return &ledger{
+		Version: ledgerVersion,
+		Format:  formatBinary,
 		Params:  params,
 		Entries: make(map[string]entry),
+		Deleted: make(map[string]time.Time),
 	}
 }
 
 func loadLedger(path string) (*ledger, error) {
-	f, err := os.Open(path)
+	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
-	defer f.Close()
+	led, err := parseLedger(data)
+	if err != nil {
+		return nil, err
+	}
+	led.path = path
+	return led, nil
+}
+
+func parseLedger(data []byte) (*ledger, error) {
+	if bytes.HasPrefix(data, []byte(textMagic+" ")) {
+		return parseLedgerText(data)
+	}
 
+	r := bytes.NewReader(data)
+
+	led, err := readHeader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadHeader, err)
+	}
+	if err := readIndex(r, data, led); err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return nil, errTruncated
+		}
+		return nil, err
+	}
+	return led, nil
+}
+
+// readHeader reads everything up to the entry count: magic, version, KDF
+// params and, from version 2, flags and generation.
+func readHeader(r io.Reader) (*ledger, error) {
 	magic := make([]byte, len(ledgerMagic))
-	if _, err := io.ReadFull(f, magic); err != nil {
+	if _, err := io.ReadFull(r, magic); err != nil {
 		return nil, err
 	}
 	if string(magic) != ledgerMagic {
-		return nil, errors.New("invalid ledger header")
+		return nil, errors.New("not a secled ledger")
 	}
 
-	version, err := readUint8(f)
+	version, err := readUint8(r)
 	if err != nil {
 		return nil, err
 	}
-	if version != ledgerVersion {
+	if version < 1 || version > ledgerVersion {
 		return nil, fmt.Errorf("unsupported ledger version: %d", version)
 	}
 
-	timeParam, err := readUint32(f)
+	timeParam, err := readUint32(r)
 	if err != nil {
 		return nil, err
 	}
-	memParam, err := readUint32(f)
+	memParam, err := readUint32(r)
 	if err != nil {
 		return nil, err
 	}
-	threadsParam, err := readUint8(f)
+	threadsParam, err := readUint8(r)
 	if err != nil {
 		return nil, err
 	}
-	keyLen, err := readUint32(f)
+	keyLen, err := readUint32(r)
 	if err != nil {
 		return nil, err
 	}
-	saltLen, err := readUint8(f)
+	saltLen, err := readUint8(r)
 	if err != nil {
 		return nil, err
 	}
@@ -103,16 +194,13 @@ func loadLedger(path string) (*ledger, error) {
 	}
 
 	salt := make([]byte, saltLen)
-	if _, err := io.ReadFull(f, salt); err != nil {
-		return nil, err
-	}
-
-	count, err := readUint32(f)
-	if err != nil {
+	if _, err := io.ReadFull(r, salt); err != nil {
 		return nil, err
 	}
 
 	led := &ledger{
+		Version: version,
+		Format:  formatBinary,
 		Params: kdfParams{
 			Time:    timeParam,
 			Memory:  memParam,
@@ -121,112 +209,259 @@ func loadLedger(path string) (*ledger, error) {
 			Salt:    salt,
 		},
 		Entries: make(map[string]entry),
+		Deleted: make(map[string]time.Time),
 	}
 
-	for i := uint32(0); i < count; i++ {
-		keyLen, err := readUint32(f)
+	if version >= 2 {
+		flags, err := readUint8(r)
+		if err != nil {
+			return nil, err
+		}
+		if flags&^flagPrivateIndex != 0 {
+			return nil, fmt.Errorf("unsupported ledger flags: %#x", flags)
+		}
+		led.Private = flags&flagPrivateIndex != 0
+		led.Generation, err = readUint64(r)
 		if err != nil {
 			return nil, err
 		}
+	}
+
+	return led, nil
+}
+
+// readIndex reads the entry count, the entries (or the sealed index of a
+// private ledger) and the MAC that follows them.
+func readIndex(r *bytes.Reader, data []byte, led *ledger) error {
+	count, err := readUint32(r)
+	if err != nil {
+		return err
+	}
+	led.Count = int(count)
+
+	if led.Private {
+		led.indexAAD = data[:len(data)-r.Len()]
+		indexLen, err := readUint32(r)
+		if err != nil {
+			return err
+		}
+		if indexLen < nonceSize {
+			return errors.New("invalid index length")
+		}
+		if int64(indexLen) > int64(r.Len()) {
+			return io.ErrUnexpectedEOF
+		}
+		led.sealedIndex = make([]byte, indexLen)
+		if _, err := io.ReadFull(r, led.sealedIndex); err != nil {
+			return err
+		}
+	} else if err := readIndexBody(r, led, count); err != nil {
+		return err
+	}
+
+	if led.Version >= 2 {
+		led.signed = data[:len(data)-r.Len()]
+		led.MAC = make([]byte, macSize)
+		if _, err := io.ReadFull(r, led.MAC); err != nil {
+			return err
+		}
+		if r.Len() != 0 {
+			return errors.New("unexpected data after ledger MAC")
+		}
+	} else {
+		led.trailing = r.Len()
+	}
+
+	return nil
+}
+
+// readIndexBody reads count entries and, from version 3, their metadata
+// and the tombstones that follow them.
+func readIndexBody(r io.Reader, led *ledger, count uint32) error {
+	for i := uint32(0); i < count; i++ {
+		keyLen, err := readUint32(r)
+		if err != nil {
+			return err
+		}
 		if keyLen == 0 || keyLen > maxKeyLen {
-			return nil, errors.New("invalid key length")
+			return errors.New("invalid key length")
 		}
 		keyBytes := make([]byte, keyLen)
-		if _, err := io.ReadFull(f, keyBytes); err != nil {
-			return nil, err
+		if _, err := io.ReadFull(r, keyBytes); err != nil {
+			return err
 		}
 
 		nonce := make([]byte, nonceSize)
-		if _, err := io.ReadFull(f, nonce); err != nil {
-			return nil, err
+		if _, err := io.ReadFull(r, nonce); err != nil {
+			return err
 		}
 
-		cipherLen, err := readUint32(f)
+		cipherLen, err := readUint32(r)
 		if err != nil {
-			return nil, err
+			return err
 		}
 		if cipherLen == 0 || cipherLen > maxValueLen {
-			return nil, errors.New("invalid ciphertext length")
+			return errors.New("invalid ciphertext length")
 		}
 		cipherText := make([]byte, cipherLen)
-		if _, err := io.ReadFull(f, cipherText); err != nil {
-			return nil, err
+		if _, err := io.ReadFull(r, cipherText); err != nil {
+			return err
 		}
 
-		led.Entries[string(keyBytes)] = entry{Nonce: nonce, Ciphertext: cipherText}
+		e := entry{Nonce: nonce, Ciphertext: cipherText}
+		if led.Version >= 3 {
+			if e.Meta, err = readMeta(r); err != nil {
+				return err
+			}
+		}
+		led.Entries[string(keyBytes)] = e
 	}
 
-	return led, nil
-}
+	if led.Version < 3 {
+		return nil
+	}
 
-func saveLedger(path string, led *ledger) error {
-	dir := filepath.Dir(path)
-	tmp, err := os.CreateTemp(dir, "ledger.encrypted.tmp")
+	deleted, err := readUint32(r)
 	if err != nil {
 		return err
 	}
-	tmpPath := tmp.Name()
-	defer func() {
-		tmp.Close()
-		_ = os.Remove(tmpPath)
-	}()
+	for i := uint32(0); i < deleted; i++ {
+		key, err := readString(r)
+		if err != nil {
+			return err
+		}
+		at, err := readUint64(r)
+		if err != nil {
+			return err
+		}
+		led.Deleted[key] = time.Unix(0, int64(at)).UTC()
+	}
+	return nil
+}
 
-	if _, err := tmp.Write([]byte(ledgerMagic)); err != nil {
-		return err
+func readMeta(r io.Reader) (map[string]string, error) {
+	count, err := readUint32(r)
+	if err != nil {
+		return nil, err
 	}
-	if err := writeUint8(tmp, ledgerVersion); err != nil {
-		return err
+	if count > maxMetaFields {
+		return nil, errors.New("invalid metadata count")
+	}
+	if count == 0 {
+		return nil, nil
+	}
+	meta := make(map[string]string, count)
+	for i := uint32(0); i < count; i++ {
+		name, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		meta[name] = value
+	}
+	return meta, nil
+}
+
+func readString(r io.Reader) (string, error) {
+	n, err := readUint32(r)
+	if err != nil {
+		return "", err
 	}
+	if n > maxKeyLen {
+		return "", errors.New("invalid string length")
+	}
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
 
-	if err := writeUint32(tmp, led.Params.Time); err != nil {
+// unlockIndex decrypts the key index of a private ledger. It does nothing
+// for ledgers that are not private or already unlocked.
+func unlockIndex(led *ledger, masterKey []byte) error {
+	if led.sealedIndex == nil {
+		return nil
+	}
+	indexKey, err := deriveSubkey(masterKey, "ledger index")
+	if err != nil {
 		return err
 	}
-	if err := writeUint32(tmp, led.Params.Memory); err != nil {
+	if len(led.sealedIndex) < nonceSize {
+		return errors.New("invalid index length")
+	}
+	plaintext, err := decryptEntry(indexKey, string(led.indexAAD), entry{
+		Nonce:      led.sealedIndex[:nonceSize],
+		Ciphertext: led.sealedIndex[nonceSize:],
+	})
+	if err != nil {
+		return errWrongPassword
+	}
+
+	r := bytes.NewReader(plaintext)
+	if err := readIndexBody(r, led, uint32(led.Count)); err != nil {
 		return err
 	}
-	if err := writeUint8(tmp, led.Params.Threads); err != nil {
+	if r.Len() != 0 || len(led.Entries) != led.Count {
+		return errors.New("corrupted ledger index")
+	}
+	led.sealedIndex = nil
+	return nil
+}
+
+// saveLedger writes the ledger in the current format. The master key is
+// needed to compute the whole-file MAC.
+func saveLedger(path string, led *ledger, masterKey []byte) error {
+	if err := writeLedger(path, led, masterKey); err != nil {
 		return err
 	}
-	if err := writeUint32(tmp, led.Params.KeyLen); err != nil {
+	noteGeneration(led)
+	noteKeyCheck(led, masterKey)
+	return nil
+}
+
+// writeLedger is saveLedger without remembering the generation and key on
+// this machine, for files that are not the ledger in use (a merge result
+// git puts in a temporary file).
+func writeLedger(path string, led *ledger, masterKey []byte) error {
+	if err := markIntegrity(led, masterKey); err != nil {
 		return err
 	}
-	if err := writeUint8(tmp, uint8(len(led.Params.Salt))); err != nil {
+	led.Version = ledgerVersion
+	led.Generation++
+
+	body, err := encodeLedger(led, masterKey)
+	if err != nil {
 		return err
 	}
-	if _, err := tmp.Write(led.Params.Salt); err != nil {
+	mac, err := ledgerMAC(masterKey, body)
+	if err != nil {
 		return err
 	}
-
-	keys := make([]string, 0, len(led.Entries))
-	for k := range led.Entries {
-		keys = append(keys, k)
+	trailer := mac
+	if led.Format == formatText {
+		trailer = []byte("mac " + base64.StdEncoding.EncodeToString(mac) + "\n")
 	}
-	sort.Strings(keys)
 
-	if err := writeUint32(tmp, uint32(len(keys))); err != nil {
+	dir := filepath.Dir(path)
+	tmp, err := os.CreateTemp(dir, "ledger.encrypted.tmp")
+	if err != nil {
 		return err
 	}
+	tmpPath := tmp.Name()
+	defer func() {
+		tmp.Close()
+		_ = os.Remove(tmpPath)
+	}()
 
-	for _, key := range keys {
-		e := led.Entries[key]
-		if err := writeUint32(tmp, uint32(len(key))); err != nil {
-			return err
-		}
-		if _, err := tmp.Write([]byte(key)); err != nil {
-			return err
-		}
-		if len(e.Nonce) != nonceSize {
-			return errors.New("invalid nonce size")
-		}
-		if _, err := tmp.Write(e.Nonce); err != nil {
-			return err
-		}
-		if err := writeUint32(tmp, uint32(len(e.Ciphertext))); err != nil {
-			return err
-		}
-		if _, err := tmp.Write(e.Ciphertext); err != nil {
-			return err
-		}
+	if _, err := tmp.Write(body); err != nil {
+		return err
+	}
+	if _, err := tmp.Write(trailer); err != nil {
+		return err
 	}
 
 	if err := tmp.Sync(); err != nil {
@@ -251,9 +486,443 @@ func saveLedger(path string, led *ledger) error {
 		_ = os.Chmod(path, 0o600)
 	}
 
+	led.Count = len(led.Entries)
+	led.path = path
+	led.signed = body
+	led.MAC = mac
+	return nil
+}
+
+// encodeLedger serializes everything the MAC covers: header, KDF params,
+// flags, generation and the sorted entries. For a private ledger the entries
+// are encrypted as one blob, which needs the master key. Writes to a
+// bytes.Buffer do not fail, so only format errors are returned.
+func encodeLedger(led *ledger, masterKey []byte) ([]byte, error) {
+	if led.sealedIndex != nil {
+		return nil, errors.New("ledger index is locked")
+	}
+	if led.Format == formatText {
+		return encodeLedgerText(led, masterKey)
+	}
+
+	var buf bytes.Buffer
+
+	buf.WriteString(ledgerMagic)
+	writeUint8(&buf, ledgerVersion)
+
+	writeUint32(&buf, led.Params.Time)
+	writeUint32(&buf, led.Params.Memory)
+	writeUint8(&buf, led.Params.Threads)
+	writeUint32(&buf, led.Params.KeyLen)
+	writeUint8(&buf, uint8(len(led.Params.Salt)))
+	buf.Write(led.Params.Salt)
+
+	flags := uint8(0)
+	if led.Private {
+		flags |= flagPrivateIndex
+	}
+	writeUint8(&buf, flags)
+	writeUint64(&buf, led.Generation)
+
+	writeUint32(&buf, uint32(len(led.Entries)))
+
+	index, err := encodeIndexBody(led)
+	if err != nil {
+		return nil, err
+	}
+	if !led.Private {
+		buf.Write(index)
+		return buf.Bytes(), nil
+	}
+
+	sealed, err := sealIndex(masterKey, buf.Bytes(), index)
+	if err != nil {
+		return nil, err
+	}
+	writeUint32(&buf, uint32(len(sealed)))
+	buf.Write(sealed)
+	return buf.Bytes(), nil
+}
+
+// sealIndex encrypts the index body of a private ledger, bound to the
+// header bytes before it. The result is nonce followed by ciphertext.
+func sealIndex(masterKey []byte, header []byte, index []byte) ([]byte, error) {
+	indexKey, err := deriveSubkey(masterKey, "ledger index")
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := encryptEntry(indexKey, string(header), index)
+	if err != nil {
+		return nil, err
+	}
+	return append(sealed.Nonce, sealed.Ciphertext...), nil
+}
+
+// parseLedgerText reads the text serialization:
+//
+//	SECLED-TEXT 3
+//	kdf argon2id time=3 memory=65536 threads=4 keylen=32 salt=<base64>
+//	index public
+//	generation 7
+//	entries 2
+//	entry "alpha" <nonce base64> <ciphertext base64> updated_at=...
+//	deleted "beta" 2026-01-02T03:04:05.123456789Z
+//	mac <base64>
+//
+// A private ledger has a single "sealed <base64>" line instead of the entry
+// and deleted lines. Keys are Go-quoted, metadata values are URL-escaped.
+func parseLedgerText(data []byte) (*ledger, error) {
+	lines := strings.SplitAfter(string(data), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	led, n, err := readTextHeader(lines)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", errBadHeader, err)
+	}
+
+	offset := 0
+	for _, line := range lines[:n] {
+		offset += len(line)
+	}
+
+	for _, line := range lines[n:] {
+		word, rest, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		switch {
+		case led.MAC != nil:
+			return nil, errors.New("unexpected data after ledger MAC")
+		case word == "entry" && !led.Private:
+			key, e, err := parseTextEntry(rest)
+			if err != nil {
+				return nil, err
+			}
+			led.Entries[key] = e
+		case word == "deleted" && !led.Private:
+			key, at, err := parseTextTombstone(rest)
+			if err != nil {
+				return nil, err
+			}
+			led.Deleted[key] = at
+		case word == "sealed" && led.Private && led.sealedIndex == nil:
+			led.indexAAD = data[:offset]
+			if led.sealedIndex, err = base64.StdEncoding.DecodeString(rest); err != nil {
+				return nil, errors.New("invalid sealed index")
+			}
+		case word == "mac":
+			led.signed = data[:offset]
+			if led.MAC, err = base64.StdEncoding.DecodeString(rest); err != nil || len(led.MAC) != macSize {
+				return nil, errors.New("invalid ledger MAC")
+			}
+		default:
+			return nil, fmt.Errorf("invalid ledger line: %q", word)
+		}
+		offset += len(line)
+	}
+
+	if led.MAC == nil || (led.Private && led.sealedIndex == nil) {
+		return nil, errTruncated
+	}
+	if !led.Private && len(led.Entries) != led.Count {
+		return nil, fmt.Errorf("ledger has %d entries, header says %d", len(led.Entries), led.Count)
+	}
+	return led, nil
+}
+
+// readTextHeader parses the fixed header lines and returns how many lines
+// it used.
+func readTextHeader(lines []string) (*ledger, int, error) {
+	const headerLines = 5
+	if len(lines) < headerLines {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	fields := make([][]string, headerLines)
+	for i := range fields {
+		fields[i] = strings.Fields(lines[i])
+	}
+
+	if len(fields[0]) != 2 || fields[0][0] != textMagic {
+		return nil, 0, errors.New("not a secled ledger")
+	}
+	version, err := strconv.ParseUint(fields[0][1], 10, 8)
+	if err != nil || version != uint64(ledgerVersion) {
+		return nil, 0, fmt.Errorf("unsupported text ledger version: %s", fields[0][1])
+	}
+
+	led := newLedger(kdfParams{})
+	led.Version = uint8(version)
+	led.Format = formatText
+
+	if len(fields[1]) != 7 || fields[1][0] != "kdf" || fields[1][1] != "argon2id" {
+		return nil, 0, errors.New("invalid kdf line")
+	}
+	kdf := make(map[string]string)
+	for _, f := range fields[1][2:] {
+		name, value, _ := strings.Cut(f, "=")
+		kdf[name] = value
+	}
+	var nums [4]uint64
+	for i, name := range []string{"time", "memory", "threads", "keylen"} {
+		if nums[i], err = strconv.ParseUint(kdf[name], 10, 32); err != nil {
+			return nil, 0, fmt.Errorf("invalid kdf %s", name)
+		}
+	}
+	if nums[2] > 255 {
+		return nil, 0, errors.New("invalid kdf threads")
+	}
+	salt, err := base64.StdEncoding.DecodeString(kdf["salt"])
+	if err != nil || len(salt) == 0 || len(salt) > 255 {
+		return nil, 0, errors.New("invalid salt")
+	}
+	led.Params = kdfParams{
+		Time:    uint32(nums[0]),
+		Memory:  uint32(nums[1]),
+		Threads: uint8(nums[2]),
+		KeyLen:  uint32(nums[3]),
+		Salt:    salt,
+	}
+
+	if len(fields[2]) != 2 || fields[2][0] != "index" {
+		return nil, 0, errors.New("invalid index line")
+	}
+	switch fields[2][1] {
+	case "public":
+	case "private":
+		led.Private = true
+	default:
+		return nil, 0, fmt.Errorf("unknown index mode: %s", fields[2][1])
+	}
+
+	if len(fields[3]) != 2 || fields[3][0] != "generation" {
+		return nil, 0, errors.New("invalid generation line")
+	}
+	if led.Generation, err = strconv.ParseUint(fields[3][1], 10, 64); err != nil {
+		return nil, 0, errors.New("invalid generation")
+	}
+
+	if len(fields[4]) != 2 || fields[4][0] != "entries" {
+		return nil, 0, errors.New("invalid entries line")
+	}
+	count, err := strconv.ParseUint(fields[4][1], 10, 32)
+	if err != nil {
+		return nil, 0, errors.New("invalid entry count")
+	}
+	led.Count = int(count)
+
+	return led, headerLines, nil
+}
+
+// parseTextEntry parses the part of an entry line after "entry ".
+func parseTextEntry(line string) (string, entry, error) {
+	key, rest, err := unquoteKey(line)
+	if err != nil {
+		return "", entry{}, err
+	}
+	if key == "" || len(key) > maxKeyLen {
+		return "", entry{}, errors.New("invalid key length")
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) < 2 {
+		return "", entry{}, fmt.Errorf("invalid entry %s", strconv.Quote(key))
+	}
+	nonce, err := base64.StdEncoding.DecodeString(fields[0])
+	if err != nil || len(nonce) != nonceSize {
+		return "", entry{}, fmt.Errorf("invalid nonce for %s", strconv.Quote(key))
+	}
+	cipherText, err := base64.StdEncoding.DecodeString(fields[1])
+	if err != nil || len(cipherText) == 0 || len(cipherText) > maxValueLen {
+		return "", entry{}, fmt.Errorf("invalid ciphertext for %s", strconv.Quote(key))
+	}
+
+	e := entry{Nonce: nonce, Ciphertext: cipherText}
+	if len(fields) > 2+maxMetaFields {
+		return "", entry{}, errors.New("invalid metadata count")
+	}
+	for _, f := range fields[2:] {
+		name, value, ok := strings.Cut(f, "=")
+		if !ok {
+			return "", entry{}, fmt.Errorf("invalid metadata for %s", strconv.Quote(key))
+		}
+		name, err1 := url.QueryUnescape(name)
+		value, err2 := url.QueryUnescape(value)
+		if err1 != nil || err2 != nil {
+			return "", entry{}, fmt.Errorf("invalid metadata for %s", strconv.Quote(key))
+		}
+		if e.Meta == nil {
+			e.Meta = make(map[string]string)
+		}
+		e.Meta[name] = value
+	}
+	return key, e, nil
+}
+
+// parseTextTombstone parses the rest of a deleted line: the quoted key
+// and the RFC3339 time of the removal.
+func parseTextTombstone(line string) (string, time.Time, error) {
+	key, rest, err := unquoteKey(line)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	at, err := time.Parse(time.RFC3339Nano, rest)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("invalid tombstone for %s", strconv.Quote(key))
+	}
+	return key, at, nil
+}
+
+func unquoteKey(s string) (string, string, error) {
+	quoted, err := strconv.QuotedPrefix(s)
+	if err != nil {
+		return "", "", errors.New("invalid quoted key")
+	}
+	key, err := strconv.Unquote(quoted)
+	if err != nil {
+		return "", "", errors.New("invalid quoted key")
+	}
+	return key, strings.TrimPrefix(s[len(quoted):], " "), nil
+}
+
+func encodeLedgerText(led *ledger, masterKey []byte) ([]byte, error) {
+	var buf bytes.Buffer
+
+	index := "public"
+	if led.Private {
+		index = "private"
+	}
+	fmt.Fprintf(&buf, "%s %d\n", textMagic, ledgerVersion)
+	fmt.Fprintf(&buf, "kdf argon2id time=%d memory=%d threads=%d keylen=%d salt=%s\n",
+		led.Params.Time, led.Params.Memory, led.Params.Threads, led.Params.KeyLen,
+		base64.StdEncoding.EncodeToString(led.Params.Salt))
+	fmt.Fprintf(&buf, "index %s\n", index)
+	fmt.Fprintf(&buf, "generation %d\n", led.Generation)
+	fmt.Fprintf(&buf, "entries %d\n", len(led.Entries))
+
+	if led.Private {
+		body, err := encodeIndexBody(led)
+		if err != nil {
+			return nil, err
+		}
+		sealed, err := sealIndex(masterKey, buf.Bytes(), body)
+		if err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, "sealed %s\n", base64.StdEncoding.EncodeToString(sealed))
+		return buf.Bytes(), nil
+	}
+
+	for _, key := range sortedKeys(led.Entries) {
+		e := led.Entries[key]
+		if len(e.Nonce) != nonceSize {
+			return nil, errors.New("invalid nonce size")
+		}
+		fmt.Fprintf(&buf, "entry %s %s %s", strconv.Quote(key),
+			base64.StdEncoding.EncodeToString(e.Nonce),
+			base64.StdEncoding.EncodeToString(e.Ciphertext))
+		names := make([]string, 0, len(e.Meta))
+		for name := range e.Meta {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(&buf, " %s=%s", url.QueryEscape(name), url.QueryEscape(e.Meta[name]))
+		}
+		buf.WriteString("\n")
+	}
+
+	deleted := make([]string, 0, len(led.Deleted))
+	for key := range led.Deleted {
+		deleted = append(deleted, key)
+	}
+	sort.Strings(deleted)
+	for _, key := range deleted {
+		fmt.Fprintf(&buf, "deleted %s %s\n", strconv.Quote(key), led.Deleted[key].UTC().Format(time.RFC3339Nano))
+	}
+	return buf.Bytes(), nil
+}
+
+func encodeIndexBody(led *ledger) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, key := range sortedKeys(led.Entries) {
+		e := led.Entries[key]
+		if len(e.Nonce) != nonceSize {
+			return nil, errors.New("invalid nonce size")
+		}
+		if len(e.Meta) > maxMetaFields {
+			return nil, errors.New("too many metadata fields")
+		}
+		writeString(&buf, key)
+		buf.Write(e.Nonce)
+		writeUint32(&buf, uint32(len(e.Ciphertext)))
+		buf.Write(e.Ciphertext)
+
+		names := make([]string, 0, len(e.Meta))
+		for name := range e.Meta {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		writeUint32(&buf, uint32(len(names)))
+		for _, name := range names {
+			writeString(&buf, name)
+			writeString(&buf, e.Meta[name])
+		}
+	}
+
+	deleted := make([]string, 0, len(led.Deleted))
+	for key := range led.Deleted {
+		deleted = append(deleted, key)
+	}
+	sort.Strings(deleted)
+	writeUint32(&buf, uint32(len(deleted)))
+	for _, key := range deleted {
+		writeString(&buf, key)
+		writeUint64(&buf, uint64(led.Deleted[key].UnixNano()))
+	}
+	return buf.Bytes(), nil
+}
+
+// storeEntry encrypts value under key and stamps updated_at. Metadata of
+// an entry it replaces is kept, and a tombstone for key is cleared.
+func storeEntry(led *ledger, masterKey []byte, key string, value []byte) error {
+	enc, err := encryptEntry(masterKey, key, value)
+	if err != nil {
+		return err
+	}
+	enc.Meta = make(map[string]string)
+	for name, v := range led.Entries[key].Meta {
+		enc.Meta[name] = v
+	}
+	enc.Meta[metaUpdatedAt] = time.Now().UTC().Format(time.RFC3339Nano)
+	led.Entries[key] = enc
+	delete(led.Deleted, key)
 	return nil
 }
 
+// deleteEntry removes key and leaves a tombstone for merge.
+func deleteEntry(led *ledger, key string) {
+	delete(led.Entries, key)
+	led.Deleted[key] = time.Now().UTC()
+}
+
+// updatedAt returns when the entry was last written, or the zero time for
+// entries from before version 3.
+func updatedAt(e entry) time.Time {
+	t, err := time.Parse(time.RFC3339, e.Meta[metaUpdatedAt])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+func sortedKeys(entries map[string]entry) []string {
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
 func readUint8(r io.Reader) (uint8, error) {
 	var b [1]byte
 	if _, err := io.ReadFull(r, b[:]); err != nil {
@@ -270,6 +939,14 @@ func readUint32(r io.Reader) (uint32, error) {
 	return binary.BigEndian.Uint32(b[:]), nil
 }
 
+func readUint64(r io.Reader) (uint64, error) {
+	var b [8]byte
+	if _, err := io.ReadFull(r, b[:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b[:]), nil
+}
+
 func writeUint8(w io.Writer, v uint8) error {
 	_, err := w.Write([]byte{v})
 	return err
@@ -281,3 +958,18 @@ func writeUint32(w io.Writer, v uint32) error {
 	_, err := w.Write(b[:])
 	return err
 }
+
+func writeString(w io.Writer, s string) error {
+	if err := writeUint32(w, uint32(len(s))); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, s)
+	return err
+}
+
+func writeUint64(w io.Writer, v uint64) error {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	_, err := w.Write(b[:])
+	return err
+}
@@ -1,11 +1,16 @@
 package main
 
 import (
+	"bytes"
+	"errors"
+	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 )
 
 func TestLedgerRoundTrip(t *testing.T) {
+	isolateUserConfig(t)
 	dir := t.TempDir()
 	path := filepath.Join(dir, "ledger.encrypted")
 
@@ -25,7 +30,7 @@ func TestLedgerRoundTrip(t *testing.T) {
 	}
 	led.Entries["alpha"] = e1
 
-	if err := saveLedger(path, led); err != nil {
+	if err := saveLedger(path, led, master); err != nil {
 		t.Fatalf("save failed: %v", err)
 	}
 
@@ -51,3 +56,199 @@ func TestLedgerRoundTrip(t *testing.T) {
 		t.Fatalf("expected secret, got %q", string(got))
 	}
 }
+
+func TestLoadLedgerVersion1(t *testing.T) {
+	params := testParams()
+	master := deriveKey("password", params)
+	e, err := encryptEntry(master, "alpha", []byte("secret"))
+	if err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(ledgerMagic)
+	writeUint8(&buf, 1)
+	writeUint32(&buf, params.Time)
+	writeUint32(&buf, params.Memory)
+	writeUint8(&buf, params.Threads)
+	writeUint32(&buf, params.KeyLen)
+	writeUint8(&buf, uint8(len(params.Salt)))
+	buf.Write(params.Salt)
+	writeUint32(&buf, 1)
+	writeUint32(&buf, uint32(len("alpha")))
+	buf.WriteString("alpha")
+	buf.Write(e.Nonce)
+	writeUint32(&buf, uint32(len(e.Ciphertext)))
+	buf.Write(e.Ciphertext)
+
+	led, err := parseLedger(buf.Bytes())
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if led.Version != 1 || led.MAC != nil {
+		t.Fatalf("expected version 1 without MAC, got version %d", led.Version)
+	}
+	got, err := decryptEntry(master, "alpha", led.Entries["alpha"])
+	if err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+	if string(got) != "secret" {
+		t.Fatalf("expected secret, got %q", string(got))
+	}
+}
+
+func TestPrivateIndexRoundTrip(t *testing.T) {
+	isolateUserConfig(t)
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+
+	led := newLedger(testParams())
+	led.Private = true
+	master := deriveKey("password", led.Params)
+	e, err := encryptEntry(master, "customer-acme", []byte("secret"))
+	if err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	led.Entries["customer-acme"] = e
+	if err := saveLedger(path, led, master); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if bytes.Contains(data, []byte("customer-acme")) {
+		t.Fatalf("key name stored in plaintext")
+	}
+
+	loaded, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if !loaded.Private || loaded.Count != 1 || len(loaded.Entries) != 0 {
+		t.Fatalf("expected locked private ledger with count 1, got private=%v count=%d entries=%d", loaded.Private, loaded.Count, len(loaded.Entries))
+	}
+
+	if err := unlockIndex(loaded, deriveKey("other", loaded.Params)); err == nil {
+		t.Fatalf("expected error with wrong password")
+	}
+	if err := unlockIndex(loaded, master); err != nil {
+		t.Fatalf("unlock failed: %v", err)
+	}
+	got, err := decryptEntry(master, "customer-acme", loaded.Entries["customer-acme"])
+	if err != nil {
+		t.Fatalf("decrypt failed: %v", err)
+	}
+	if string(got) != "secret" {
+		t.Fatalf("expected secret, got %q", string(got))
+	}
+}
+
+func TestLedgerMetaAndTombstones(t *testing.T) {
+	isolateUserConfig(t)
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+
+	led, master := newTestLedger(t, map[string]string{"alpha": "a", "beta": "b"})
+	deleteEntry(led, "beta")
+	if err := saveLedger(path, led, master); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+
+	loaded, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if updatedAt(loaded.Entries["alpha"]).IsZero() {
+		t.Fatalf("expected updated_at on alpha")
+	}
+	if _, ok := loaded.Deleted["beta"]; !ok {
+		t.Fatalf("expected tombstone for beta")
+	}
+	if _, ok := loaded.Entries["beta"]; ok {
+		t.Fatalf("did not expect beta entry")
+	}
+}
+
+func TestTextLedgerRoundTrip(t *testing.T) {
+	isolateUserConfig(t)
+	for _, private := range []bool{false, true} {
+		path := filepath.Join(t.TempDir(), "ledger.encrypted")
+
+		led := newLedger(testParams())
+		led.Format = formatText
+		led.Private = private
+		master := deriveKey("password", led.Params)
+		for _, key := range []string{reservedInitialKey, "my key", `quote"d`} {
+			if err := storeEntry(led, master, key, []byte("value of "+key)); err != nil {
+				t.Fatalf("store failed: %v", err)
+			}
+		}
+		deleteEntry(led, `quote"d`)
+		if err := saveLedger(path, led, master); err != nil {
+			t.Fatalf("save failed: %v", err)
+		}
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatalf("read failed: %v", err)
+		}
+		if !bytes.HasPrefix(data, []byte("SECLED-TEXT 3\n")) {
+			t.Fatalf("expected text header, got %q", data[:20])
+		}
+		if got := bytes.Contains(data, []byte(`entry "my key" `)); got == private {
+			t.Fatalf("private=%v but plaintext key line present=%v", private, got)
+		}
+
+		loaded, err := loadLedger(path)
+		if err != nil {
+			t.Fatalf("load failed: %v", err)
+		}
+		if loaded.Format != formatText || loaded.Private != private {
+			t.Fatalf("unexpected format %q private %v", loaded.Format, loaded.Private)
+		}
+		if _, err := verifyPassword(loaded, "password"); err != nil {
+			t.Fatalf("verify failed: %v", err)
+		}
+		if got := mustValue(t, loaded, master, "my key"); got != "value of my key" {
+			t.Fatalf("unexpected value %q", got)
+		}
+		if _, ok := loaded.Deleted[`quote"d`]; !ok {
+			t.Fatalf("expected tombstone to survive")
+		}
+	}
+}
+
+func TestTextLedgerTampering(t *testing.T) {
+	isolateUserConfig(t)
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+
+	led, master := newTestLedger(t, map[string]string{reservedInitialKey: "v", "alpha": "v", "beta": "v"})
+	led.Format = formatText
+	if err := saveLedger(path, led, master); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	// Drop the "beta" line and fix the count: only the MAC can tell.
+	var kept []string
+	for _, line := range strings.SplitAfter(string(data), "\n") {
+		if strings.HasPrefix(line, `entry "beta"`) {
+			continue
+		}
+		kept = append(kept, strings.Replace(line, "entries 3", "entries 2", 1))
+	}
+	tampered, err := parseLedger([]byte(strings.Join(kept, "")))
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	if _, err := verifyPassword(tampered, "password"); !errors.Is(err, errIntegrity) {
+		t.Fatalf("expected integrity error, got %v", err)
+	}
+
+	if _, err := parseLedger(data[:bytes.Index(data, []byte("mac "))]); !errors.Is(err, errTruncated) {
+		t.Fatalf("expected truncated error, got %v", err)
+	}
+}
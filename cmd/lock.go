@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	lockTimeout       = 10 * time.Second
+	lockRetryInterval = 100 * time.Millisecond
+
+	// staleLockAge is how old a fallback lock file must be before it is
+	// considered abandoned by a crashed process.
+	staleLockAge = 10 * time.Minute
+)
+
+var (
+	errLedgerLocked    = errors.New("ledger is locked by another secled process")
+	errLockUnsupported = errors.New("file locking is not supported")
+)
+
+// lockLedger takes an exclusive advisory lock for the ledger at path and
+// returns a function that releases it. The lock must be held for the whole
+// load, modify and save cycle so parallel secled processes do not overwrite
+// each other's changes.
+func lockLedger(path string) (func(), error) {
+	return lockLedgerTimeout(path, lockTimeout)
+}
+
+func lockLedgerTimeout(path string, timeout time.Duration) (func(), error) {
+	f, err := os.OpenFile(path+".lock", os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		ok, err := tryLockFile(f)
+		if errors.Is(err, errLockUnsupported) {
+			f.Close()
+			return lockFallback(path, timeout)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if ok {
+			return func() {
+				_ = unlockFile(f)
+				f.Close()
+			}, nil
+		}
+		if time.Now().After(deadline) {
+			f.Close()
+			return nil, fmt.Errorf("%w (waited %s)", errLedgerLocked, timeout)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// lockFallback is used where the OS or file system has no advisory locks
+// (some network and USB file systems). The lock is the existence of a file
+// created with O_EXCL, which holds the owner's PID and a random token. The
+// holder touches it every lockRefreshInterval, so only a lock of a crashed
+// process gets older than staleLockAge.
+func lockFallback(path string, timeout time.Duration) (func(), error) {
+	lockPath := path + ".lock.pid"
+	token, err := lockToken()
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		f, err := os.OpenFile(lockPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+		if err == nil {
+			_, err = f.WriteString(token)
+			if closeErr := f.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				_ = os.Remove(lockPath)
+				return nil, err
+			}
+			return holdFallback(lockPath, token), nil
+		}
+		if !errors.Is(err, os.ErrExist) {
+			return nil, err
+		}
+
+		if info, err := os.Stat(lockPath); err == nil && time.Since(info.ModTime()) > staleLockAge {
+			if err := removeStaleLock(lockPath, info); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf("%w (waited %s, remove %s if no secled is running)", errLedgerLocked, timeout, lockPath)
+		}
+		time.Sleep(lockRetryInterval)
+	}
+}
+
+// lockRefreshInterval is how often a held fallback lock is touched.
+var lockRefreshInterval = staleLockAge / 4
+
+func lockToken() (string, error) {
+	nonce := make([]byte, 8)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%d %s\n", os.Getpid(), hex.EncodeToString(nonce)), nil
+}
+
+// holdFallback keeps the lock file fresh until the returned release
+// function runs. Release removes the file only while it still holds token,
+// so a lock taken over meanwhile is left alone.
+func holdFallback(lockPath, token string) func() {
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(lockRefreshInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				now := time.Now()
+				_ = os.Chtimes(lockPath, now, now)
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		if data, err := os.ReadFile(lockPath); err == nil && string(data) == token {
+			_ = os.Remove(lockPath)
+		}
+	}
+}
+
+// removeStaleLock takes the stale lock file out of the way by renaming it
+// to a name only this process uses. The file is only renamed while it is
+// still the one found stale, and checked again after the rename (another
+// waiter may have taken over and a new holder created the lock in
+// between); a live lock that was moved by mistake is put back.
+func removeStaleLock(lockPath string, stale os.FileInfo) error {
+	staleToken, err := os.ReadFile(lockPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !sameLockFile(lockPath, stale, staleToken) {
+		return nil
+	}
+
+	token, err := lockToken()
+	if err != nil {
+		return err
+	}
+	moved := fmt.Sprintf("%s.stale.%s", lockPath, strings.Fields(token)[1])
+	if err := os.Rename(lockPath, moved); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	if sameLockFile(moved, stale, staleToken) {
+		return os.Remove(moved)
+	}
+	return putBackLock(moved, lockPath)
+}
+
+// sameLockFile tells whether path is still the file found stale, with the
+// token read from it then.
+func sameLockFile(path string, stale os.FileInfo, token []byte) bool {
+	info, err := os.Stat(path)
+	if err != nil || !os.SameFile(info, stale) || !info.ModTime().Equal(stale.ModTime()) {
+		return false
+	}
+	data, err := os.ReadFile(path)
+	return err == nil && bytes.Equal(data, token)
+}
+
+// putBackLock restores a live lock that was renamed to moved. It never
+// replaces a lock created at lockPath meanwhile; then moved is left where
+// it is and the ledger counts as locked.
+func putBackLock(moved, lockPath string) error {
+	err := os.Link(moved, lockPath)
+	if err == nil {
+		return os.Remove(moved)
+	}
+	if !errors.Is(err, os.ErrExist) {
+		// no hard links on this file system
+		if _, statErr := os.Lstat(lockPath); errors.Is(statErr, os.ErrNotExist) {
+			return os.Rename(moved, lockPath)
+		}
+	}
+	return fmt.Errorf("%w (a live lock was moved to %s while a stale one was taken over; remove it if no secled is running)", errLedgerLocked, moved)
+}
@@ -0,0 +1,13 @@
+//go:build !unix && !windows
+
+package main
+
+import "os"
+
+func tryLockFile(f *os.File) (bool, error) {
+	return false, errLockUnsupported
+}
+
+func unlockFile(f *os.File) error {
+	return nil
+}
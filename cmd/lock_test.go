@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLockLedgerExclusive(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+
+	unlock, err := lockLedgerTimeout(path, time.Second)
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+
+	if _, err := lockLedgerTimeout(path, 200*time.Millisecond); !errors.Is(err, errLedgerLocked) {
+		t.Fatalf("expected errLedgerLocked, got %v", err)
+	}
+
+	unlock()
+
+	unlock2, err := lockLedgerTimeout(path, time.Second)
+	if err != nil {
+		t.Fatalf("relock failed: %v", err)
+	}
+	unlock2()
+}
+
+func TestLockFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+
+	unlock, err := lockFallback(path, time.Second)
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	if _, err := lockFallback(path, 200*time.Millisecond); !errors.Is(err, errLedgerLocked) {
+		t.Fatalf("expected errLedgerLocked, got %v", err)
+	}
+	unlock()
+
+	if _, err := os.Stat(path + ".lock.pid"); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("expected lock file to be removed, got %v", err)
+	}
+}
+
+func TestLockFallbackStale(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	lockPath := path + ".lock.pid"
+	if err := os.WriteFile(lockPath, []byte("1\n"), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatalf("chtimes failed: %v", err)
+	}
+
+	unlock, err := lockFallback(path, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("expected stale lock to be taken over: %v", err)
+	}
+	unlock()
+}
+
+func TestLockFallbackRefresh(t *testing.T) {
+	defer func(old time.Duration) { lockRefreshInterval = old }(lockRefreshInterval)
+	lockRefreshInterval = 20 * time.Millisecond
+
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	lockPath := path + ".lock.pid"
+	unlock, err := lockFallback(path, time.Second)
+	if err != nil {
+		t.Fatalf("lock failed: %v", err)
+	}
+	defer unlock()
+
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatalf("chtimes failed: %v", err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	info, err := os.Stat(lockPath)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+	if time.Since(info.ModTime()) > time.Minute {
+		t.Fatalf("held lock was not refreshed: %s", info.ModTime())
+	}
+}
+
+func TestRemoveStaleLockKeepsNewHolder(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	lockPath := path + ".lock.pid"
+	if err := os.WriteFile(lockPath, []byte("1\n"), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	old := time.Now().Add(-2 * staleLockAge)
+	if err := os.Chtimes(lockPath, old, old); err != nil {
+		t.Fatalf("chtimes failed: %v", err)
+	}
+	stale, err := os.Stat(lockPath)
+	if err != nil {
+		t.Fatalf("stat failed: %v", err)
+	}
+
+	// another waiter takes over between our Stat and our takeover
+	unlock, err := lockFallback(path, time.Second)
+	if err != nil {
+		t.Fatalf("takeover failed: %v", err)
+	}
+	defer unlock()
+	held, err := os.ReadFile(lockPath)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	if err := removeStaleLock(lockPath, stale); err != nil {
+		t.Fatalf("removeStaleLock failed: %v", err)
+	}
+	data, err := os.ReadFile(lockPath)
+	if err != nil || string(data) != string(held) {
+		t.Fatalf("new holder's lock was removed: %q, %v", data, err)
+	}
+	if _, err := lockFallback(path, 200*time.Millisecond); !errors.Is(err, errLedgerLocked) {
+		t.Fatalf("expected errLedgerLocked, got %v", err)
+	}
+}
+
+func TestPutBackLock(t *testing.T) {
+	dir := t.TempDir()
+	lockPath := filepath.Join(dir, "ledger.encrypted.lock.pid")
+	moved := lockPath + ".stale.0123456789abcdef"
+	if err := os.WriteFile(moved, []byte("1 live\n"), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	// the renamed file was a live lock and nobody took the name since
+	if err := putBackLock(moved, lockPath); err != nil {
+		t.Fatalf("put back failed: %v", err)
+	}
+	if data, err := os.ReadFile(lockPath); err != nil || string(data) != "1 live\n" {
+		t.Fatalf("lock not restored: %q, %v", data, err)
+	}
+	if _, err := os.Stat(moved); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("moved lock left behind: %v", err)
+	}
+
+	// a new holder created the lock after the live one was renamed
+	if err := os.Rename(lockPath, moved); err != nil {
+		t.Fatalf("rename failed: %v", err)
+	}
+	if err := os.WriteFile(lockPath, []byte("2 new\n"), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	if err := putBackLock(moved, lockPath); !errors.Is(err, errLedgerLocked) {
+		t.Fatalf("expected errLedgerLocked, got %v", err)
+	}
+	if data, err := os.ReadFile(lockPath); err != nil || string(data) != "2 new\n" {
+		t.Fatalf("new holder's lock was replaced: %q, %v", data, err)
+	}
+	if data, err := os.ReadFile(moved); err != nil || string(data) != "1 live\n" {
+		t.Fatalf("live lock was removed: %q, %v", data, err)
+	}
+}
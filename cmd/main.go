@@ -6,11 +6,16 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"time"
 )
 
 const reservedInitialKey = "initial"
 
 func main() {
+	if isGitHelper(os.Args[0]) {
+		// git runs credential.helper secled as git-credential-secled <op>
+		os.Args = append([]string{os.Args[0], "git-credential"}, os.Args[1:]...)
+	}
 	if len(os.Args) < 2 {
 		usage()
 		os.Exit(1)
@@ -21,45 +26,151 @@ func main() {
 
 	switch cmd {
 	case "login":
-		err = cmdLogin()
+		err = cmdLogin(os.Args[2:])
 	case "logout":
 		err = cmdLogout()
 	case "list":
-		err = cmdList()
+		err = cmdList(os.Args[2:])
 	case "add":
 		err = cmdAdd(os.Args[2:])
 	case "get":
 		err = cmdGet(os.Args[2:])
 	case "update":
 		err = cmdUpdate(os.Args[2:])
-	case "remove":
+	case "remove", "rm":
 		err = cmdRemove(os.Args[2:])
+	case "tree":
+		err = cmdTree(os.Args[2:])
+	case "mv":
+		err = cmdMv(os.Args[2:])
+	case "rename":
+		err = cmdRename(os.Args[2:])
+	case "copy-key":
+		err = cmdCopyKey(os.Args[2:])
 	case "generate-uuid":
 		err = cmdGenerate(os.Args[2:], "uuid")
 	case "generate-64hex":
 		err = cmdGenerate(os.Args[2:], "64hex")
+	case "verify":
+		err = cmdVerify()
+	case "convert":
+		err = cmdConvert(os.Args[2:])
+	case "salvage":
+		err = cmdSalvage(os.Args[2:])
+	case "merge":
+		err = cmdMerge(os.Args[2:])
+	case "merge-driver":
+		err = cmdMergeDriver(os.Args[2:])
+	case "attach":
+		err = cmdAttach(os.Args[2:])
+	case "extract":
+		err = cmdExtract(os.Args[2:])
+	case "pick":
+		err = cmdPick(os.Args[2:])
+	case "shell":
+		err = cmdShell(os.Args[2:])
+	case "agent":
+		err = cmdAgent(os.Args[2:])
+	case "policy":
+		err = cmdPolicy(os.Args[2:])
+	case "audit":
+		err = cmdAudit(os.Args[2:])
+	case "due":
+		err = cmdDue(os.Args[2:])
+	case "git-credential":
+		err = cmdGitCredential(os.Args[2:])
+	case "redact":
+		err = cmdRedact(os.Args[2:])
+	case "scan":
+		err = cmdScan(os.Args[2:])
+	case "grep":
+		err = cmdGrep(os.Args[2:])
+	case "dupes":
+		err = cmdDupes(os.Args[2:])
+	case "audit-strength":
+		err = cmdAuditStrength(os.Args[2:])
+	case "status":
+		err = cmdStatus(os.Args[2:])
+	case "lockout":
+		err = cmdLockout(os.Args[2:])
+	case "recover":
+		err = cmdRecover(os.Args[2:])
+	case "completion":
+		err = cmdCompletion(os.Args[2:])
+	case "__complete":
+		err = cmdComplete(os.Args[2:])
 	default:
 		usage()
 		os.Exit(1)
 	}
 
+	if auditedCommands[cmd] {
+		logAudit(cmd, os.Args[2:], err)
+	}
+
 	if err != nil {
 		printError(err)
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
 		os.Exit(1)
 	}
 }
 
 func usage() {
 	fmt.Fprintln(os.Stderr, "Usage:")
-	fmt.Fprintln(os.Stderr, "  secled login")
+	fmt.Fprintln(os.Stderr, "  secled login [--private] [--format binary|text]")
 	fmt.Fprintln(os.Stderr, "  secled logout")
-	fmt.Fprintln(os.Stderr, "  secled list")
-	fmt.Fprintln(os.Stderr, "  secled add <key>")
-	fmt.Fprintln(os.Stderr, "  secled get <key>")
-	fmt.Fprintln(os.Stderr, "  secled update <key>")
-	fmt.Fprintln(os.Stderr, "  secled remove <key>")
-	fmt.Fprintln(os.Stderr, "  secled generate-uuid [-o] <key>")
-	fmt.Fprintln(os.Stderr, "  secled generate-64hex [-o] <key>")
+	fmt.Fprintln(os.Stderr, "  secled list [prefix/]")
+	fmt.Fprintln(os.Stderr, "  secled tree [prefix/]")
+	fmt.Fprintln(os.Stderr, "  secled add <key> [--field name=value|name=- ...] [--expires 90d|date] [--rotate-every 90d]")
+	fmt.Fprintln(os.Stderr, "  secled get <key>[.field] [--field name]")
+	fmt.Fprintln(os.Stderr, "  secled update <key> [--field name=value|name=- ...] [--expires 90d|date|none] [--rotate-every 90d|none]")
+	fmt.Fprintln(os.Stderr, "  secled remove|rm [-r] <key|prefix/>")
+	fmt.Fprintln(os.Stderr, "  secled mv <key|prefix/> <key|prefix/>")
+	fmt.Fprintln(os.Stderr, "  secled rename <old-key> <new-key>")
+	fmt.Fprintln(os.Stderr, "  secled copy-key <key> <new-key>")
+	fmt.Fprintln(os.Stderr, "  secled generate-uuid [-o] <key> [--expires 90d|date] [--rotate-every 90d]")
+	fmt.Fprintln(os.Stderr, "  secled generate-64hex [-o] <key> [--expires 90d|date] [--rotate-every 90d]")
+	fmt.Fprintln(os.Stderr, "  secled verify")
+	fmt.Fprintln(os.Stderr, "  secled convert [--index private|public] [--format binary|text]")
+	fmt.Fprintln(os.Stderr, "  secled salvage <in> <out>")
+	fmt.Fprintln(os.Stderr, "  secled merge <other-ledger> [--prefer ours|theirs|newer]")
+	fmt.Fprintln(os.Stderr, "  secled merge-driver [--prefer ours|theirs|newer] <base> <ours> <theirs> [<path>]")
+	fmt.Fprintln(os.Stderr, "  secled attach <key> <file>")
+	fmt.Fprintln(os.Stderr, "  secled extract <key> [--out file [--force]]")
+	fmt.Fprintln(os.Stderr, "  secled pick [--exec 'cmd {}' | --copy]")
+	fmt.Fprintln(os.Stderr, "  secled policy <key> [confirm|password|deny-noninteractive|none ...]")
+	fmt.Fprintln(os.Stderr, "  secled audit [--key key] [--since 24h|7d]")
+	fmt.Fprintln(os.Stderr, "  secled audit-strength [--all]")
+	fmt.Fprintln(os.Stderr, "  secled dupes")
+	fmt.Fprintln(os.Stderr, "  secled grep [--regex] [-i] [-l] <pattern>")
+	fmt.Fprintln(os.Stderr, "  secled scan [--encoded] [paths...] | --staged [--encoded] [pathspecs...]")
+	fmt.Fprintln(os.Stderr, "  secled redact [-- <command> [args...]]")
+	fmt.Fprintln(os.Stderr, "  secled git-credential get|store|erase")
+	fmt.Fprintln(os.Stderr, "  secled due [--within 14d]")
+	fmt.Fprintln(os.Stderr, "  secled status")
+	fmt.Fprintln(os.Stderr, "  secled lockout <attempts>|off")
+	fmt.Fprintln(os.Stderr, "  secled recover <recovery-code>")
+	fmt.Fprintln(os.Stderr, "  secled shell")
+	fmt.Fprintln(os.Stderr, "  secled agent [--timeout 15m] [--socket path] [--foreground] | --status | --stop")
+	fmt.Fprintln(os.Stderr, "  secled completion bash|zsh|fish|powershell")
+}
+
+// exitError makes main exit with a specific code so scripts can tell
+// failures apart.
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
 }
 
 func printError(err error) {
@@ -70,40 +181,67 @@ func printError(err error) {
 	fmt.Fprintln(os.Stderr, msg)
 }
 
-func cmdLogin() error {
+func cmdLogin(args []string) error {
+	private := false
+	format := ""
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--private":
+			private = true
+		case "--format":
+			if i+1 >= len(args) {
+				return errors.New("--format needs binary or text")
+			}
+			i++
+			format = args[i]
+			if format != formatBinary && format != formatText {
+				return fmt.Errorf("unknown format: %s", format)
+			}
+		default:
+			return fmt.Errorf("unknown argument: %s", args[i])
+		}
+	}
+
 	password, err := readPassword("Master password: ")
 	if err != nil {
 		return err
 	}
-	if len(password) < 8 {
-		fmt.Fprintln(os.Stderr, "Warning: password length is less than 8 characters")
-	}
-
 	path, err := ledgerPath()
 	if err != nil {
 		return err
 	}
+	unlock, err := lockLedger(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 
 	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
 		params, err := defaultKDFParams()
 		if err != nil {
 			return err
 		}
+		warnWeakMaster(password)
 		led := newLedger(params)
+		led.Private = private
+		if format != "" {
+			led.Format = format
+		}
 
 		masterKey := deriveKey(password, led.Params)
-		initEntry, err := encryptEntry(masterKey, reservedInitialKey, []byte(initialValue()))
-		if err != nil {
+		if err := storeEntry(led, masterKey, reservedInitialKey, []byte(initialValue())); err != nil {
 			return err
 		}
-		led.Entries[reservedInitialKey] = initEntry
 
-		if err := saveLedger(path, led); err != nil {
+		if err := saveLedger(path, led, masterKey); err != nil {
 			return err
 		}
 
 		fmt.Fprintln(os.Stderr, "Ledger created:", path)
 	} else if err == nil {
+		if private || format != "" {
+			return errors.New("ledger already exists (use secled convert)")
+		}
 		led, err := loadLedger(path)
 		if err != nil {
 			return err
@@ -111,6 +249,9 @@ func cmdLogin() error {
 		if _, err := verifyPassword(led, password); err != nil {
 			return err
 		}
+		if len(password) < 8 {
+			fmt.Fprintln(os.Stderr, "Warning: password length is less than 8 characters")
+		}
 	} else if err != nil {
 		return err
 	}
@@ -124,22 +265,27 @@ func cmdLogout() error {
 	return nil
 }
 
-func cmdList() error {
-	path, err := ledgerPath()
-	if err != nil {
-		return err
+func cmdList(args []string) error {
+	prefix := ""
+	if len(args) > 1 {
+		return errors.New("usage: secled list [prefix/]")
 	}
-	led, err := loadLedger(path)
+	if len(args) == 1 {
+		prefix = namespacePrefix(args[0])
+	}
+
+	led, err := loadListableLedger()
 	if err != nil {
 		return err
 	}
 
-	keys := make([]string, 0, len(led.Entries))
-	for k := range led.Entries {
-		keys = append(keys, k)
+	keys := sortedKeys(led.Entries)
+	if prefix != "" {
+		keys = listLevel(keys, prefix)
+		if len(keys) == 0 {
+			return fmt.Errorf("no keys under %s", prefix)
+		}
 	}
-	sort.Strings(keys)
-
 	for _, k := range keys {
 		fmt.Fprintln(os.Stdout, k)
 	}
@@ -147,139 +293,295 @@ func cmdList() error {
 }
 
 func cmdAdd(args []string) error {
-	key, err := parseKeyArg(args)
+	args, expiry, err := parseExpiryArgs(args, time.Now())
 	if err != nil {
 		return err
 	}
+	key, fieldArgs, err := parseKeyFieldArgs(args)
+	if err != nil {
+		return err
+	}
+	if err := checkFieldPrompts(fieldArgs); err != nil {
+		return err
+	}
 	if key == reservedInitialKey {
 		return errors.New("key 'initial' is reserved")
 	}
 
-	password, err := requirePassword()
+	path, err := ledgerPath()
 	if err != nil {
 		return err
 	}
-
-	path, err := ledgerPath()
+	unlock, err := lockLedger(path)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 	led, err := loadLedger(path)
 	if err != nil {
 		return err
 	}
-	masterKey, err := verifyPassword(led, password)
+	masterKey, err := unlockLedger(led)
 	if err != nil {
 		return err
 	}
 
-	if _, exists := led.Entries[key]; exists {
-		return errors.New("key already exists (use update)")
+	if err := addValue(led, masterKey, key, fieldArgs, readSecret); err != nil {
+		return err
 	}
+	expiry.apply(led.Entries[key])
 
-	secret, err := readSecret("Secret value: ")
-	if err != nil {
+	if err := saveLedger(path, led, masterKey); err != nil {
 		return err
 	}
 
-	enc, err := encryptEntry(masterKey, key, secret)
+	return nil
+}
+
+// secretReader asks for a secret value: readSecret on the command line,
+// the terminal of the session in secled shell.
+type secretReader func(prompt string) ([]byte, error)
+
+func addValue(led *ledger, masterKey []byte, key string, fieldArgs []fieldArg, read secretReader) error {
+	if _, exists := led.Entries[key]; exists {
+		return errors.New("key already exists (use update)")
+	}
+
+	var secret []byte
+	var err error
+	if len(fieldArgs) == 0 {
+		secret, err = read("Secret value: ")
+	} else {
+		fields := make(map[string][]byte)
+		err = readFieldValues(fieldArgs, fields, read)
+		secret = encodeFields(fields)
+	}
 	if err != nil {
 		return err
 	}
-	led.Entries[key] = enc
 
-	if err := saveLedger(path, led); err != nil {
+	if err := storeEntry(led, masterKey, key, secret); err != nil {
 		return err
 	}
-
+	if len(fieldArgs) > 0 {
+		led.Entries[key].Meta[metaType] = typeFields
+	}
 	return nil
 }
 
 func cmdGet(args []string) error {
-	key, err := parseKeyArg(args)
+	key, field, err := parseGetArgs(args)
 	if err != nil {
 		return err
 	}
 
-	password, err := requirePassword()
+	path, err := ledgerPath()
 	if err != nil {
 		return err
 	}
-
-	path, err := ledgerPath()
+	led, err := loadLedger(path)
 	if err != nil {
 		return err
 	}
-	led, err := loadLedger(path)
+	masterKey, err := unlockLedger(led)
 	if err != nil {
 		return err
 	}
-	masterKey, err := verifyPassword(led, password)
+
+	p := ttyPrompter()
+	defer p.close()
+	value, err := getValue(led, masterKey, key, field, p.prompter)
 	if err != nil {
 		return err
 	}
+	key, _ = resolveField(led.Entries, key, field)
+	if warning := expiryWarning(key, led.Entries[key], time.Now()); warning != "" {
+		fmt.Fprintln(os.Stderr, warning)
+	}
 
+	_, err = os.Stdout.Write(value)
+	return err
+}
+
+// getValue returns what get prints for key (or key.field) once the policy
+// of the key allows it.
+func getValue(led *ledger, masterKey []byte, key, field string, p prompter) ([]byte, error) {
+	key, field = resolveField(led.Entries, key, field)
 	e, ok := led.Entries[key]
 	if !ok {
-		return errors.New("key not found")
+		return nil, errors.New("key not found")
+	}
+	if isAttachment(e) {
+		return nil, errors.New("key is an attachment (use secled extract)")
+	}
+	if err := checkPolicy(led, masterKey, key, p); err != nil {
+		return nil, err
 	}
 
 	plaintext, err := decryptEntry(masterKey, key, e)
 	if err != nil {
-		return errors.New("invalid password or corrupted entry")
+		return nil, errors.New("invalid password or corrupted entry")
 	}
+	return selectField(e, plaintext, field)
+}
 
-	_, err = os.Stdout.Write(plaintext)
-	return err
+// storedValue is one decrypted value: a plain entry, or one field of a
+// structured entry.
+type storedValue struct {
+	Key   string
+	Field string
+	Value []byte
+}
+
+// Name is the key, or key.field for a field.
+func (v storedValue) Name() string {
+	if v.Field == "" {
+		return v.Key
+	}
+	return v.Key + "." + v.Field
+}
+
+// revealValues decrypts every value the policies allow to read now, sorted
+// by name; fields picks the fields of structured entries (nil for all).
+// Keys refused by their policy are returned in skipped; attachments are
+// left out.
+func revealValues(led *ledger, masterKey []byte, p prompter, fields func(name string) bool) (values []storedValue, skipped []string, err error) {
+	return decryptValues(led, masterKey, fields, func(key string) bool {
+		return checkPolicy(led, masterKey, key, p) == nil
+	})
+}
+
+// decryptValues is revealValues with allow instead of the policy check
+// (nil allows every key), for commands that never show the values.
+func decryptValues(led *ledger, masterKey []byte, fields func(name string) bool, allow func(key string) bool) (values []storedValue, skipped []string, err error) {
+	for _, key := range sortedKeys(led.Entries) {
+		e := led.Entries[key]
+		if key == reservedInitialKey || isAttachment(e) {
+			continue
+		}
+		if allow != nil && !allow(key) {
+			skipped = append(skipped, key)
+			continue
+		}
+		plaintext, err := decryptEntry(masterKey, key, e)
+		if err != nil {
+			clearValues(values)
+			return nil, nil, fmt.Errorf("%s: invalid password or corrupted entry", key)
+		}
+		if !isFields(e) {
+			values = append(values, storedValue{Key: key, Value: plaintext})
+			continue
+		}
+		decoded, err := decodeFields(plaintext)
+		clear(plaintext)
+		if err != nil {
+			clearValues(values)
+			return nil, nil, fmt.Errorf("%s: %w", key, err)
+		}
+		names := make([]string, 0, len(decoded))
+		for name := range decoded {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if fields == nil || fields(name) {
+				values = append(values, storedValue{Key: key, Field: name, Value: decoded[name]})
+			} else {
+				clear(decoded[name])
+			}
+		}
+	}
+	return values, skipped, nil
+}
+
+// clearValues zeroes the plaintexts returned by revealValues.
+func clearValues(values []storedValue) {
+	for _, v := range values {
+		clear(v.Value)
+	}
 }
 
 func cmdUpdate(args []string) error {
-	key, err := parseKeyArg(args)
+	args, expiry, err := parseExpiryArgs(args, time.Now())
 	if err != nil {
 		return err
 	}
+	key, fieldArgs, err := parseKeyFieldArgs(args)
+	if err != nil {
+		return err
+	}
+	if err := checkFieldPrompts(fieldArgs); err != nil {
+		return err
+	}
 	if key == reservedInitialKey {
 		return errors.New("key 'initial' is reserved")
 	}
 
-	password, err := requirePassword()
+	path, err := ledgerPath()
 	if err != nil {
 		return err
 	}
-
-	path, err := ledgerPath()
+	unlock, err := lockLedger(path)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 	led, err := loadLedger(path)
 	if err != nil {
 		return err
 	}
-	masterKey, err := verifyPassword(led, password)
+	masterKey, err := unlockLedger(led)
 	if err != nil {
 		return err
 	}
 
-	if _, exists := led.Entries[key]; !exists {
-		return errors.New("key not found")
+	if err := updateValue(led, masterKey, key, fieldArgs, readSecret); err != nil {
+		return err
 	}
+	expiry.apply(led.Entries[key])
 
-	secret, err := readSecret("New secret value: ")
-	if err != nil {
-		return err
+	return saveLedger(path, led, masterKey)
+}
+
+func updateValue(led *ledger, masterKey []byte, key string, fieldArgs []fieldArg, read secretReader) error {
+	e, exists := led.Entries[key]
+	if !exists {
+		return errors.New("key not found")
+	}
+	if isAttachment(e) {
+		return errors.New("key is an attachment (remove it and attach the file again)")
 	}
 
-	enc, err := encryptEntry(masterKey, key, secret)
+	var secret []byte
+	var err error
+	switch {
+	case isFields(e) && len(fieldArgs) == 0:
+		return errors.New("key has fields (use --field name=value)")
+	case !isFields(e) && len(fieldArgs) > 0:
+		return errors.New("key has no fields")
+	case len(fieldArgs) == 0:
+		secret, err = read("New secret value: ")
+	default:
+		var plaintext []byte
+		if plaintext, err = decryptEntry(masterKey, key, e); err != nil {
+			return errors.New("invalid password or corrupted entry")
+		}
+		var fields map[string][]byte
+		if fields, err = decodeFields(plaintext); err != nil {
+			return err
+		}
+		err = readFieldValues(fieldArgs, fields, read)
+		secret = encodeFields(fields)
+	}
 	if err != nil {
 		return err
 	}
-	led.Entries[key] = enc
 
-	return saveLedger(path, led)
+	return storeEntry(led, masterKey, key, secret)
 }
 
 func cmdRemove(args []string) error {
-	key, err := parseKeyArg(args)
+	key, recursive, err := parseRemoveArgs(args)
 	if err != nil {
 		return err
 	}
@@ -287,32 +589,57 @@ func cmdRemove(args []string) error {
 		return errors.New("key 'initial' is reserved")
 	}
 
-	password, err := requirePassword()
+	path, err := ledgerPath()
 	if err != nil {
 		return err
 	}
-
-	path, err := ledgerPath()
+	unlock, err := lockLedger(path)
 	if err != nil {
 		return err
 	}
+	defer unlock()
 	led, err := loadLedger(path)
 	if err != nil {
 		return err
 	}
-	if _, err := verifyPassword(led, password); err != nil {
+	masterKey, err := unlockLedger(led)
+	if err != nil {
 		return err
 	}
 
-	if _, exists := led.Entries[key]; !exists {
-		return errors.New("key not found")
+	if err := removeKeys(led, key, recursive); err != nil {
+		return err
 	}
-	delete(led.Entries, key)
 
-	return saveLedger(path, led)
+	if err := saveLedger(path, led, masterKey); err != nil {
+		return err
+	}
+	pruneAttachments(path, led)
+	return nil
+}
+
+// removeKeys deletes key, or with recursive every key in the namespace key.
+func removeKeys(led *ledger, key string, recursive bool) error {
+	keys := []string{key}
+	if recursive {
+		keys = keysUnder(sortedKeys(led.Entries), key)
+		if len(keys) == 0 {
+			return fmt.Errorf("no keys under %s", key)
+		}
+	} else if _, exists := led.Entries[key]; !exists {
+		return errors.New("key not found")
+	}
+	for _, k := range keys {
+		deleteEntry(led, k)
+	}
+	return nil
 }
 
 func cmdGenerate(args []string, kind string) error {
+	args, expiry, err := parseExpiryArgs(args, time.Now())
+	if err != nil {
+		return err
+	}
 	key, output, err := parseGenerateArgs(args)
 	if err != nil {
 		return err
@@ -321,7 +648,44 @@ func cmdGenerate(args []string, kind string) error {
 		return errors.New("key 'initial' is reserved")
 	}
 
-	password, err := requirePassword()
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockLedger(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	value, err := generateValue(led, masterKey, key, kind)
+	if err != nil {
+		return err
+	}
+	expiry.apply(led.Entries[key])
+
+	if err := saveLedger(path, led, masterKey); err != nil {
+		return err
+	}
+
+	if output {
+		_, err := os.Stdout.Write([]byte(value))
+		return err
+	}
+
+	return nil
+}
+
+func cmdConvert(args []string) error {
+	index, format, err := parseConvertArgs(args)
 	if err != nil {
 		return err
 	}
@@ -330,48 +694,87 @@ func cmdGenerate(args []string, kind string) error {
 	if err != nil {
 		return err
 	}
+	unlock, err := lockLedger(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	led, err := loadLedger(path)
 	if err != nil {
 		return err
 	}
-	masterKey, err := verifyPassword(led, password)
+	masterKey, err := unlockLedger(led)
 	if err != nil {
 		return err
 	}
 
+	if index != "" {
+		led.Private = index == "private"
+	}
+	if format != "" {
+		led.Format = format
+	}
+	if err := saveLedger(path, led, masterKey); err != nil {
+		return err
+	}
+
+	index = "public"
+	if led.Private {
+		index = "private"
+	}
+	fmt.Fprintf(os.Stderr, "Ledger is now %s format with a %s index\n", led.Format, index)
+	return nil
+}
+
+func generateValue(led *ledger, masterKey []byte, key, kind string) (string, error) {
 	if _, exists := led.Entries[key]; exists {
-		return errors.New("key already exists (use update)")
+		return "", errors.New("key already exists (use update)")
 	}
 
 	var value string
+	var err error
 	switch kind {
 	case "uuid":
 		value, err = generateUUIDv4()
 	case "64hex":
 		value, err = generate64Hex()
 	default:
-		return errors.New("unknown generator")
-	}
-	if err != nil {
-		return err
+		return "", errors.New("unknown generator")
 	}
-
-	enc, err := encryptEntry(masterKey, key, []byte(value))
 	if err != nil {
-		return err
+		return "", err
 	}
-	led.Entries[key] = enc
 
-	if err := saveLedger(path, led); err != nil {
-		return err
+	if err := storeEntry(led, masterKey, key, []byte(value)); err != nil {
+		return "", err
 	}
+	return value, nil
+}
 
-	if output {
-		_, err := os.Stdout.Write([]byte(value))
-		return err
+func parseConvertArgs(args []string) (string, string, error) {
+	usage := errors.New("usage: secled convert [--index private|public] [--format binary|text]")
+	if len(args) == 0 || len(args)%2 != 0 {
+		return "", "", usage
+	}
+	index, format := "", ""
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch args[i] {
+		case "--index":
+			if value != "private" && value != "public" {
+				return "", "", fmt.Errorf("unknown index mode: %s", value)
+			}
+			index = value
+		case "--format":
+			if value != formatBinary && value != formatText {
+				return "", "", fmt.Errorf("unknown format: %s", value)
+			}
+			format = value
+		default:
+			return "", "", usage
+		}
 	}
-
-	return nil
+	return index, format, nil
 }
 
 func parseGenerateArgs(args []string) (string, bool, error) {
@@ -403,6 +806,23 @@ func parseGenerateArgs(args []string) (string, bool, error) {
 	return key, output, nil
 }
 
+// parseRemoveArgs parses "[-r] <key>"; with -r the key is a namespace.
+func parseRemoveArgs(args []string) (string, bool, error) {
+	recursive := false
+	if len(args) > 0 && args[0] == "-r" {
+		recursive = true
+		args = args[1:]
+	}
+	key, err := parseKeyArg(args)
+	if err != nil {
+		return "", false, err
+	}
+	if recursive {
+		key = namespacePrefix(key)
+	}
+	return key, recursive, nil
+}
+
 func parseKeyArg(args []string) (string, error) {
 	if len(args) == 0 {
 		return "", errors.New("missing key")
@@ -421,14 +841,67 @@ func requirePassword() (string, error) {
 	return password, nil
 }
 
+// unlockLedger returns the master key of led: from the agent when one runs
+// for this ledger, otherwise derived from SECLED_MASTER.
+func unlockLedger(led *ledger) ([]byte, error) {
+	return unlockLedgerWith(led, requirePassword)
+}
+
+// unlockLedgerWith is unlockLedger with another source for the password,
+// which is only asked for when the agent cannot help.
+func unlockLedgerWith(led *ledger, password func() (string, error)) ([]byte, error) {
+	masterKey, agentErr := agentKey(led.path)
+	if agentErr == nil {
+		if agentErr = verifyKey(led, masterKey); agentErr == nil {
+			return masterKey, nil
+		}
+	}
+
+	pw, err := password()
+	if err != nil {
+		if agentErr != nil && !errors.Is(agentErr, errNoAgent) {
+			return nil, agentErr
+		}
+		return nil, err
+	}
+	return verifyPassword(led, pw)
+}
+
+// verifyPassword derives the master key and checks it. Wrong passwords are
+// counted and slowed down (see throttle.go).
 func verifyPassword(led *ledger, password string) ([]byte, error) {
+	if err := checkThrottle(led.path); err != nil {
+		return nil, err
+	}
 	masterKey := deriveKey(password, led.Params)
+	err := verifyKey(led, masterKey)
+	if errors.Is(err, errWrongPassword) {
+		noteUnlock(led.path, false)
+	}
+	if err != nil {
+		return nil, err
+	}
+	noteUnlock(led.path, true)
+	return masterKey, nil
+}
+
+// verifyKey checks masterKey against the initial entry and the whole-file
+// MAC, decrypting a private index on the way.
+func verifyKey(led *ledger, masterKey []byte) error {
+	if err := unlockIndex(led, masterKey); err != nil {
+		return err
+	}
 	initEntry, ok := led.Entries[reservedInitialKey]
 	if !ok {
-		return nil, errors.New("missing initial entry in ledger")
+		return errors.New("missing initial entry in ledger")
 	}
-	if _, err := decryptEntry(masterKey, reservedInitialKey, initEntry); err != nil {
-		return nil, errors.New("invalid password or corrupted ledger")
+	initial, err := decryptEntry(masterKey, reservedInitialKey, initEntry)
+	if err != nil {
+		return errWrongPassword
 	}
-	return masterKey, nil
+	if err := checkIntegrity(led, masterKey, initial); err != nil {
+		return err
+	}
+	noteAuditKey(led, masterKey)
+	return nil
 }
@@ -0,0 +1,400 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+const (
+	preferAsk    = ""
+	preferOurs   = "ours"
+	preferTheirs = "theirs"
+	preferNewer  = "newer"
+)
+
+// mergeStats counts what mergeLedgers changed in the local ledger.
+type mergeStats struct {
+	Added     int
+	Updated   int
+	Deleted   int
+	Conflicts int
+}
+
+// conflictResolver decides a conflict on key, returning true to take the
+// other ledger's value.
+type conflictResolver func(key string, ours, theirs entry) (bool, error)
+
+func cmdMerge(args []string) error {
+	other, prefer, err := parseMergeArgs(args)
+	if err != nil {
+		return err
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockLedger(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	theirs, err := loadLedger(other)
+	if err != nil {
+		return err
+	}
+	// Copies of one ledger share the KDF salt, so the same key usually
+	// opens both; otherwise try SECLED_MASTER and then ask for the other
+	// ledger's password.
+	theirsKey := masterKey
+	err = verifyKey(theirs, masterKey)
+	if password, perr := requirePassword(); err != nil && !errors.Is(err, errIntegrity) && perr == nil {
+		theirsKey, err = verifyPassword(theirs, password)
+	}
+	if err != nil && !errors.Is(err, errIntegrity) {
+		otherPassword, perr := readPassword("Master password of " + other + ": ")
+		if perr != nil {
+			return err
+		}
+		theirsKey, err = verifyPassword(theirs, otherPassword)
+	}
+	if err != nil {
+		return err
+	}
+
+	basePath, err := mergeBasePath(led, theirs)
+	if err != nil {
+		return err
+	}
+	base, err := loadMergeBase(basePath, masterKey)
+	if err != nil {
+		return err
+	}
+	stats, err := mergeLedgers(led, theirs, masterKey, theirsKey, base, resolverFor(prefer))
+	if err != nil {
+		return err
+	}
+
+	if theirs.Generation > led.Generation {
+		led.Generation = theirs.Generation
+	}
+	if err := copyAttachments(other, path, led); err != nil {
+		return err
+	}
+	if err := saveLedger(path, led, masterKey); err != nil {
+		return err
+	}
+	pruneAttachments(path, led)
+	if err := base.save(); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: cannot remember the merge base:", err)
+	}
+
+	fmt.Fprintf(os.Stderr, "Merged %s: %d added, %d updated, %d deleted, %d conflicts resolved\n", other, stats.Added, stats.Updated, stats.Deleted, stats.Conflicts)
+	return nil
+}
+
+func parseMergeArgs(args []string) (string, string, error) {
+	other := ""
+	prefer := preferAsk
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		switch {
+		case arg == "--prefer":
+			if i+1 >= len(args) {
+				return "", "", errors.New("--prefer needs ours, theirs or newer")
+			}
+			i++
+			prefer = args[i]
+		case strings.HasPrefix(arg, "--prefer="):
+			prefer = strings.TrimPrefix(arg, "--prefer=")
+		case strings.HasPrefix(arg, "-"):
+			return "", "", fmt.Errorf("unknown flag: %s", arg)
+		case other != "":
+			return "", "", errors.New("too many arguments")
+		default:
+			other = arg
+		}
+	}
+	if other == "" {
+		return "", "", errors.New("usage: secled merge <other-ledger> [--prefer ours|theirs|newer]")
+	}
+	switch prefer {
+	case preferAsk, preferOurs, preferTheirs, preferNewer:
+	default:
+		return "", "", fmt.Errorf("unknown --prefer value: %s", prefer)
+	}
+	return other, prefer, nil
+}
+
+// mergeLedgers applies the changes of theirs to ours. Entries are compared
+// by value; when base knows the values both sides had after the last merge,
+// a key changed on one side only takes that side's value and only a key
+// changed on both is a conflict. Without a base every difference is a
+// conflict. Tombstones keep deleted keys from coming back unless they were
+// written again after the deletion. Values taken from theirs are
+// re-encrypted under ours' master key with their metadata kept. The
+// initial entry belongs to each ledger and is never merged. base may be
+// nil; otherwise it is updated to the result.
+func mergeLedgers(ours, theirs *ledger, oursKey, theirsKey []byte, base *mergeBase, resolve conflictResolver) (mergeStats, error) {
+	var stats mergeStats
+
+	keys := make(map[string]entry, len(theirs.Entries)+len(theirs.Deleted))
+	for key, e := range theirs.Entries {
+		keys[key] = e
+	}
+	for key := range theirs.Deleted {
+		keys[key] = entry{}
+	}
+	next := make(map[string]syncPoint)
+
+	// sorted, so conflicts are asked in a stable order
+	for _, key := range sortedKeys(keys) {
+		if key == reservedInitialKey {
+			continue
+		}
+		o, inOurs := ours.Entries[key]
+		t, inTheirs := theirs.Entries[key]
+		oursDeleted, oursHasTomb := ours.Deleted[key]
+		theirsDeleted, theirsHasTomb := theirs.Deleted[key]
+
+		switch {
+		case inTheirs && !inOurs:
+			if oursHasTomb && !oursDeleted.Before(updatedAt(t)) {
+				continue
+			}
+			if err := takeEntry(ours, theirs, oursKey, theirsKey, key); err != nil {
+				return stats, err
+			}
+			stats.Added++
+			if base != nil {
+				if tv, err := decryptEntry(theirsKey, key, t); err == nil {
+					next[base.mac(key)] = syncPoint{Ours: base.mac(key, tv), Theirs: base.mac(key, tv)}
+				}
+			}
+
+		case inOurs && !inTheirs:
+			if theirsHasTomb && theirsDeleted.After(updatedAt(o)) {
+				delete(ours.Entries, key)
+				ours.Deleted[key] = theirsDeleted
+				stats.Deleted++
+			}
+
+		case inOurs && inTheirs:
+			ov, err := decryptEntry(oursKey, key, o)
+			if err != nil {
+				return stats, fmt.Errorf("cannot decrypt %s in this ledger", strconv.Quote(key))
+			}
+			tv, err := decryptEntry(theirsKey, key, t)
+			if err != nil {
+				return stats, fmt.Errorf("cannot decrypt %s in the other ledger", strconv.Quote(key))
+			}
+			take, err := mergeEntry(key, o, t, ov, tv, base, resolve, &stats)
+			if err != nil {
+				return stats, err
+			}
+			if take {
+				if err := takeEntry(ours, theirs, oursKey, theirsKey, key); err != nil {
+					return stats, err
+				}
+				stats.Updated++
+				ov = tv
+			}
+			if base != nil {
+				next[base.mac(key)] = syncPoint{Ours: base.mac(key, ov), Theirs: base.mac(key, tv)}
+			}
+
+		default:
+			if theirsHasTomb && theirsDeleted.After(oursDeleted) {
+				ours.Deleted[key] = theirsDeleted
+			}
+		}
+	}
+	if base != nil {
+		base.points = next
+	}
+	return stats, nil
+}
+
+// mergeEntry decides a key both ledgers hold: true takes theirs.
+func mergeEntry(key string, o, t entry, ov, tv []byte, base *mergeBase, resolve conflictResolver, stats *mergeStats) (bool, error) {
+	if bytes.Equal(ov, tv) {
+		return false, nil
+	}
+	if base != nil {
+		if p, ok := base.points[base.mac(key)]; ok {
+			oursChanged := p.Ours != base.mac(key, ov)
+			theirsChanged := p.Theirs != base.mac(key, tv)
+			if !theirsChanged {
+				return false, nil
+			}
+			if !oursChanged {
+				return true, nil
+			}
+		}
+	}
+	stats.Conflicts++
+	return resolve(key, o, t)
+}
+
+func takeEntry(ours, theirs *ledger, oursKey, theirsKey []byte, key string) error {
+	t := theirs.Entries[key]
+	value, err := decryptEntry(theirsKey, key, t)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt %s in the other ledger", strconv.Quote(key))
+	}
+	enc, err := encryptEntry(oursKey, key, value)
+	if err != nil {
+		return err
+	}
+	enc.Meta = t.Meta
+	ours.Entries[key] = enc
+	delete(ours.Deleted, key)
+	return nil
+}
+
+func resolverFor(prefer string) conflictResolver {
+	switch prefer {
+	case preferOurs:
+		return func(string, entry, entry) (bool, error) { return false, nil }
+	case preferTheirs:
+		return func(string, entry, entry) (bool, error) { return true, nil }
+	case preferNewer:
+		return func(_ string, o, t entry) (bool, error) { return updatedAt(t).After(updatedAt(o)), nil }
+	}
+	return askConflict
+}
+
+func askConflict(key string, o, t entry) (bool, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false, fmt.Errorf("conflict on %s (use --prefer ours|theirs|newer)", strconv.Quote(key))
+	}
+	reader := bufio.NewReader(os.Stdin)
+	for {
+		fmt.Fprintf(os.Stderr, "Conflict on %s: ours updated %s, theirs updated %s. Keep [o]urs or [t]heirs? ",
+			strconv.Quote(key), formatUpdated(o), formatUpdated(t))
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return false, err
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "o", "ours":
+			return false, nil
+		case "t", "theirs":
+			return true, nil
+		}
+	}
+}
+
+func formatUpdated(e entry) string {
+	t := updatedAt(e)
+	if t.IsZero() {
+		return "unknown"
+	}
+	return t.Local().Format(time.DateTime)
+}
+
+// syncPoint is what one key held in both ledgers after a merge, as HMACs.
+type syncPoint struct {
+	Ours   string
+	Theirs string
+}
+
+// mergeBase remembers, per peer ledger, the values both sides had after the
+// last merge, so the next merge can tell which side changed a key. Key names
+// and values are stored as HMACs under a subkey of the master key, so the
+// file reveals neither.
+type mergeBase struct {
+	path   string
+	macKey []byte
+	points map[string]syncPoint
+}
+
+// mergeBasePath is a per-user file for the pair of ledgers, named by both
+// ledgerIDs.
+func mergeBasePath(ours, theirs *ledger) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "secled", "merge-base", ledgerID(ours)+"-"+ledgerID(theirs)), nil
+}
+
+func newMergeBase(masterKey []byte) (*mergeBase, error) {
+	macKey, err := deriveSubkey(masterKey, "merge base")
+	if err != nil {
+		return nil, err
+	}
+	return &mergeBase{macKey: macKey, points: make(map[string]syncPoint)}, nil
+}
+
+// loadMergeBase reads the base of the last merge; it is empty before the
+// first one.
+func loadMergeBase(path string, masterKey []byte) (*mergeBase, error) {
+	b, err := newMergeBase(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	b.path = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) == 3 {
+			b.points[fields[0]] = syncPoint{Ours: fields[1], Theirs: fields[2]}
+		}
+	}
+	return b, nil
+}
+
+// mac identifies a key name, or with a value the value of a key.
+func (b *mergeBase) mac(key string, value ...[]byte) string {
+	m := hmac.New(sha256.New, b.macKey)
+	m.Write([]byte(key))
+	for _, v := range value {
+		m.Write([]byte{0})
+		m.Write(v)
+	}
+	return hex.EncodeToString(m.Sum(nil)[:16])
+}
+
+func (b *mergeBase) save() error {
+	names := make([]string, 0, len(b.points))
+	for name := range b.points {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&buf, "%s %s %s\n", name, b.points[name].Ours, b.points[name].Theirs)
+	}
+	if err := os.MkdirAll(filepath.Dir(b.path), 0o700); err != nil {
+		return err
+	}
+	return os.WriteFile(b.path, buf.Bytes(), 0o600)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mergeTestLedger(t *testing.T, salt string) (*ledger, []byte) {
+	t.Helper()
+	params := testParams()
+	params.Salt = []byte(salt)
+	led := newLedger(params)
+	return led, deriveKey("password", params)
+}
+
+func putAt(t *testing.T, led *ledger, masterKey []byte, key, value string, at time.Time) {
+	t.Helper()
+	e, err := encryptEntry(masterKey, key, []byte(value))
+	if err != nil {
+		t.Fatalf("encrypt failed: %v", err)
+	}
+	e.Meta = map[string]string{metaUpdatedAt: at.UTC().Format(time.RFC3339)}
+	led.Entries[key] = e
+}
+
+func TestMergeLedgers(t *testing.T) {
+	day := 24 * time.Hour
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	ours, oursKey := mergeTestLedger(t, "salt-ours-012345")
+	theirs, theirsKey := mergeTestLedger(t, "salt-theirs-0123")
+
+	putAt(t, ours, oursKey, "same", "v", t0)
+	putAt(t, theirs, theirsKey, "same", "v", t0)
+
+	putAt(t, theirs, theirsKey, "new-there", "n", t0)
+
+	putAt(t, ours, oursKey, "removed-there", "r", t0)
+	theirs.Deleted["removed-there"] = t0.Add(day)
+
+	ours.Deleted["removed-here"] = t0.Add(day)
+	putAt(t, theirs, theirsKey, "removed-here", "old", t0)
+
+	putAt(t, ours, oursKey, "conflict", "ours", t0)
+	putAt(t, theirs, theirsKey, "conflict", "theirs", t0.Add(day))
+
+	putAt(t, ours, oursKey, "kept-newer", "ours", t0.Add(2*day))
+	putAt(t, theirs, theirsKey, "kept-newer", "theirs", t0.Add(day))
+
+	stats, err := mergeLedgers(ours, theirs, oursKey, theirsKey, nil, resolverFor(preferNewer))
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+
+	if got := mustValue(t, ours, oursKey, "new-there"); got != "n" {
+		t.Fatalf("expected new-there to be added, got %q", got)
+	}
+	if _, ok := ours.Entries["removed-there"]; ok {
+		t.Fatalf("expected removed-there to be deleted")
+	}
+	if _, ok := ours.Entries["removed-here"]; ok {
+		t.Fatalf("expected removed-here to stay deleted")
+	}
+	if got := mustValue(t, ours, oursKey, "conflict"); got != "theirs" {
+		t.Fatalf("expected newer value for conflict, got %q", got)
+	}
+	if got := mustValue(t, ours, oursKey, "kept-newer"); got != "ours" {
+		t.Fatalf("expected newer value for kept-newer, got %q", got)
+	}
+
+	want := mergeStats{Added: 1, Updated: 1, Deleted: 1, Conflicts: 2}
+	if stats != want {
+		t.Fatalf("expected %+v, got %+v", want, stats)
+	}
+}
+
+func TestMergeReAddAfterDelete(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ours, oursKey := mergeTestLedger(t, "salt-ours-012345")
+	theirs, theirsKey := mergeTestLedger(t, "salt-theirs-0123")
+
+	ours.Deleted["token"] = t0
+	putAt(t, theirs, theirsKey, "token", "fresh", t0.Add(time.Hour))
+
+	if _, err := mergeLedgers(ours, theirs, oursKey, theirsKey, nil, resolverFor(preferOurs)); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if got := mustValue(t, ours, oursKey, "token"); got != "fresh" {
+		t.Fatalf("expected key written after the deletion to come back, got %q", got)
+	}
+	if _, ok := ours.Deleted["token"]; ok {
+		t.Fatalf("expected tombstone to be cleared")
+	}
+}
+
+func TestParseMergeArgs(t *testing.T) {
+	other, prefer, err := parseMergeArgs([]string{"/media/usb/ledger.encrypted", "--prefer", "newer"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if other != "/media/usb/ledger.encrypted" || prefer != preferNewer {
+		t.Fatalf("unexpected result %q %q", other, prefer)
+	}
+	if _, _, err := parseMergeArgs([]string{"x", "--prefer=mine"}); err == nil {
+		t.Fatalf("expected error for unknown --prefer value")
+	}
+	if _, _, err := parseMergeArgs(nil); err == nil {
+		t.Fatalf("expected error for missing ledger")
+	}
+}
+
+func TestMergeWithBase(t *testing.T) {
+	isolateUserConfig(t)
+	t0 := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	ours, oursKey := mergeTestLedger(t, "salt-ours-012345")
+	theirs, theirsKey := mergeTestLedger(t, "salt-theirs-0123")
+	basePath := filepath.Join(t.TempDir(), "base")
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		putAt(t, ours, oursKey, key, "ours-"+key, t0)
+		putAt(t, theirs, theirsKey, key, "theirs-"+key, t0)
+	}
+	putAt(t, theirs, theirsKey, "same", "v", t0)
+
+	// without a base every difference is a conflict, asked in key order
+	var asked []string
+	recordOurs := func(key string, _, _ entry) (bool, error) {
+		asked = append(asked, key)
+		return false, nil
+	}
+	base, err := loadMergeBase(basePath, oursKey)
+	if err != nil {
+		t.Fatalf("load base failed: %v", err)
+	}
+	if _, err := mergeLedgers(ours, theirs, oursKey, theirsKey, base, recordOurs); err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if strings.Join(asked, ",") != "a,b,c,d" {
+		t.Fatalf("expected conflicts in key order, got %v", asked)
+	}
+	if err := base.save(); err != nil {
+		t.Fatalf("save base failed: %v", err)
+	}
+
+	// a changed on their side only, b on ours only, c on both, d on neither
+	putAt(t, theirs, theirsKey, "a", "theirs-a2", t0.Add(time.Hour))
+	putAt(t, ours, oursKey, "b", "ours-b2", t0.Add(time.Hour))
+	putAt(t, ours, oursKey, "c", "ours-c2", t0.Add(time.Hour))
+	putAt(t, theirs, theirsKey, "c", "theirs-c2", t0.Add(time.Hour))
+
+	asked = nil
+	base, err = loadMergeBase(basePath, oursKey)
+	if err != nil {
+		t.Fatalf("load base failed: %v", err)
+	}
+	stats, err := mergeLedgers(ours, theirs, oursKey, theirsKey, base, recordOurs)
+	if err != nil {
+		t.Fatalf("merge failed: %v", err)
+	}
+	if strings.Join(asked, ",") != "c" {
+		t.Fatalf("expected only c to be a conflict, got %v", asked)
+	}
+	for key, want := range map[string]string{"a": "theirs-a2", "b": "ours-b2", "c": "ours-c2", "d": "ours-d", "same": "v"} {
+		if got := mustValue(t, ours, oursKey, key); got != want {
+			t.Fatalf("%s: expected %q, got %q", key, want, got)
+		}
+	}
+	if stats.Updated != 1 || stats.Conflicts != 1 {
+		t.Fatalf("expected 1 update and 1 conflict, got %+v", stats)
+	}
+
+	data, err := os.ReadFile(basePath)
+	if err != nil {
+		t.Fatalf("read base failed: %v", err)
+	}
+	if strings.Contains(string(data), "same") || strings.Contains(string(data), "ours-") {
+		t.Fatalf("base file reveals keys or values:\n%s", data)
+	}
+}
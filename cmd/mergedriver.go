@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// cmdMergeDriver is a git merge driver for a ledger kept in git. Every save
+// rewrites the generation and mac lines, so git alone reports a conflict
+// even for changes to different keys; the driver merges the entries
+// instead, against the common ancestor git passes, and writes a new file
+// with its own generation and MAC:
+//
+//	git config merge.secled.driver "secled merge-driver %O %A %B %P"
+//	echo "ledger.encrypted merge=secled -text" >> .gitattributes
+//
+// The result replaces ours (%A). A key changed on both sides is a conflict
+// resolved by --prefer or asked on the TTY; without either the driver
+// fails and git reports the file as conflicted.
+func cmdMergeDriver(args []string) error {
+	prefer := preferAsk
+	var files []string
+	for i := 0; i < len(args); i++ {
+		switch arg := args[i]; {
+		case arg == "--prefer" && i+1 < len(args):
+			i++
+			prefer = args[i]
+		case strings.HasPrefix(arg, "--prefer="):
+			prefer = strings.TrimPrefix(arg, "--prefer=")
+		default:
+			files = append(files, arg)
+		}
+	}
+	switch prefer {
+	case preferAsk, preferOurs, preferTheirs, preferNewer:
+	default:
+		return fmt.Errorf("unknown --prefer value: %s", prefer)
+	}
+	if len(files) != 3 && len(files) != 4 {
+		return errors.New("usage: secled merge-driver [--prefer ours|theirs|newer] <base> <ours> <theirs> [<path>]")
+	}
+
+	// The files are temporary copies; the failed unlock counter and the
+	// agent belong to the ledger in the work tree.
+	ledgerFile := ""
+	if len(files) == 4 {
+		ledgerFile = files[3]
+	} else if p, err := ledgerPath(); err == nil {
+		ledgerFile = p
+	}
+
+	ours, err := loadLedger(files[1])
+	if err != nil {
+		return err
+	}
+	ours.path = ledgerFile
+	masterKey, err := unlockLedger(ours)
+	if err != nil {
+		return err
+	}
+	theirs, err := loadMergeSide(files[2], masterKey)
+	if err != nil {
+		return fmt.Errorf("their version: %w", err)
+	}
+	base, err := newMergeBase(masterKey)
+	if err != nil {
+		return err
+	}
+	// git passes an empty file when the sides have no common ancestor
+	if info, err := os.Stat(files[0]); err != nil {
+		return err
+	} else if info.Size() > 0 {
+		ancestor, err := loadMergeSide(files[0], masterKey)
+		if err != nil {
+			return fmt.Errorf("common ancestor: %w", err)
+		}
+		base.addAncestor(ancestor, masterKey)
+	}
+
+	stats, err := mergeLedgers(ours, theirs, masterKey, masterKey, base, resolverFor(prefer))
+	if err != nil {
+		return err
+	}
+	ours.Generation = max(ours.Generation, theirs.Generation)
+	if err := writeLedger(files[1], ours, masterKey); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "secled: merged %s: %d added, %d updated, %d deleted, %d conflicts resolved\n", ledgerFile, stats.Added, stats.Updated, stats.Deleted, stats.Conflicts)
+	return nil
+}
+
+// loadMergeSide loads another version of the ledger, which must open with
+// the same key; a branch that changed the master password cannot be merged
+// entry by entry.
+func loadMergeSide(path string, masterKey []byte) (*ledger, error) {
+	led, err := loadLedger(path)
+	if err != nil {
+		return nil, err
+	}
+	// not a ledger in use: nothing is remembered for its path
+	led.path = ""
+	if err := verifyKey(led, masterKey); err != nil {
+		if errors.Is(err, errWrongPassword) {
+			return nil, errors.New("different master password (merge with secled merge instead)")
+		}
+		return nil, err
+	}
+	return led, nil
+}
+
+// addAncestor makes the values of the common ancestor the base of both
+// sides.
+func (b *mergeBase) addAncestor(ancestor *ledger, masterKey []byte) {
+	for key, e := range ancestor.Entries {
+		value, err := decryptEntry(masterKey, key, e)
+		if err != nil {
+			continue
+		}
+		v := b.mac(key, value)
+		b.points[b.mac(key)] = syncPoint{Ours: v, Theirs: v}
+		clear(value)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// saveTextCopy writes led as a text ledger to a new file in dir.
+func saveTextCopy(t *testing.T, dir, name string, led *ledger, masterKey []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	led.Format = formatText
+	if err := saveLedger(path, led, masterKey); err != nil {
+		t.Fatalf("save %s failed: %v", name, err)
+	}
+	return path
+}
+
+func TestMergeDriver(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ledger.encrypted")
+	master := writeTestLedger(t, path, map[string]string{"a": "1", "b": "2", "c": "3"})
+	t.Setenv(agentSockEnv, filepath.Join(dir, "no-agent.sock"))
+	t.Setenv("SECLED_MASTER", "password")
+
+	load := func() *ledger {
+		led, err := loadLedger(path)
+		if err != nil {
+			t.Fatalf("load failed: %v", err)
+		}
+		return led
+	}
+	base := saveTextCopy(t, dir, "base", load(), master)
+
+	led := load()
+	if err := storeEntry(led, master, "a", []byte("ours")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	ours := saveTextCopy(t, dir, "ours", led, master)
+
+	led = load()
+	if err := storeEntry(led, master, "b", []byte("theirs")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	deleteEntry(led, "c")
+	led.Generation += 5
+	theirs := saveTextCopy(t, dir, "theirs", led, master)
+
+	// without a TTY a conflict would fail the merge
+	if err := cmdMergeDriver([]string{base, ours, theirs, path}); err != nil {
+		t.Fatalf("merge driver failed: %v", err)
+	}
+	merged, err := loadLedger(ours)
+	if err != nil {
+		t.Fatalf("load merged failed: %v", err)
+	}
+	if err := verifyKey(merged, master); err != nil {
+		t.Fatalf("merged file does not verify: %v", err)
+	}
+	if got := mustValue(t, merged, master, "a"); got != "ours" {
+		t.Fatalf("expected our change of a, got %q", got)
+	}
+	if got := mustValue(t, merged, master, "b"); got != "theirs" {
+		t.Fatalf("expected their change of b, got %q", got)
+	}
+	if _, ok := merged.Entries["c"]; ok {
+		t.Fatalf("expected their deletion of c")
+	}
+	if merged.Format != formatText || merged.Generation <= led.Generation {
+		t.Fatalf("unexpected format %q or generation %d", merged.Format, merged.Generation)
+	}
+
+	data, err := os.ReadFile(filepath.Join(os.Getenv("XDG_CONFIG_HOME"), "secled", "generations"))
+	if err != nil {
+		t.Fatalf("read generations failed: %v", err)
+	}
+	if n := strings.Count(string(data), "\n"); n != 4 {
+		// ledger, base, ours and theirs were saved by the test itself
+		t.Fatalf("merge driver remembered temporary files:\n%s", data)
+	}
+}
+
+func TestMergeDriverConflict(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ledger.encrypted")
+	master := writeTestLedger(t, path, map[string]string{"a": "1"})
+	t.Setenv(agentSockEnv, filepath.Join(dir, "no-agent.sock"))
+	t.Setenv("SECLED_MASTER", "password")
+
+	led, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	base := saveTextCopy(t, dir, "base", led, master)
+	for _, side := range []string{"ours", "theirs"} {
+		if err := storeEntry(led, master, "a", []byte(side)); err != nil {
+			t.Fatalf("store failed: %v", err)
+		}
+		saveTextCopy(t, dir, side, led, master)
+	}
+	ours, theirs := filepath.Join(dir, "ours"), filepath.Join(dir, "theirs")
+
+	if err := cmdMergeDriver([]string{base, ours, theirs, path}); err == nil || !strings.Contains(err.Error(), "conflict") {
+		t.Fatalf("expected a conflict without a TTY, got %v", err)
+	}
+	if err := cmdMergeDriver([]string{"--prefer", "theirs", base, ours, theirs, path}); err != nil {
+		t.Fatalf("merge driver failed: %v", err)
+	}
+	merged, err := loadLedger(ours)
+	if err != nil {
+		t.Fatalf("load merged failed: %v", err)
+	}
+	if got := mustValue(t, merged, master, "a"); got != "theirs" {
+		t.Fatalf("expected theirs, got %q", got)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Keys use '/' as a namespace separator: "myapp/prod/db-password" lives in
+// the namespace "myapp/prod/". Namespaces exist only as key prefixes.
+const namespaceSep = "/"
+
+// keyMove is one step of mv: the value of From is re-encrypted under To.
+type keyMove struct {
+	From string
+	To   string
+}
+
+func cmdTree(args []string) error {
+	prefix := ""
+	if len(args) > 1 {
+		return errors.New("usage: secled tree [prefix/]")
+	}
+	if len(args) == 1 {
+		prefix = namespacePrefix(args[0])
+	}
+
+	led, err := loadListableLedger()
+	if err != nil {
+		return err
+	}
+	keys := sortedKeys(led.Entries)
+	if prefix != "" && len(keysUnder(keys, prefix)) == 0 {
+		return fmt.Errorf("no keys under %s", prefix)
+	}
+
+	root := prefix
+	if root == "" {
+		root = "."
+	}
+	fmt.Fprintln(os.Stdout, root)
+	writeTree(os.Stdout, keys, prefix, "")
+	return nil
+}
+
+func cmdMv(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: secled mv <key|prefix/> <key|prefix/>")
+	}
+	from, to := args[0], args[1]
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockLedger(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	moves, err := planMove(led.Entries, from, to)
+	if err != nil {
+		return err
+	}
+	if err := moveEntries(led, masterKey, moves, false); err != nil {
+		return err
+	}
+
+	if err := saveLedger(path, led, masterKey); err != nil {
+		return err
+	}
+	if len(moves) > 1 {
+		fmt.Fprintf(os.Stderr, "Moved %d keys from %s to %s\n", len(moves), from, to)
+	}
+	return nil
+}
+
+// loadListableLedger loads the ledger for commands that only show key
+// names; a private ledger needs the master password for that.
+func loadListableLedger() (*ledger, error) {
+	path, err := ledgerPath()
+	if err != nil {
+		return nil, err
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		return nil, err
+	}
+	if led.Private {
+		_, err := unlockLedgerWith(led, func() (string, error) {
+			password, err := requirePassword()
+			if err != nil {
+				return "", errors.New("Error: login required to list a private ledger (SECLED_MASTER is not set)")
+			}
+			return password, nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return led, nil
+}
+
+// namespacePrefix turns "myapp" or "myapp/" into "myapp/".
+func namespacePrefix(s string) string {
+	if strings.HasSuffix(s, namespaceSep) {
+		return s
+	}
+	return s + namespaceSep
+}
+
+// keysUnder returns the keys in the namespace prefix, in the order given.
+func keysUnder(keys []string, prefix string) []string {
+	var out []string
+	for _, k := range keys {
+		if strings.HasPrefix(k, prefix) {
+			out = append(out, k)
+		}
+	}
+	return out
+}
+
+// listLevel returns one level of the namespace prefix: keys directly in it
+// and, once each, the namespaces below it (with a trailing '/').
+func listLevel(keys []string, prefix string) []string {
+	seen := make(map[string]bool)
+	var out []string
+	for _, k := range keysUnder(keys, prefix) {
+		rest := k[len(prefix):]
+		if rest == "" {
+			continue
+		}
+		name := k
+		if i := strings.Index(rest, namespaceSep); i >= 0 {
+			name = prefix + rest[:i+1]
+		}
+		if !seen[name] {
+			seen[name] = true
+			out = append(out, name)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func writeTree(w io.Writer, keys []string, prefix, indent string) {
+	children := listLevel(keys, prefix)
+	for i, child := range children {
+		branch, next := "├── ", "│   "
+		if i == len(children)-1 {
+			branch, next = "└── ", "    "
+		}
+		fmt.Fprintln(w, indent+branch+child[len(prefix):])
+		if strings.HasSuffix(child, namespaceSep) {
+			writeTree(w, keys, child, indent+next)
+		}
+	}
+}
+
+// planMove works out which keys mv renames. "a/ b/" moves the subtree a/
+// to b/, "key dir/" moves key into dir/ and "key other" renames one key.
+// No target may exist already.
+func planMove(entries map[string]entry, from, to string) ([]keyMove, error) {
+	if from == reservedInitialKey || to == reservedInitialKey {
+		return nil, errors.New("key 'initial' is reserved")
+	}
+	if to == "" {
+		return nil, errors.New("missing target")
+	}
+
+	var moves []keyMove
+	if strings.HasSuffix(from, namespaceSep) {
+		if !strings.HasSuffix(to, namespaceSep) {
+			return nil, errors.New("target of a namespace must end with '/'")
+		}
+		for _, k := range keysUnder(sortedKeys(entries), from) {
+			moves = append(moves, keyMove{From: k, To: to + k[len(from):]})
+		}
+		if len(moves) == 0 {
+			return nil, fmt.Errorf("no keys under %s", from)
+		}
+	} else {
+		if strings.HasSuffix(to, namespaceSep) {
+			to += from[strings.LastIndex(from, namespaceSep)+1:]
+		}
+		move, err := planRename(entries, from, to)
+		if err != nil {
+			return nil, err
+		}
+		return []keyMove{move}, nil
+	}
+
+	for _, m := range moves {
+		if m.From == m.To {
+			return nil, fmt.Errorf("%s would be moved onto itself", m.From)
+		}
+		if _, exists := entries[m.To]; exists {
+			return nil, fmt.Errorf("key already exists: %s", m.To)
+		}
+	}
+	return moves, nil
+}
+
+// moveEntries re-encrypts each value under its new key (the key is the GCM
+// AAD, so the ciphertext cannot just be re-keyed). Metadata goes along and
+// the old keys get tombstones unless keep is set. Every value is decrypted
+// before anything changes, so a failure leaves led untouched.
+func moveEntries(led *ledger, masterKey []byte, moves []keyMove, keep bool) error {
+	values := make([][]byte, len(moves))
+	for i, m := range moves {
+		plaintext, err := decryptEntry(masterKey, m.From, led.Entries[m.From])
+		if err != nil {
+			return fmt.Errorf("cannot decrypt %s: invalid password or corrupted entry", m.From)
+		}
+		values[i] = plaintext
+	}
+
+	for i, m := range moves {
+		old := led.Entries[m.From]
+		led.Entries[m.To] = entry{Meta: old.Meta}
+		if err := storeEntry(led, masterKey, m.To, values[i]); err != nil {
+			return err
+		}
+		if !keep {
+			deleteEntry(led, m.From)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var namespaceKeys = []string{
+	"ghcr-password",
+	"initial",
+	"myapp/prod/api-key",
+	"myapp/prod/db-password",
+	"myapp/sandbox/db-password",
+	"myapp/token",
+}
+
+func TestListLevel(t *testing.T) {
+	got := listLevel(namespaceKeys, "myapp/")
+	want := []string{"myapp/prod/", "myapp/sandbox/", "myapp/token"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("listLevel = %q, want %q", got, want)
+	}
+	if got := listLevel(namespaceKeys, "nothing/"); len(got) != 0 {
+		t.Fatalf("expected empty level, got %q", got)
+	}
+}
+
+func TestWriteTree(t *testing.T) {
+	var buf bytes.Buffer
+	writeTree(&buf, namespaceKeys, "", "")
+	want := "" +
+		"├── ghcr-password\n" +
+		"├── initial\n" +
+		"└── myapp/\n" +
+		"    ├── prod/\n" +
+		"    │   ├── api-key\n" +
+		"    │   └── db-password\n" +
+		"    ├── sandbox/\n" +
+		"    │   └── db-password\n" +
+		"    └── token\n"
+	if buf.String() != want {
+		t.Fatalf("tree:\n%s\nwant:\n%s", buf.String(), want)
+	}
+}
+
+func TestPlanMove(t *testing.T) {
+	entries := make(map[string]entry)
+	for _, k := range namespaceKeys {
+		entries[k] = entry{}
+	}
+
+	moves, err := planMove(entries, "myapp/prod/", "myapp-old/")
+	if err != nil {
+		t.Fatalf("plan failed: %v", err)
+	}
+	want := []keyMove{
+		{From: "myapp/prod/api-key", To: "myapp-old/api-key"},
+		{From: "myapp/prod/db-password", To: "myapp-old/db-password"},
+	}
+	if !reflect.DeepEqual(moves, want) {
+		t.Fatalf("moves = %+v, want %+v", moves, want)
+	}
+
+	moves, err = planMove(entries, "ghcr-password", "registry/")
+	if err != nil || len(moves) != 1 || moves[0].To != "registry/ghcr-password" {
+		t.Fatalf("move into namespace = %+v, %v", moves, err)
+	}
+
+	bad := [][2]string{
+		{"initial", "other"},
+		{"missing", "other"},
+		{"myapp/", "other"},
+		{"nothing/", "other/"},
+		{"myapp/prod/db-password", "myapp/sandbox/"},
+	}
+	for _, b := range bad {
+		if _, err := planMove(entries, b[0], b[1]); err == nil {
+			t.Fatalf("expected error for mv %s %s", b[0], b[1])
+		}
+	}
+}
+
+func TestMoveEntriesReencrypts(t *testing.T) {
+	led, master := newTestLedger(t, map[string]string{"a/x": "secret"})
+	led.Entries["a/x"].Meta["note"] = "kept"
+
+	moves := []keyMove{{From: "a/x", To: "b/x"}}
+	if err := moveEntries(led, master, moves, false); err != nil {
+		t.Fatalf("move failed: %v", err)
+	}
+	if got := mustValue(t, led, master, "b/x"); got != "secret" {
+		t.Fatalf("moved value = %q", got)
+	}
+	if led.Entries["b/x"].Meta["note"] != "kept" {
+		t.Fatalf("metadata was not kept")
+	}
+	if _, ok := led.Entries["a/x"]; ok {
+		t.Fatalf("old key still present")
+	}
+	if _, ok := led.Deleted["a/x"]; !ok {
+		t.Fatalf("old key has no tombstone")
+	}
+
+	// A corrupted source must leave the ledger unchanged.
+	led.Entries["b/x"].Ciphertext[0] ^= 1
+	if err := moveEntries(led, master, []keyMove{{From: "b/x", To: "c/x"}}, false); err == nil {
+		t.Fatalf("expected error for corrupted entry")
+	}
+	if _, ok := led.Entries["c/x"]; ok {
+		t.Fatalf("failed move left a target behind")
+	}
+}
@@ -0,0 +1,20 @@
+//go:build !linux && !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// parentProcessName is the name of the process that ran secled, from ps
+// where there is no /proc.
+func parentProcessName() string {
+	out, err := exec.Command("ps", "-o", "comm=", "-p", strconv.Itoa(os.Getppid())).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
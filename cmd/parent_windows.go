@@ -0,0 +1,29 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// parentProcessName is the name of the process that ran secled.
+func parentProcessName() string {
+	snap, err := windows.CreateToolhelp32Snapshot(windows.TH32CS_SNAPPROCESS, 0)
+	if err != nil {
+		return ""
+	}
+	defer windows.CloseHandle(snap)
+
+	ppid := uint32(os.Getppid())
+	var pe windows.ProcessEntry32
+	pe.Size = uint32(unsafe.Sizeof(pe))
+	for err = windows.Process32First(snap, &pe); err == nil; err = windows.Process32Next(snap, &pe) {
+		if pe.ProcessID == ppid {
+			return windows.UTF16ToString(pe.ExeFile[:])
+		}
+	}
+	return ""
+}
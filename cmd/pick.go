@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+var errPickCancelled = errors.New("no key selected")
+
+func cmdPick(args []string) error {
+	template, copyKey, err := parsePickArgs(args)
+	if err != nil {
+		return err
+	}
+
+	in, out := int(os.Stdin.Fd()), int(os.Stderr.Fd())
+	if !term.IsTerminal(in) || !term.IsTerminal(out) {
+		return errors.New("pick needs a terminal")
+	}
+
+	led, err := loadListableLedger()
+	if err != nil {
+		return err
+	}
+
+	key, err := runPicker(os.Stdin, os.Stderr, in, out, sortedKeys(led.Entries))
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case template != "":
+		return runTemplate(template, key)
+	case copyKey:
+		if err := copyToClipboard(key); err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "Copied %s\n", key)
+		return nil
+	default:
+		_, err := fmt.Fprintln(os.Stdout, key)
+		return err
+	}
+}
+
+// parsePickArgs parses "[--exec 'cmd {}'] [--copy]".
+func parsePickArgs(args []string) (string, bool, error) {
+	template, copyKey := "", false
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--exec":
+			if i+1 >= len(args) {
+				return "", false, errors.New("--exec needs a command")
+			}
+			i++
+			template = args[i]
+		case "--copy":
+			copyKey = true
+		default:
+			return "", false, fmt.Errorf("unknown argument %q", args[i])
+		}
+	}
+	if template != "" && copyKey {
+		return "", false, errors.New("use either --exec or --copy")
+	}
+	return template, copyKey, nil
+}
+
+// runPicker shows the finder on the alternate screen of the terminal and
+// returns the chosen key.
+func runPicker(r io.Reader, w io.Writer, in, out int, keys []string) (string, error) {
+	state, err := term.MakeRaw(in)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(in, state)
+
+	fmt.Fprint(w, "\x1b[?1049h")
+	defer fmt.Fprint(w, "\x1b[?1049l")
+
+	p := newPicker(keys)
+	buf := make([]byte, 64)
+	for {
+		width, height, err := term.GetSize(out)
+		if err != nil {
+			width, height = 80, 24
+		}
+		fmt.Fprint(w, p.render(width, height))
+
+		n, err := r.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		if done := p.handle(buf[:n]); done {
+			break
+		}
+	}
+	if p.cancelled || len(p.matches) == 0 {
+		return "", errPickCancelled
+	}
+	return p.matches[p.selected], nil
+}
+
+// picker is the state of the finder: the query, the keys matching it (best
+// first) and the highlighted row.
+type picker struct {
+	keys      []string
+	query     []rune
+	matches   []string
+	selected  int
+	cancelled bool
+}
+
+func newPicker(keys []string) *picker {
+	p := &picker{keys: keys}
+	p.filter()
+	return p
+}
+
+func (p *picker) filter() {
+	p.matches = fuzzyFilter(p.keys, string(p.query))
+	p.selected = 0
+}
+
+func (p *picker) move(delta int) {
+	if len(p.matches) == 0 {
+		return
+	}
+	p.selected = (p.selected + delta + len(p.matches)) % len(p.matches)
+}
+
+// handle applies one read of terminal input and reports whether the picker
+// is done (a key was chosen or it was cancelled).
+func (p *picker) handle(input []byte) bool {
+	for len(input) > 0 {
+		// Esc alone cancels; an escape sequence (arrows, Home, F-keys,
+		// Alt+key) arrives in one read and only the arrows do something.
+		if input[0] == 0x1b && len(input) > 1 && input[1] != 0x1b {
+			n := escapeSequenceLen(input)
+			switch string(input[:n]) {
+			case "\x1b[A", "\x1bOA":
+				p.move(-1)
+			case "\x1b[B", "\x1bOB":
+				p.move(1)
+			}
+			input = input[n:]
+			continue
+		}
+
+		c := input[0]
+		switch c {
+		case '\r', '\n':
+			return true
+		case 0x1b, 0x03, 0x07: // Esc, Ctrl-C, Ctrl-G
+			p.cancelled = true
+			return true
+		case 0x10, 0x0b: // Ctrl-P, Ctrl-K
+			p.move(-1)
+		case 0x0e, '\t': // Ctrl-N, Tab
+			p.move(1)
+		case 0x7f, 0x08: // Backspace
+			if len(p.query) > 0 {
+				p.query = p.query[:len(p.query)-1]
+				p.filter()
+			}
+		case 0x15: // Ctrl-U
+			p.query = nil
+			p.filter()
+		default:
+			r, size := utf8.DecodeRune(input)
+			if unicode.IsPrint(r) {
+				p.query = append(p.query, r)
+				p.filter()
+			}
+			input = input[size:]
+			continue
+		}
+		input = input[1:]
+	}
+	return false
+}
+
+// escapeSequenceLen returns the length of the escape sequence at the start
+// of input: CSI (ESC [, parameters, a final byte 0x40-0x7e), SS3 (ESC O and
+// one byte) or ESC and one character (Alt+key). An unfinished sequence
+// takes the rest of the input.
+func escapeSequenceLen(input []byte) int {
+	switch input[1] {
+	case '[':
+		for i := 2; i < len(input); i++ {
+			if input[i] >= 0x40 && input[i] <= 0x7e {
+				return i + 1
+			}
+		}
+		return len(input)
+	case 'O':
+		return min(3, len(input))
+	}
+	_, size := utf8.DecodeRune(input[1:])
+	return 1 + size
+}
+
+// render draws the whole screen: the query line, then as many matches as
+// fit, scrolled so the highlighted one is visible.
+func (p *picker) render(width, height int) string {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "%d/%d > %s\r\n", len(p.matches), len(p.keys), string(p.query))
+
+	rows := height - 1
+	if rows < 1 {
+		rows = 1
+	}
+	first := 0
+	if p.selected >= rows {
+		first = p.selected - rows + 1
+	}
+	for i := first; i < len(p.matches) && i < first+rows; i++ {
+		line := truncateRunes(p.matches[i], width-2)
+		if i == p.selected {
+			b.WriteString("\x1b[7m> " + line + "\x1b[0m\r\n")
+		} else {
+			b.WriteString("  " + line + "\r\n")
+		}
+	}
+	// Put the cursor back at the end of the query.
+	fmt.Fprintf(&b, "\x1b[1;%dH", len(fmt.Sprintf("%d/%d > ", len(p.matches), len(p.keys)))+len(p.query)+1)
+	return b.String()
+}
+
+func truncateRunes(s string, n int) string {
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) {
+			return '?'
+		}
+		return r
+	}, s)
+	if n < 1 || utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
+
+// fuzzyFilter returns the keys that contain the query as a subsequence
+// (case-insensitive), best match first.
+func fuzzyFilter(keys []string, query string) []string {
+	type scored struct {
+		key   string
+		score int
+	}
+	var found []scored
+	for _, k := range keys {
+		if score, ok := fuzzyScore(k, query); ok {
+			found = append(found, scored{k, score})
+		}
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].score != found[j].score {
+			return found[i].score > found[j].score
+		}
+		return len(found[i].key) < len(found[j].key)
+	})
+	out := make([]string, len(found))
+	for i, f := range found {
+		out[i] = f.key
+	}
+	return out
+}
+
+// fuzzyScore matches query against key greedily. Consecutive characters,
+// the start of the key and the start of a word (after / - _ . or space)
+// score extra, so "ghp" ranks "ghcr-password" above "github-pat".
+func fuzzyScore(key, query string) (int, bool) {
+	k := []rune(strings.ToLower(key))
+	score, last := 0, -2
+	pos := 0
+	for _, q := range strings.ToLower(query) {
+		for pos < len(k) && k[pos] != q {
+			pos++
+		}
+		if pos == len(k) {
+			return 0, false
+		}
+		score++
+		switch {
+		case pos == 0:
+			score += 8
+		case strings.ContainsRune("/-_. ", k[pos-1]):
+			score += 6
+		}
+		if pos == last+1 {
+			score += 4
+		}
+		last = pos
+		pos++
+	}
+	return score, true
+}
+
+// runTemplate runs the --exec command with every {} replaced by the
+// quoted key.
+func runTemplate(template, key string) error {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("powershell", "-NoProfile", "-Command", expandTemplate(template, quotePowerShell(key)))
+	} else {
+		cmd = exec.Command("sh", "-c", expandTemplate(template, quotePOSIX(key)))
+	}
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return &exitError{code: exitErr.ExitCode(), err: fmt.Errorf("command failed: %w", err)}
+	}
+	return err
+}
+
+func expandTemplate(template, quotedKey string) string {
+	if !strings.Contains(template, "{}") {
+		return template + " " + quotedKey
+	}
+	return strings.ReplaceAll(template, "{}", quotedKey)
+}
+
+func copyToClipboard(text string) error {
+	var candidates [][]string
+	switch runtime.GOOS {
+	case "darwin":
+		candidates = [][]string{{"pbcopy"}}
+	case "windows":
+		candidates = [][]string{{"clip"}}
+	default:
+		if os.Getenv("WAYLAND_DISPLAY") != "" {
+			candidates = append(candidates, []string{"wl-copy"})
+		}
+		candidates = append(candidates, []string{"xclip", "-selection", "clipboard"}, []string{"xsel", "--clipboard", "--input"})
+	}
+	for _, c := range candidates {
+		if _, err := exec.LookPath(c[0]); err != nil {
+			continue
+		}
+		cmd := exec.Command(c[0], c[1:]...)
+		cmd.Stdin = strings.NewReader(text)
+		return cmd.Run()
+	}
+	return errors.New("no clipboard tool found (pbcopy, clip, wl-copy, xclip or xsel)")
+}
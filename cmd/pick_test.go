@@ -0,0 +1,103 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFuzzyFilter(t *testing.T) {
+	keys := []string{"github-pat", "ghcr-password", "ghcr_pass", "initial", "prod/db-password"}
+
+	got := fuzzyFilter(keys, "ghp")
+	want := []string{"ghcr_pass", "ghcr-password", "github-pat"}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("fuzzyFilter(ghp) = %q, want %q", got, want)
+	}
+	if got := fuzzyFilter(keys, "DBPW"); !reflect.DeepEqual(got, []string{"prod/db-password"}) {
+		t.Fatalf("case-insensitive match failed: %q", got)
+	}
+	if got := fuzzyFilter(keys, "zz"); len(got) != 0 {
+		t.Fatalf("expected no matches, got %q", got)
+	}
+	if got := fuzzyFilter(keys, ""); len(got) != len(keys) {
+		t.Fatalf("empty query should match everything, got %q", got)
+	}
+}
+
+func TestPickerHandle(t *testing.T) {
+	p := newPicker([]string{"alpha", "beta", "gamma"})
+
+	if p.handle([]byte("a")) {
+		t.Fatalf("typing ended the picker")
+	}
+	if len(p.matches) != 3 {
+		t.Fatalf("matches for 'a' = %q", p.matches)
+	}
+	p.handle([]byte("m"))
+	if !reflect.DeepEqual(p.matches, []string{"gamma"}) {
+		t.Fatalf("matches for 'am' = %q", p.matches)
+	}
+	p.handle([]byte{0x7f, 0x7f})
+	if len(p.query) != 0 || len(p.matches) != 3 {
+		t.Fatalf("backspace did not clear the query: %q", string(p.query))
+	}
+
+	p.handle([]byte("\x1b[B\x1b[B\x1b[B\x1b[A"))
+	if p.selected != 2 {
+		t.Fatalf("selected = %d, want 2 (down wraps)", p.selected)
+	}
+	if !p.handle([]byte("\r")) || p.cancelled || p.matches[p.selected] != "gamma" {
+		t.Fatalf("enter did not choose gamma")
+	}
+
+	p = newPicker([]string{"alpha"})
+	if !p.handle([]byte{0x1b}) || !p.cancelled {
+		t.Fatalf("esc did not cancel")
+	}
+}
+
+func TestPickerIgnoresOtherEscapeSequences(t *testing.T) {
+	p := newPicker([]string{"alpha", "beta"})
+	// right, Home, Delete, F5, Alt+x, then SS3 F1
+	for _, seq := range []string{"\x1b[C", "\x1b[H", "\x1b[3~", "\x1b[15;2~", "\x1bx", "\x1bOP"} {
+		if p.handle([]byte(seq)) || p.cancelled {
+			t.Fatalf("%q ended the picker", seq)
+		}
+	}
+	if len(p.query) != 0 {
+		t.Fatalf("escape sequences were typed into the query: %q", string(p.query))
+	}
+	p.handle([]byte("\x1b[C\x1b[Bb"))
+	if p.selected != 0 || string(p.query) != "b" {
+		t.Fatalf("selected %d query %q after right, down, b", p.selected, string(p.query))
+	}
+	if !p.handle([]byte("\x1b[D\x1b")) || !p.cancelled {
+		t.Fatalf("esc at the end of a read did not cancel")
+	}
+}
+
+func TestPickerRender(t *testing.T) {
+	keys := []string{"k0", "k1", "k2", "k3", "k4"}
+	p := newPicker(keys)
+	p.selected = 4
+	screen := p.render(80, 3)
+	if !strings.Contains(screen, "5/5 > ") {
+		t.Fatalf("missing query line: %q", screen)
+	}
+	if strings.Contains(screen, "k2") || !strings.Contains(screen, "\x1b[7m> k4") {
+		t.Fatalf("selection not scrolled into view: %q", screen)
+	}
+}
+
+func TestExpandTemplate(t *testing.T) {
+	if got := expandTemplate("secled get {} | wc -c", "'my key'"); got != "secled get 'my key' | wc -c" {
+		t.Fatalf("expandTemplate = %q", got)
+	}
+	if got := expandTemplate("secled get", "k"); got != "secled get k" {
+		t.Fatalf("expandTemplate without {} = %q", got)
+	}
+	if _, _, err := parsePickArgs([]string{"--exec", "x", "--copy"}); err == nil {
+		t.Fatalf("expected error for --exec with --copy")
+	}
+}
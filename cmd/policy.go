@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Per-key access policies, stored in the metadata field "policy" as a
+// comma-separated list. They apply to every command that reveals a value,
+// however the ledger was unlocked (SECLED_MASTER, agent or shell).
+const (
+	metaPolicy = "policy"
+
+	policyConfirm            = "confirm"
+	policyPassword           = "password"
+	policyDenyNonInteractive = "deny-noninteractive"
+	policyNone               = "none"
+)
+
+var policyRules = []string{policyConfirm, policyPassword, policyDenyNonInteractive}
+
+// prompter asks the user at a terminal. interactive is false when there is
+// no terminal (cron, CI), and then the read functions are nil.
+type prompter struct {
+	interactive  bool
+	readLine     func(prompt string) (string, error)
+	readPassword func(prompt string) (string, error)
+}
+
+func cmdPolicy(args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: secled policy <key> [confirm|password|deny-noninteractive|none ...]")
+	}
+	key, rules := args[0], args[1:]
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	if len(rules) == 0 {
+		led, err := loadListableLedger()
+		if err != nil {
+			return err
+		}
+		e, ok := led.Entries[key]
+		if !ok {
+			return errors.New("key not found")
+		}
+		policy := e.Meta[metaPolicy]
+		if policy == "" {
+			policy = policyNone
+		}
+		fmt.Fprintln(os.Stdout, policy)
+		return nil
+	}
+
+	policy, err := parsePolicy(rules)
+	if err != nil {
+		return err
+	}
+	if key == reservedInitialKey {
+		return errors.New("key 'initial' is reserved")
+	}
+
+	unlock, err := lockLedger(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+	e, ok := led.Entries[key]
+	if !ok {
+		return errors.New("key not found")
+	}
+
+	// Changing a policy is guarded by the policy itself.
+	p := ttyPrompter()
+	defer p.close()
+	if err := checkPolicy(led, masterKey, key, p.prompter); err != nil {
+		return err
+	}
+
+	if policy == "" {
+		delete(e.Meta, metaPolicy)
+	} else {
+		if e.Meta == nil {
+			e.Meta = make(map[string]string)
+		}
+		e.Meta[metaPolicy] = policy
+	}
+	led.Entries[key] = e
+	return saveLedger(path, led, masterKey)
+}
+
+// parsePolicy turns rule arguments (also comma-separated) into the stored
+// form; "none" alone clears the policy.
+func parsePolicy(args []string) (string, error) {
+	seen := make(map[string]bool)
+	for _, arg := range args {
+		for _, rule := range strings.Split(arg, ",") {
+			rule = strings.TrimSpace(rule)
+			if rule == policyNone {
+				seen[rule] = true
+				continue
+			}
+			known := false
+			for _, r := range policyRules {
+				known = known || r == rule
+			}
+			if !known {
+				return "", fmt.Errorf("unknown policy %q (use %s or none)", rule, strings.Join(policyRules, ", "))
+			}
+			seen[rule] = true
+		}
+	}
+	if seen[policyNone] {
+		if len(seen) > 1 {
+			return "", errors.New("none cannot be combined with other policies")
+		}
+		return "", nil
+	}
+	rules := make([]string, 0, len(seen))
+	for rule := range seen {
+		rules = append(rules, rule)
+	}
+	sort.Strings(rules)
+	return strings.Join(rules, ","), nil
+}
+
+func policyOf(e entry) []string {
+	if e.Meta[metaPolicy] == "" {
+		return nil
+	}
+	return strings.Split(e.Meta[metaPolicy], ",")
+}
+
+// checkPolicy enforces the policy of key before its value is revealed.
+// Unknown rules deny, so a ledger written by a newer secled fails closed.
+func checkPolicy(led *ledger, masterKey []byte, key string, p prompter) error {
+	rules := policyOf(led.Entries[key])
+	sort.Slice(rules, func(i, j int) bool { return policyOrder(rules[i]) < policyOrder(rules[j]) })
+
+	for _, rule := range rules {
+		if !p.interactive {
+			return fmt.Errorf("policy of %s needs a terminal (%s)", key, rule)
+		}
+		switch rule {
+		case policyDenyNonInteractive:
+		case policyConfirm:
+			answer, err := p.readLine(fmt.Sprintf("Reveal %s (policy: confirm)? [y/N] ", key))
+			if err != nil {
+				return err
+			}
+			if a := strings.ToLower(strings.TrimSpace(answer)); a != "y" && a != "yes" {
+				return fmt.Errorf("access to %s not confirmed", key)
+			}
+		case policyPassword:
+			password, err := p.readPassword(fmt.Sprintf("Master password for %s: ", key))
+			if err != nil {
+				return err
+			}
+			// counted like any other unlock, so the prompt cannot be used
+			// to guess the master password without the throttle
+			if err := checkThrottle(led.path); err != nil {
+				return err
+			}
+			if subtle.ConstantTimeCompare(deriveKey(password, led.Params), masterKey) != 1 {
+				noteUnlock(led.path, false)
+				return fmt.Errorf("wrong password for %s", key)
+			}
+			noteUnlock(led.path, true)
+		default:
+			return fmt.Errorf("unknown policy %q on %s", rule, key)
+		}
+	}
+	return nil
+}
+
+// policyOrder runs the cheap checks first and the password last.
+func policyOrder(rule string) int {
+	switch rule {
+	case policyDenyNonInteractive:
+		return 0
+	case policyConfirm:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// ttyPrompt is a prompter on the controlling terminal, which works even
+// when stdin and stdout are redirected (secled get key | kubectl ...).
+type ttyPrompt struct {
+	prompter
+	in, out *os.File
+}
+
+func ttyPrompter() *ttyPrompt {
+	t := &ttyPrompt{}
+	inName, outName := "/dev/tty", "/dev/tty"
+	if runtime.GOOS == "windows" {
+		inName, outName = "CONIN$", "CONOUT$"
+	}
+	in, err := os.OpenFile(inName, os.O_RDWR, 0)
+	if err != nil || !term.IsTerminal(int(in.Fd())) {
+		if in != nil {
+			in.Close()
+		}
+		return t
+	}
+	out, err := os.OpenFile(outName, os.O_WRONLY, 0)
+	if err != nil {
+		in.Close()
+		return t
+	}
+	t.in, t.out = in, out
+	t.interactive = true
+	t.readLine = func(prompt string) (string, error) {
+		fmt.Fprint(out, prompt)
+		line, err := bufio.NewReader(in).ReadString('\n')
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+	t.readPassword = func(prompt string) (string, error) {
+		fmt.Fprint(out, prompt)
+		b, err := term.ReadPassword(int(in.Fd()))
+		fmt.Fprintln(out)
+		return string(b), err
+	}
+	return t
+}
+
+func (t *ttyPrompt) close() {
+	if t.in != nil {
+		t.in.Close()
+		t.out.Close()
+	}
+}
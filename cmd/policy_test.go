@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParsePolicy(t *testing.T) {
+	cases := map[string][]string{
+		"confirm":                      {"confirm"},
+		"confirm,password":             {"password", "confirm"},
+		"deny-noninteractive,password": {"password,deny-noninteractive", "password"},
+		"":                             {"none"},
+	}
+	for want, args := range cases {
+		got, err := parsePolicy(args)
+		if err != nil || got != want {
+			t.Fatalf("parsePolicy(%q) = %q, %v; want %q", args, got, err, want)
+		}
+	}
+	for _, args := range [][]string{{"sometimes"}, {"none", "confirm"}} {
+		if _, err := parsePolicy(args); err == nil {
+			t.Fatalf("expected error for %q", args)
+		}
+	}
+}
+
+func scriptedPrompter(lines, passwords []string) prompter {
+	return prompter{
+		interactive: true,
+		readLine: func(string) (string, error) {
+			if len(lines) == 0 {
+				return "", errors.New("unexpected question")
+			}
+			line := lines[0]
+			lines = lines[1:]
+			return line, nil
+		},
+		readPassword: func(string) (string, error) {
+			if len(passwords) == 0 {
+				return "", errors.New("unexpected password prompt")
+			}
+			pw := passwords[0]
+			passwords = passwords[1:]
+			return pw, nil
+		},
+	}
+}
+
+func TestCheckPolicy(t *testing.T) {
+	policies := map[string]string{
+		"open":     "",
+		"confirm":  "confirm",
+		"password": "password",
+		"batch":    "deny-noninteractive",
+		"both":     "confirm,password",
+		"future":   "biometric",
+	}
+	values := make(map[string]string)
+	for key := range policies {
+		values[key] = "v"
+	}
+	led, master := newTestLedger(t, values)
+	for key, policy := range policies {
+		if policy != "" {
+			led.Entries[key].Meta[metaPolicy] = policy
+		}
+	}
+	noTTY := prompter{}
+
+	cases := []struct {
+		key     string
+		p       prompter
+		allowed bool
+	}{
+		{"open", noTTY, true},
+		{"confirm", noTTY, false},
+		{"confirm", scriptedPrompter([]string{"y"}, nil), true},
+		{"confirm", scriptedPrompter([]string{""}, nil), false},
+		{"password", scriptedPrompter(nil, []string{"password"}), true},
+		{"password", scriptedPrompter(nil, []string{"guess"}), false},
+		{"batch", noTTY, false},
+		{"batch", scriptedPrompter(nil, nil), true},
+		{"both", scriptedPrompter([]string{"yes"}, []string{"password"}), true},
+		{"both", scriptedPrompter([]string{"n"}, []string{"password"}), false},
+		{"future", scriptedPrompter(nil, nil), false},
+	}
+	for i, c := range cases {
+		err := checkPolicy(led, master, c.key, c.p)
+		if (err == nil) != c.allowed {
+			t.Fatalf("case %d (%s): err = %v, want allowed=%v", i, c.key, err, c.allowed)
+		}
+	}
+
+	if _, err := getValue(led, master, "confirm", "", noTTY); err == nil {
+		t.Fatalf("getValue ignored the policy")
+	}
+}
+
+func TestCheckPolicyPasswordThrottle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	writeTestLedger(t, path, map[string]string{"root": "v"})
+	led, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	master := deriveKey("password", led.Params)
+	e := led.Entries["root"]
+	e.Meta = map[string]string{metaPolicy: policyPassword}
+	led.Entries["root"] = e
+
+	for i := 0; i < 3; i++ {
+		if err := checkPolicy(led, master, "root", scriptedPrompter(nil, []string{"guess"})); err == nil {
+			t.Fatalf("wrong password accepted")
+		}
+	}
+	st, err := loadUnlockState(unlockStatePath(path))
+	if err != nil || st.Failures != 3 {
+		t.Fatalf("failures = %d, %v; want 3", st.Failures, err)
+	}
+	err = checkPolicy(led, master, "root", scriptedPrompter(nil, []string{"password"}))
+	if err == nil || !strings.Contains(err.Error(), "try again") {
+		t.Fatalf("throttled policy prompt = %v", err)
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"syscall"
+)
+
+// buildRedactMatcher is buildMatcher with the encoded forms (base64 also
+// padded), where a multi-line value (a PEM key) is looked for line by line
+// instead, so no pattern spans a line break.
+func buildRedactMatcher(values []storedValue) *matcher {
+	m := newMatcher()
+	for _, v := range values {
+		forms := scanForms(v.Value, true)
+		if len(forms) > 0 {
+			// the last character and the padding would be left after the
+			// replacement otherwise
+			forms["base64 padded"] = []byte(base64.StdEncoding.EncodeToString(normalizeValue(v.Value)))
+			forms["base64 unpadded"] = []byte(base64.RawStdEncoding.EncodeToString(normalizeValue(v.Value)))
+		}
+		if plain, ok := forms[""]; ok && bytes.ContainsAny(plain, "\r\n") {
+			delete(forms, "")
+			for i, line := range bytes.Split(plain, []byte("\n")) {
+				if line = bytes.TrimSpace(line); len(line) >= minScanLength {
+					forms[fmt.Sprintf("line %d", i+1)] = line
+				}
+			}
+		}
+		names := make([]string, 0, len(forms))
+		for form := range forms {
+			names = append(names, form)
+		}
+		sort.Strings(names)
+		for _, form := range names {
+			m.add(forms[form], scanPattern{Name: v.Name(), Form: form})
+		}
+	}
+	m.build()
+	return m
+}
+
+// redactor is a writer that replaces every stored value in what passes
+// through with ***<key>***. It holds back the end of the output that could
+// be the start of a value; Close writes the rest.
+type redactor struct {
+	m   *matcher
+	w   io.Writer
+	buf []byte
+}
+
+func newRedactor(m *matcher, w io.Writer) *redactor {
+	return &redactor{m: m, w: w}
+}
+
+func (r *redactor) Write(p []byte) (int, error) {
+	r.buf = append(r.buf, p...)
+	if err := r.flush(false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close writes what is held back.
+func (r *redactor) Close() error {
+	return r.flush(true)
+}
+
+// flush writes the buffer up to the first position where a value could
+// still be completed by later data, so a prompt without a newline
+// ("Password: ") is shown at once.
+func (r *redactor) flush(final bool) error {
+	safe := len(r.buf)
+	if !final {
+		safe = r.m.pendingStart(r.buf)
+	}
+
+	var out bytes.Buffer
+	pos := 0
+	for _, match := range redactMatches(r.m, r.buf) {
+		if match.Start >= safe {
+			break
+		}
+		out.Write(r.buf[pos:match.Start])
+		out.WriteString("***" + r.m.patterns[match.Pattern].Name + "***")
+		pos = match.Start + r.m.lengths[match.Pattern]
+	}
+	if pos < safe {
+		out.Write(r.buf[pos:safe])
+		pos = safe
+	}
+	r.buf = append(r.buf[:0], r.buf[pos:]...)
+	_, err := r.w.Write(out.Bytes())
+	return err
+}
+
+// pendingStart returns the first offset from which the rest of data is a
+// proper prefix of a pattern, or len(data). Patterns hold no line breaks, so
+// only the last line is searched; every walk is at most one pattern long.
+func (m *matcher) pendingStart(data []byte) int {
+	for i := bytes.LastIndexByte(data, '\n') + 1; i < len(data); i++ {
+		n, ok := int32(0), true
+		for _, c := range data[i:] {
+			if n, ok = m.nodes[n].next[c]; !ok {
+				break
+			}
+		}
+		if ok && len(m.nodes[n].next) > 0 {
+			return i
+		}
+	}
+	return len(data)
+}
+
+// redactMatches picks the matches to replace: from the left, the longest
+// at each position, none overlapping.
+func redactMatches(m *matcher, data []byte) []scanMatch {
+	matches := m.find(data)
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].Start != matches[j].Start {
+			return matches[i].Start < matches[j].Start
+		}
+		return m.lengths[matches[i].Pattern] > m.lengths[matches[j].Pattern]
+	})
+	var picked []scanMatch
+	end := 0
+	for _, match := range matches {
+		if match.Start < end {
+			continue
+		}
+		picked = append(picked, match)
+		end = match.Start + m.lengths[match.Pattern]
+	}
+	return picked
+}
+
+func cmdRedact(args []string) error {
+	if len(args) > 0 && (args[0] != "--" || len(args) < 2) {
+		return errors.New("usage: secled redact -- <command> [args...] or <command> | secled redact")
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	// Policies are not asked: the values are only used to hide them, and
+	// skipping a key would let it through.
+	values, _, err := decryptValues(led, masterKey, isSecretField, nil)
+	if err != nil {
+		return err
+	}
+	m := buildRedactMatcher(values)
+	clearValues(values)
+
+	if len(args) == 0 {
+		out := newRedactor(m, os.Stdout)
+		if _, err := io.Copy(out, os.Stdin); err != nil {
+			return err
+		}
+		return out.Close()
+	}
+	return runRedacted(m, args[1:])
+}
+
+// runRedacted runs a command with its stdout and stderr passed through
+// redactors and returns its exit code as an exitError.
+func runRedacted(m *matcher, argv []string) error {
+	stdout, stderr := newRedactor(m, os.Stdout), newRedactor(m, os.Stderr)
+	cmd := exec.Command(argv[0], argv[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, stdout, stderr
+
+	// Ctrl-C reaches the command too; keep running to write its last output.
+	// SIGTERM is only sent to secled, so it is passed on.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case sig := <-signals:
+				if sig != os.Interrupt {
+					_ = cmd.Process.Signal(sig)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	err := cmd.Wait()
+	if closeErr := stdout.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	if closeErr := stderr.Close(); closeErr != nil && err == nil {
+		err = closeErr
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// only the program name: the arguments may hold secrets
+		return &exitError{code: exitErr.ExitCode(), err: fmt.Errorf("%s failed: %w", argv[0], err)}
+	}
+	return err
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"runtime"
+	"syscall"
+	"testing"
+)
+
+func redactTestMatcher() *matcher {
+	return buildRedactMatcher([]storedValue{
+		{Key: "jwt", Value: []byte("0123456789abcdef\n")},
+		{Key: "jwt-long", Value: []byte("0123456789abcdefXYZ")},
+		{Key: "tls", Value: []byte("-----BEGIN KEY-----\nMIIEvQIBADANBgkq\nhkiG9w0BAQEFAASC\n-----END KEY-----\n")},
+		{Key: "db", Field: "password", Value: []byte("p@ss word/1")},
+		{Key: "pin", Value: []byte("1234")},
+	})
+}
+
+func TestRedactor(t *testing.T) {
+	input := "token=0123456789abcdef and 0123456789abcdefXYZ pin 1234\n" +
+		"key:\nMIIEvQIBADANBgkq\nhkiG9w0BAQEFAASC\n" +
+		"data: " + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef")) + "\n" +
+		"url: p%40ss+word%2F1 tail"
+	want := "token=***jwt*** and ***jwt-long*** pin 1234\n" +
+		"key:\n***tls***\n***tls***\n" +
+		"data: ***jwt***\n" +
+		"url: ***db.password*** tail"
+
+	// every split of the input into two writes gives the same output
+	for cut := 0; cut <= len(input); cut++ {
+		var out bytes.Buffer
+		r := newRedactor(redactTestMatcher(), &out)
+		if _, err := r.Write([]byte(input[:cut])); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if _, err := r.Write([]byte(input[cut:])); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+		if err := r.Close(); err != nil {
+			t.Fatalf("close failed: %v", err)
+		}
+		if out.String() != want {
+			t.Fatalf("cut at %d:\n%q\nwant\n%q", cut, out.String(), want)
+		}
+	}
+}
+
+func TestRedactorFlushesLines(t *testing.T) {
+	var out bytes.Buffer
+	r := newRedactor(redactTestMatcher(), &out)
+	r.Write([]byte("first line\nPassword: "))
+	if out.String() != "first line\nPassword: " {
+		t.Fatalf("prompt held back: %q", out.String())
+	}
+	r.Write([]byte("token 0123"))
+	if out.String() != "first line\nPassword: token " {
+		t.Fatalf("flushed %q, want the start of a value held back", out.String())
+	}
+	r.Write([]byte("456789abcdef"))
+	if out.String() != "first line\nPassword: token " {
+		t.Fatalf("flushed %q before a longer value was ruled out", out.String())
+	}
+	r.Write([]byte("!\r"))
+	if out.String() != "first line\nPassword: token ***jwt***!\r" {
+		t.Fatalf("after the value %q", out.String())
+	}
+	r.Write([]byte("0123"))
+	r.Close()
+	if out.String() != "first line\nPassword: token ***jwt***!\r0123" {
+		t.Fatalf("after close %q", out.String())
+	}
+}
+
+func TestRunRedactedForwardsSIGTERM(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no SIGTERM on Windows")
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("pipe failed: %v", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runRedacted(redactTestMatcher(), []string{"sh", "-c", `trap 'echo term; exit 3' TERM; echo ready; while :; do sleep 0.05; done`})
+		w.Close()
+	}()
+	lines := bufio.NewScanner(r)
+	if !lines.Scan() || lines.Text() != "ready" {
+		t.Fatalf("child did not start: %q", lines.Text())
+	}
+	self, _ := os.FindProcess(os.Getpid())
+	if err := self.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("signal failed: %v", err)
+	}
+	if !lines.Scan() || lines.Text() != "term" {
+		t.Fatalf("child output after SIGTERM = %q", lines.Text())
+	}
+	var exitErr *exitError
+	if err := <-done; !errors.As(err, &exitErr) || exitErr.code != 3 {
+		t.Fatalf("runRedacted = %v, want exit code 3", err)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+func cmdRename(args []string) error {
+	return renameOrCopy(args, "rename", false)
+}
+
+func cmdCopyKey(args []string) error {
+	return renameOrCopy(args, "copy-key", true)
+}
+
+// renameOrCopy re-encrypts one value under a new key in a single save.
+// With keep set the old key stays (copy-key), otherwise it gets a
+// tombstone (rename).
+func renameOrCopy(args []string, name string, keep bool) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: secled %s <old-key> <new-key>", name)
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	unlock, err := lockLedger(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	move, err := planRename(led.Entries, args[0], args[1])
+	if err != nil {
+		return err
+	}
+	if err := moveEntries(led, masterKey, []keyMove{move}, keep); err != nil {
+		return err
+	}
+	return saveLedger(path, led, masterKey)
+}
+
+// planRename checks a single key move. A copied attachment shares the
+// encrypted file with the original; the file is removed with the last key
+// that refers to it.
+func planRename(entries map[string]entry, from, to string) (keyMove, error) {
+	if from == reservedInitialKey || to == reservedInitialKey {
+		return keyMove{}, errors.New("key 'initial' is reserved")
+	}
+	if to == "" {
+		return keyMove{}, errors.New("missing target")
+	}
+	if _, ok := entries[from]; !ok {
+		return keyMove{}, errors.New("key not found")
+	}
+	if from == to {
+		return keyMove{}, errors.New("old and new key are the same")
+	}
+	if _, exists := entries[to]; exists {
+		return keyMove{}, fmt.Errorf("key already exists: %s", to)
+	}
+	return keyMove{From: from, To: to}, nil
+}
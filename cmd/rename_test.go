@@ -0,0 +1,47 @@
+package main
+
+import "testing"
+
+func TestPlanRename(t *testing.T) {
+	entries := map[string]entry{"initial": {}, "a": {}, "b": {}}
+
+	move, err := planRename(entries, "a", "c")
+	if err != nil || move != (keyMove{From: "a", To: "c"}) {
+		t.Fatalf("planRename = %+v, %v", move, err)
+	}
+
+	bad := [][2]string{
+		{"initial", "c"},
+		{"a", "initial"},
+		{"missing", "c"},
+		{"a", "a"},
+		{"a", "b"},
+		{"a", ""},
+	}
+	for _, b := range bad {
+		if _, err := planRename(entries, b[0], b[1]); err == nil {
+			t.Fatalf("expected error for %s -> %s", b[0], b[1])
+		}
+	}
+}
+
+func TestCopyKeepsOriginal(t *testing.T) {
+	led, master := newTestLedger(t, map[string]string{"prod": "secret"})
+	led.Entries["prod"].Meta[metaType] = typeFields
+
+	if err := moveEntries(led, master, []keyMove{{From: "prod", To: "staging"}}, true); err != nil {
+		t.Fatalf("copy failed: %v", err)
+	}
+	if mustValue(t, led, master, "prod") != "secret" || mustValue(t, led, master, "staging") != "secret" {
+		t.Fatalf("copy changed values")
+	}
+	if led.Entries["staging"].Meta[metaType] != typeFields {
+		t.Fatalf("copy lost metadata")
+	}
+	if _, ok := led.Deleted["prod"]; ok {
+		t.Fatalf("copy left a tombstone for the original")
+	}
+	if _, err := decryptEntry(master, "prod", led.Entries["staging"]); err == nil {
+		t.Fatalf("copy was not re-encrypted under the new key")
+	}
+}
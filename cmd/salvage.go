@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// gcmTagSize is the minimum ciphertext length: an empty value still carries
+// the 16 byte GCM tag.
+const gcmTagSize = 16
+
+var errNothingSalvaged = errors.New("no entries could be recovered (wrong password?)")
+
+func cmdSalvage(args []string) error {
+	if len(args) != 2 {
+		return errors.New("usage: secled salvage <in> <out>")
+	}
+	in, out := args[0], args[1]
+
+	password, err := requirePassword()
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(out); err == nil {
+		return fmt.Errorf("%s already exists", out)
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	data, err := os.ReadFile(in)
+	if err != nil {
+		return err
+	}
+	if err := checkThrottle(in); err != nil {
+		return err
+	}
+	led, masterKey, skipped, err := salvageLedger(data, password)
+	if errors.Is(err, errNothingSalvaged) || errors.Is(err, errWrongPassword) {
+		noteUnlock(in, false)
+	}
+	if err != nil {
+		return err
+	}
+	noteUnlock(in, true)
+
+	if err := copyAttachments(in, out, led); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: some attachments could not be copied:", err)
+	}
+	if err := saveLedger(out, led, masterKey); err != nil {
+		return err
+	}
+
+	for _, key := range sortedKeys(led.Entries) {
+		fmt.Fprintln(os.Stdout, key)
+	}
+	fmt.Fprintf(os.Stderr, "Recovered %d entries and %d deletions into %s (%d damaged bytes skipped)\n", len(led.Entries), len(led.Deleted), out, skipped)
+	return nil
+}
+
+// salvageLedger rebuilds a ledger from a damaged file. Only the header has
+// to be intact, since the KDF salt is needed to derive the master key. The
+// entries are found by scanning the raw bytes; every candidate must pass GCM
+// authentication under its own key name, so garbage cannot slip through.
+// Tombstones are kept where they still parse, so a salvaged copy merged
+// with another one does not bring deleted keys back. The returned ledger
+// keeps the original KDF params, so the same password opens it. skipped is
+// the number of bytes that were not part of a recovered entry or tombstone.
+func salvageLedger(data []byte, password string) (*ledger, []byte, int, error) {
+	if bytes.HasPrefix(data, []byte(textMagic+" ")) {
+		return salvageText(data, password)
+	}
+
+	r := bytes.NewReader(data)
+	header, err := readHeader(r)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("%w: %w (the KDF salt is lost, nothing can be decrypted)", errBadHeader, err)
+	}
+	masterKey := deriveKey(password, header.Params)
+
+	if header.Private {
+		return salvagePrivate(data, masterKey)
+	}
+
+	led := newLedger(header.Params)
+	led.Generation = header.Generation
+
+	var skipped int
+	led.Entries, led.Deleted, skipped = scanEntries(data[len(data)-r.Len():], masterKey, header.Version)
+	if len(led.Entries) == 0 {
+		return nil, nil, 0, errNothingSalvaged
+	}
+	dropRevived(led)
+
+	if err := ensureInitialEntry(led, masterKey); err != nil {
+		return nil, nil, 0, err
+	}
+	return led, masterKey, skipped, nil
+}
+
+// salvageText recovers a text ledger line by line: every entry line that
+// still parses and decrypts is kept.
+func salvageText(data []byte, password string) (*ledger, []byte, int, error) {
+	lines := strings.Split(string(data), "\n")
+	header, n, err := readTextHeader(lines)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("%w: %w (the KDF salt is lost, nothing can be decrypted)", errBadHeader, err)
+	}
+	masterKey := deriveKey(password, header.Params)
+	if header.Private {
+		return salvagePrivate(data, masterKey)
+	}
+
+	led := newLedger(header.Params)
+	led.Format = formatText
+	led.Generation = header.Generation
+
+	skipped := 0
+	for _, line := range lines[n:] {
+		line = strings.TrimRight(line, "\r")
+		if rest, ok := strings.CutPrefix(line, "deleted "); ok {
+			key, at, err := parseTextTombstone(rest)
+			if err != nil {
+				skipped++
+			} else if _, exists := led.Deleted[key]; !exists {
+				led.Deleted[key] = at
+			}
+			continue
+		}
+		rest, ok := strings.CutPrefix(line, "entry ")
+		if !ok {
+			continue
+		}
+		key, e, err := parseTextEntry(rest)
+		if err == nil {
+			_, err = decryptEntry(masterKey, key, e)
+		}
+		if err != nil {
+			skipped++
+			continue
+		}
+		if _, exists := led.Entries[key]; !exists {
+			led.Entries[key] = e
+		}
+	}
+	if len(led.Entries) == 0 {
+		return nil, nil, 0, errNothingSalvaged
+	}
+	dropRevived(led)
+
+	if err := ensureInitialEntry(led, masterKey); err != nil {
+		return nil, nil, 0, err
+	}
+	return led, masterKey, skipped, nil
+}
+
+// dropRevived removes tombstones of keys that were recovered as entries. A
+// healthy ledger never has both; the entry is authenticated, the tombstone
+// is not.
+func dropRevived(led *ledger) {
+	for key := range led.Deleted {
+		if _, ok := led.Entries[key]; ok {
+			delete(led.Deleted, key)
+		}
+	}
+}
+
+// salvagePrivate handles private ledgers: the index is a single GCM
+// message, so it is either intact or lost as a whole.
+func salvagePrivate(data []byte, masterKey []byte) (*ledger, []byte, int, error) {
+	led, err := parseLedger(data)
+	if err != nil {
+		return nil, nil, 0, fmt.Errorf("private index is damaged and cannot be recovered: %w", err)
+	}
+	if err := unlockIndex(led, masterKey); err != nil {
+		return nil, nil, 0, err
+	}
+	led.MAC = nil
+	if err := ensureInitialEntry(led, masterKey); err != nil {
+		return nil, nil, 0, err
+	}
+	return led, masterKey, 0, nil
+}
+
+// scanEntries looks for "keyLen key nonce cipherLen ciphertext" records at
+// every offset, and from version 3 for the tombstone list. Lengths and the
+// key are sanity checked before a candidate is decrypted, so decryption is
+// only attempted where a record plausibly starts; after a hit the scan
+// resumes right after the record, so intact runs of entries are read in one
+// pass and only damaged regions are searched byte by byte. Duplicate keys
+// keep the first copy.
+func scanEntries(data []byte, masterKey []byte, version uint8) (map[string]entry, map[string]time.Time, int) {
+	entries := make(map[string]entry)
+	deleted := make(map[string]time.Time)
+	skipped := 0
+
+	for i := 0; i < len(data); {
+		if e, key, n, ok := scanEntryAt(data[i:], masterKey, version); ok {
+			if _, exists := entries[key]; !exists {
+				entries[key] = e
+			}
+			i += n
+			continue
+		}
+		if version >= 3 {
+			if tombs, n, ok := scanTombstonesAt(data[i:]); ok {
+				for key, at := range tombs {
+					deleted[key] = at
+				}
+				i += n
+				continue
+			}
+		}
+		i++
+		skipped++
+	}
+	return entries, deleted, skipped
+}
+
+// plausibleKey rejects candidates that cannot be a stored key name. Keys
+// come from arguments and lines of input, which cannot hold NUL bytes.
+func plausibleKey(key []byte) bool {
+	return utf8.Valid(key) && bytes.IndexByte(key, 0) < 0
+}
+
+// scanEntryAt tries to read one entry at the start of data. From version 3
+// the metadata after the ciphertext is kept when it still parses; it is
+// only covered by the MAC, so damaged metadata is dropped, not fatal.
+func scanEntryAt(data []byte, masterKey []byte, version uint8) (entry, string, int, bool) {
+	if len(data) < 4 {
+		return entry{}, "", 0, false
+	}
+	keyLen := int(binary.BigEndian.Uint32(data))
+	if keyLen == 0 || keyLen > maxKeyLen || 4+keyLen+nonceSize+4 > len(data) {
+		return entry{}, "", 0, false
+	}
+	key := data[4 : 4+keyLen]
+	if !plausibleKey(key) {
+		return entry{}, "", 0, false
+	}
+
+	pos := 4 + keyLen
+	nonce := data[pos : pos+nonceSize]
+	pos += nonceSize
+	cipherLen := int(binary.BigEndian.Uint32(data[pos:]))
+	pos += 4
+	if cipherLen < gcmTagSize || cipherLen > maxValueLen || pos+cipherLen > len(data) {
+		return entry{}, "", 0, false
+	}
+
+	e := entry{
+		Nonce:      bytes.Clone(nonce),
+		Ciphertext: bytes.Clone(data[pos : pos+cipherLen]),
+	}
+	if _, err := decryptEntry(masterKey, string(key), e); err != nil {
+		return entry{}, "", 0, false
+	}
+	pos += cipherLen
+
+	if version >= 3 {
+		r := bytes.NewReader(data[pos:])
+		if meta, err := readMeta(r); err == nil {
+			e.Meta = meta
+			pos = len(data) - r.Len()
+		}
+	}
+	return e, string(key), pos, true
+}
+
+// scanTombstonesAt tries to read the tombstone list at the start of data:
+// a count and that many (key, deleted_at) records. Tombstones carry no
+// authentication of their own, so the list is only taken when every record
+// is sane and it ends where the file or its MAC does.
+func scanTombstonesAt(data []byte) (map[string]time.Time, int, bool) {
+	r := bytes.NewReader(data)
+	count, err := readUint32(r)
+	if err != nil || int64(count) > int64(len(data)/13) {
+		return nil, 0, false
+	}
+	tombs := make(map[string]time.Time, count)
+	for i := uint32(0); i < count; i++ {
+		keyLen, err := readUint32(r)
+		if err != nil || keyLen == 0 || keyLen > maxKeyLen || int64(keyLen)+8 > int64(r.Len()) {
+			return nil, 0, false
+		}
+		key := make([]byte, keyLen)
+		_, _ = io.ReadFull(r, key)
+		at, _ := readUint64(r)
+		if !plausibleKey(key) || at == 0 || at > math.MaxInt64 {
+			return nil, 0, false
+		}
+		tombs[string(key)] = time.Unix(0, int64(at)).UTC()
+	}
+	n := len(data) - r.Len()
+	if rest := r.Len(); rest != 0 && rest != macSize {
+		return nil, 0, false
+	}
+	return tombs, n, true
+}
+
+// ensureInitialEntry recreates the initial entry if it was lost, so the
+// salvaged ledger can be logged into.
+func ensureInitialEntry(led *ledger, masterKey []byte) error {
+	if _, ok := led.Entries[reservedInitialKey]; ok {
+		return nil
+	}
+	return storeEntry(led, masterKey, reservedInitialKey, []byte(initialValue()))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSalvageLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	master := writeTestLedger(t, path, map[string]string{"alpha": "a", "beta": "b", "gamma": "c"})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	// Break the key length of "beta" so a normal load fails.
+	i := bytes.Index(data, []byte("beta"))
+	binary.BigEndian.PutUint32(data[i-4:], 0xffffffff)
+	if _, err := parseLedger(data); err == nil {
+		t.Fatalf("expected damaged ledger to fail parsing")
+	}
+
+	led, key, skipped, err := salvageLedger(data, "password")
+	if err != nil {
+		t.Fatalf("salvage failed: %v", err)
+	}
+	if !bytes.Equal(key, master) {
+		t.Fatalf("expected the same master key")
+	}
+	if skipped == 0 {
+		t.Fatalf("expected damaged bytes to be skipped")
+	}
+	for _, k := range []string{"alpha", "gamma", reservedInitialKey} {
+		if _, ok := led.Entries[k]; !ok {
+			t.Fatalf("expected %q to be recovered", k)
+		}
+	}
+	if _, ok := led.Entries["beta"]; ok {
+		t.Fatalf("did not expect damaged entry to be recovered")
+	}
+
+	out := filepath.Join(t.TempDir(), "ledger.encrypted")
+	if err := saveLedger(out, led, key); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	loaded, err := loadLedger(out)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if _, err := verifyPassword(loaded, "password"); err != nil {
+		t.Fatalf("verify failed: %v", err)
+	}
+}
+
+func TestSalvageWrongPassword(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	writeTestLedger(t, path, map[string]string{"alpha": "a"})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	if _, _, _, err := salvageLedger(data, "other"); err == nil {
+		t.Fatalf("expected error with wrong password")
+	}
+}
+
+func TestSalvageKeepsTombstones(t *testing.T) {
+	for _, format := range []string{formatBinary, formatText} {
+		t.Run(format, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "ledger.encrypted")
+			master := writeTestLedger(t, path, map[string]string{"alpha": "a", "beta": "b", "gamma": "c"})
+			led, err := loadLedger(path)
+			if err != nil {
+				t.Fatalf("load failed: %v", err)
+			}
+			led.Format = format
+			deleteEntry(led, "gamma")
+			if err := saveLedger(path, led, master); err != nil {
+				t.Fatalf("save failed: %v", err)
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("read failed: %v", err)
+			}
+			// damage the "alpha" ciphertext
+			i := bytes.Index(data, []byte("alpha")) + 20
+			data[i] ^= 0xff
+
+			salvaged, _, _, err := salvageLedger(data, "password")
+			if err != nil {
+				t.Fatalf("salvage failed: %v", err)
+			}
+			if _, ok := salvaged.Entries["beta"]; !ok {
+				t.Fatalf("expected beta to be recovered")
+			}
+			if _, ok := salvaged.Deleted["gamma"]; !ok {
+				t.Fatalf("expected the tombstone of gamma to be kept, got %v", salvaged.Deleted)
+			}
+			if !salvaged.Deleted["gamma"].Equal(led.Deleted["gamma"]) {
+				t.Fatalf("tombstone time changed: %s != %s", salvaged.Deleted["gamma"], led.Deleted["gamma"])
+			}
+		})
+	}
+}
+
+func TestSalvageCountsFailedUnlocks(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "ledger.encrypted")
+	writeTestLedger(t, path, map[string]string{"alpha": "a"})
+	t.Setenv("SECLED_MASTER", "other")
+
+	if err := cmdSalvage([]string{path, filepath.Join(dir, "out")}); err == nil {
+		t.Fatalf("expected error with wrong password")
+	}
+	st, err := loadUnlockState(unlockStatePath(path))
+	if err != nil {
+		t.Fatalf("load unlock state failed: %v", err)
+	}
+	if st.Failures != 1 {
+		t.Fatalf("expected 1 failed unlock, got %d", st.Failures)
+	}
+}
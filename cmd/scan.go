@@ -0,0 +1,363 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// minScanLength is the shortest value scan looks for; shorter ones (ports,
+// "true", PINs) would be found everywhere.
+const minScanLength = 8
+
+// maxScanFileSize is the largest file scan reads; bigger ones are skipped
+// with a note.
+const maxScanFileSize = 64 << 20
+
+// scanPattern is one byte string scan looks for: a value or an encoded
+// form of it.
+type scanPattern struct {
+	Name string // key or key.field
+	Form string // "" for the value itself, "base64", "base64url" or "url"
+}
+
+// acNode is a node of the Aho-Corasick automaton: the trie edges, the
+// failure link and the patterns ending here (also through failure links).
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	out  []int
+}
+
+// matcher finds all patterns in one pass over the input, in time linear in
+// the input plus the matches (Aho-Corasick).
+type matcher struct {
+	nodes    []acNode
+	patterns []scanPattern
+	lengths  []int
+}
+
+func newMatcher() *matcher {
+	return &matcher{nodes: []acNode{{next: make(map[byte]int32)}}}
+}
+
+// add inserts a pattern; build must be called after the last add.
+func (m *matcher) add(b []byte, p scanPattern) {
+	n := int32(0)
+	for _, c := range b {
+		child, ok := m.nodes[n].next[c]
+		if !ok {
+			child = int32(len(m.nodes))
+			m.nodes = append(m.nodes, acNode{next: make(map[byte]int32)})
+			m.nodes[n].next[c] = child
+		}
+		n = child
+	}
+	m.nodes[n].out = append(m.nodes[n].out, len(m.patterns))
+	m.patterns = append(m.patterns, p)
+	m.lengths = append(m.lengths, len(b))
+}
+
+// build sets the failure links breadth first.
+func (m *matcher) build() {
+	queue := []int32{}
+	for _, child := range m.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		n := queue[0]
+		queue = queue[1:]
+		for c, child := range m.nodes[n].next {
+			f := m.nodes[n].fail
+			for f != 0 {
+				if _, ok := m.nodes[f].next[c]; ok {
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			if target, ok := m.nodes[f].next[c]; ok && target != child {
+				m.nodes[child].fail = target
+			}
+			fail := m.nodes[child].fail
+			m.nodes[child].out = append(m.nodes[child].out, m.nodes[fail].out...)
+			queue = append(queue, child)
+		}
+	}
+}
+
+// scanMatch is a pattern found at offset Start of the input.
+type scanMatch struct {
+	Start   int
+	Pattern int
+}
+
+// find returns every occurrence of every pattern in data.
+func (m *matcher) find(data []byte) []scanMatch {
+	var matches []scanMatch
+	n := int32(0)
+	for i, c := range data {
+		for {
+			if next, ok := m.nodes[n].next[c]; ok {
+				n = next
+				break
+			}
+			if n == 0 {
+				break
+			}
+			n = m.nodes[n].fail
+		}
+		for _, p := range m.nodes[n].out {
+			matches = append(matches, scanMatch{Start: i + 1 - m.lengths[p], Pattern: p})
+		}
+	}
+	return matches
+}
+
+// scanForms returns the byte strings to look for for one value: the value
+// without surrounding whitespace and, with encoded, its base64 and URL
+// encodings where they differ from it.
+//
+// A value inside a larger base64 blob (user:token in a Basic header or a
+// Docker auth) is encoded differently depending on its offset modulo 3, so
+// there is one base64 form per offset, without the characters at either end
+// that also depend on the neighbouring bytes. Padding is never part of a
+// form, so padded text matches as well.
+func scanForms(value []byte, encoded bool) map[string][]byte {
+	value = normalizeValue(value)
+	if len(value) < minScanLength {
+		return nil
+	}
+	forms := map[string][]byte{"": value}
+	if !encoded {
+		return forms
+	}
+	for offset := 0; offset < 3; offset++ {
+		suffix := ""
+		if offset > 0 {
+			suffix = fmt.Sprintf(", offset %d", offset)
+		}
+		std := base64Aligned(base64.RawStdEncoding, value, offset)
+		forms["base64"+suffix] = std
+		if urlSafe := base64Aligned(base64.RawURLEncoding, value, offset); !bytes.Equal(urlSafe, std) {
+			forms["base64url"+suffix] = urlSafe
+		}
+	}
+	if escaped := url.QueryEscape(string(value)); escaped != string(value) {
+		forms["url"] = []byte(escaped)
+	}
+	return forms
+}
+
+// base64Aligned encodes value as if offset bytes came before it and keeps
+// only the characters made of value's bits alone.
+func base64Aligned(enc *base64.Encoding, value []byte, offset int) []byte {
+	s := enc.EncodeToString(append(make([]byte, offset), value...))
+	first := (offset*8 + 5) / 6
+	end := (offset + len(value)) * 8 / 6
+	return []byte(s[first:end])
+}
+
+// buildMatcher puts the forms of every value into one matcher.
+func buildMatcher(values []storedValue, encoded bool) *matcher {
+	m := newMatcher()
+	for _, v := range values {
+		forms := scanForms(v.Value, encoded)
+		names := make([]string, 0, len(forms))
+		for form := range forms {
+			names = append(names, form)
+		}
+		sort.Strings(names)
+		for _, form := range names {
+			m.add(forms[form], scanPattern{Name: v.Name(), Form: form})
+		}
+	}
+	m.build()
+	return m
+}
+
+// scanFinding is a stored value found in a file.
+type scanFinding struct {
+	Path string
+	Line int
+	scanPattern
+}
+
+func (f scanFinding) String() string {
+	s := fmt.Sprintf("%s:%d: %s", f.Path, f.Line, f.Name)
+	if f.Form != "" {
+		s += " (" + f.Form + ")"
+	}
+	return s
+}
+
+// scanData reports the lines of data that contain a pattern, each key once
+// per line.
+func (m *matcher) scanData(path string, data []byte) []scanFinding {
+	matches := m.find(data)
+	sort.SliceStable(matches, func(i, j int) bool { return matches[i].Start < matches[j].Start })
+
+	var findings []scanFinding
+	seen := make(map[scanFinding]bool)
+	line, pos := 1, 0
+	for _, match := range matches {
+		line += bytes.Count(data[pos:match.Start], []byte("\n"))
+		pos = match.Start
+		f := scanFinding{Path: path, Line: line, scanPattern: m.patterns[match.Pattern]}
+		if !seen[f] {
+			seen[f] = true
+			findings = append(findings, f)
+		}
+	}
+	return findings
+}
+
+// scanPaths walks files and directories; .git directories, symlinks and
+// files over maxScanFileSize are skipped.
+func (m *matcher) scanPaths(paths []string, notes io.Writer) ([]scanFinding, error) {
+	var findings []scanFinding
+	for _, root := range paths {
+		err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() {
+				if d.Name() == ".git" && path != root {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+			info, err := d.Info()
+			if err != nil {
+				return err
+			}
+			if info.Size() > maxScanFileSize {
+				fmt.Fprintf(notes, "Skipped %s (larger than %d MiB)\n", path, maxScanFileSize>>20)
+				return nil
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			findings = append(findings, m.scanData(path, data)...)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return findings, nil
+}
+
+// scanStaged scans what is staged for the next commit: the index version
+// of every added, copied, modified or renamed file, so a pre-commit hook
+// sees exactly what would be committed.
+func (m *matcher) scanStaged(pathspecs []string) ([]scanFinding, error) {
+	args := append([]string{"diff", "--cached", "--name-only", "-z", "--diff-filter=ACMR", "--"}, pathspecs...)
+	out, err := gitOutput(args...)
+	if err != nil {
+		return nil, err
+	}
+	var findings []scanFinding
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name == "" {
+			continue
+		}
+		data, err := gitOutput("cat-file", "blob", ":"+name)
+		if err != nil {
+			return nil, err
+		}
+		findings = append(findings, m.scanData(name, data)...)
+	}
+	return findings, nil
+}
+
+func gitOutput(args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %w", args[0], err)
+	}
+	return out, nil
+}
+
+func parseScanArgs(args []string) (paths []string, staged, encoded bool, err error) {
+	for _, arg := range args {
+		switch {
+		case arg == "--staged":
+			staged = true
+		case arg == "--encoded":
+			encoded = true
+		case strings.HasPrefix(arg, "-"):
+			return nil, false, false, errors.New("usage: secled scan [--encoded] [paths...] | secled scan --staged [--encoded] [pathspecs...]")
+		default:
+			paths = append(paths, arg)
+		}
+	}
+	if len(paths) == 0 && !staged {
+		paths = []string{"."}
+	}
+	return paths, staged, encoded, nil
+}
+
+func cmdScan(args []string) error {
+	paths, staged, encoded, err := parseScanArgs(args)
+	if err != nil {
+		return err
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	// Policies are not asked: values are never printed, and skipping a key
+	// would let it through.
+	values, _, err := decryptValues(led, masterKey, isSecretField, nil)
+	if err != nil {
+		return err
+	}
+	m := buildMatcher(values, encoded)
+	clearValues(values)
+
+	var findings []scanFinding
+	if staged {
+		findings, err = m.scanStaged(paths)
+	} else {
+		findings, err = m.scanPaths(paths, os.Stderr)
+	}
+	if err != nil {
+		return err
+	}
+	for _, f := range findings {
+		fmt.Fprintln(os.Stdout, f)
+	}
+	if len(findings) > 0 {
+		return fmt.Errorf("stored secrets found (%d)", len(findings))
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMatcherFind(t *testing.T) {
+	m := newMatcher()
+	for i, p := range []string{"he", "she", "his", "hers"} {
+		m.add([]byte(p), scanPattern{Name: p, Form: string(rune('0' + i))})
+	}
+	m.build()
+
+	var got []string
+	for _, match := range m.find([]byte("ushers")) {
+		got = append(got, m.patterns[match.Pattern].Name+"@"+string(rune('0'+match.Start)))
+	}
+	want := "she@1 he@2 hers@2"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("matches = %v, want %s", got, want)
+	}
+}
+
+func TestScanForms(t *testing.T) {
+	if forms := scanForms([]byte("short\n"), true); forms != nil {
+		t.Fatalf("short value scanned: %v", forms)
+	}
+	forms := scanForms([]byte("p@ss word/1\n"), true)
+	if string(forms[""]) != "p@ss word/1" || string(forms["url"]) != "p%40ss+word%2F1" {
+		t.Fatalf("forms = %q", forms)
+	}
+	// 11 bytes: the last character also holds bits of whatever follows
+	if want := base64.RawStdEncoding.EncodeToString([]byte("p@ss word/1")); string(forms["base64"]) != want[:len(want)-1] {
+		t.Fatalf("base64 form = %q", forms["base64"])
+	}
+	for offset, form := range []string{"base64", "base64, offset 1", "base64, offset 2"} {
+		for _, prefix := range []string{"", "a", "ab", "abc"} {
+			if len(prefix)%3 != offset {
+				continue
+			}
+			for _, suffix := range []string{"", "x", "xy", "xyz"} {
+				blob := base64.StdEncoding.EncodeToString([]byte(prefix + "p@ss word/1" + suffix))
+				if !strings.Contains(blob, string(forms[form])) {
+					t.Fatalf("%s form %q not in %q", form, forms[form], blob)
+				}
+			}
+		}
+	}
+	if forms := scanForms([]byte("plainvalue"), false); len(forms) != 1 {
+		t.Fatalf("forms without encoded = %q", forms)
+	}
+}
+
+func TestScanPaths(t *testing.T) {
+	values := []storedValue{
+		{Key: "jwt", Value: []byte("0123456789abcdef\n")},
+		{Key: "db", Field: "password", Value: []byte("hunter2hunter2")},
+		{Key: "pin", Value: []byte("1234")},
+	}
+	m := buildMatcher(values, true)
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.env":   "PIN=1234\nJWT=0123456789abcdef\n",
+		"sub/auth.txt": "a\nb\nAuthorization: Basic " + base64.StdEncoding.EncodeToString([]byte("hunter2hunter2")) + "\n",
+		"sub/clean.go": "package main\n",
+		"docker.json":  `{"auths":{"ghcr.io":{"auth":"` + base64.StdEncoding.EncodeToString([]byte("user:hunter2hunter2")) + `"}}}`,
+		".git/config":  "0123456789abcdef",
+	}
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			t.Fatalf("mkdir failed: %v", err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+
+	findings, err := m.scanPaths([]string{dir}, &bytes.Buffer{})
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	var got []string
+	for _, f := range findings {
+		rel, _ := filepath.Rel(dir, f.Path)
+		f.Path = filepath.ToSlash(rel)
+		got = append(got, f.String())
+	}
+	want := "config.env:2: jwt docker.json:1: db.password (base64, offset 2) sub/auth.txt:3: db.password (base64)"
+	if strings.Join(got, " ") != want {
+		t.Fatalf("findings = %q, want %q", got, want)
+	}
+}
+
+func TestScanStaged(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not installed")
+	}
+	dir := t.TempDir()
+	git := func(args ...string) {
+		cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v failed: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	if err := os.WriteFile(filepath.Join(dir, "app.env"), []byte("TOKEN=0123456789abcdef\n"), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+	git("add", "app.env")
+	// the working tree no longer has the token, the index still does
+	if err := os.WriteFile(filepath.Join(dir, "app.env"), []byte("TOKEN=\n"), 0o600); err != nil {
+		t.Fatalf("write failed: %v", err)
+	}
+
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatalf("chdir failed: %v", err)
+	}
+	defer os.Chdir(wd)
+
+	m := buildMatcher([]storedValue{{Key: "token", Value: []byte("0123456789abcdef")}}, false)
+	findings, err := m.scanStaged(nil)
+	if err != nil {
+		t.Fatalf("scan failed: %v", err)
+	}
+	if len(findings) != 1 || findings[0].String() != "app.env:1: token" {
+		t.Fatalf("findings = %v", findings)
+	}
+}
+
+func TestParseScanArgs(t *testing.T) {
+	paths, staged, encoded, err := parseScanArgs(nil)
+	if err != nil || strings.Join(paths, ",") != "." || staged || encoded {
+		t.Fatalf("defaults = %v %v %v %v", paths, staged, encoded, err)
+	}
+	paths, staged, encoded, err = parseScanArgs([]string{"--staged", "--encoded"})
+	if err != nil || len(paths) != 0 || !staged || !encoded {
+		t.Fatalf("staged = %v %v %v %v", paths, staged, encoded, err)
+	}
+	if _, _, _, err := parseScanArgs([]string{"--all"}); err == nil {
+		t.Fatal("expected error for an unknown option")
+	}
+}
@@ -0,0 +1,573 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/term"
+)
+
+// shellHelp lists the commands of secled shell.
+const shellHelp = `Commands:
+  list [prefix/]                      tree [prefix/]
+  get <key>[.field] [--field name]    add <key> [--field name=value|name=- ...]
+  update <key> [--field ...]          rm [-r] <key|prefix/>
+  mv <from> <to>                      rename <old> <new>
+  copy-key <key> <new>                gen uuid|64hex [-o] <key>
+  due [--within 14d]                  save
+  exit (saves), quit! (drops unsaved changes)
+add, update and gen take --expires 90d|date and --rotate-every 90d.
+`
+
+// shellCommandNames are completed as the first word of a line.
+var shellCommandNames = []string{
+	"list", "tree", "get", "add", "update", "rm", "remove", "mv", "rename",
+	"copy-key", "gen", "due", "save", "help", "exit", "quit",
+}
+
+// session is an unlocked ledger kept in memory by secled shell. Changes are
+// written on save and on exit, so neither Argon2id nor a file rewrite runs
+// per command. The ledger lock is only taken while saving: the file is
+// loaded again and the entries changed in the session since the last save
+// are applied to it, so other secled processes can write meanwhile.
+type session struct {
+	path      string
+	led       *ledger
+	masterKey []byte
+	dirty     bool
+	term      *term.Terminal
+
+	// base is what the entries were at the last load or save; save writes
+	// only what differs from it.
+	base map[string]entry
+}
+
+func cmdShell(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: secled shell")
+	}
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return errors.New("shell needs a terminal")
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedgerWith(led, func() (string, error) {
+		if password, err := requirePassword(); err == nil {
+			return password, nil
+		}
+		return readPassword("Master password: ")
+	})
+	if err != nil {
+		return err
+	}
+	defer clear(masterKey)
+
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer term.Restore(fd, state)
+
+	s := &session{path: path, led: led, masterKey: masterKey}
+	s.snapshot()
+	s.term = term.NewTerminal(struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}, "secled> ")
+	s.term.AutoCompleteCallback = s.complete
+	fmt.Fprintln(s.term, `Ledger unlocked. Type "help" for commands.`)
+	return s.run()
+}
+
+func (s *session) run() error {
+	for {
+		if s.dirty {
+			s.term.SetPrompt("secled*> ")
+		} else {
+			s.term.SetPrompt("secled> ")
+		}
+
+		line, err := s.term.ReadLine()
+		if errors.Is(err, io.EOF) {
+			fmt.Fprintln(s.term)
+			return s.save()
+		}
+		if err != nil {
+			return err
+		}
+
+		words, err := splitWords(line)
+		if err != nil {
+			fmt.Fprintln(s.term, "Error:", err)
+			continue
+		}
+		if len(words) == 0 {
+			continue
+		}
+
+		switch words[0] {
+		case "exit", "quit":
+			if err := s.save(); err != nil {
+				fmt.Fprintln(s.term, "Error:", err)
+				continue
+			}
+			return nil
+		case "quit!":
+			return nil
+		}
+		err = s.exec(words[0], words[1:])
+		if auditedCommands[words[0]] {
+			if aerr := appendAudit(auditLogPath(s.path), s.led, "shell "+words[0], auditKeyOf(words[0], words[1:]), err); aerr != nil {
+				fmt.Fprintln(s.term, "Warning: cannot write audit log:", aerr)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(s.term, "Error:", err)
+		}
+	}
+}
+
+func (s *session) exec(name string, args []string) error {
+	switch name {
+	case "help":
+		_, err := fmt.Fprint(s.term, shellHelp)
+		return err
+	case "save":
+		return s.save()
+	case "list", "ls":
+		return s.list(args)
+	case "tree":
+		return s.tree(args)
+	case "get":
+		return s.get(args)
+	case "add":
+		return s.add(args)
+	case "update":
+		return s.update(args)
+	case "rm", "remove":
+		return s.remove(args)
+	case "mv", "rename", "copy-key":
+		return s.move(name, args)
+	case "gen", "generate":
+		return s.generate(args)
+	case "due":
+		within, err := parseDueArgs(args)
+		if err != nil {
+			return err
+		}
+		return writeDue(s.term, s.led.Entries, time.Now(), within)
+	default:
+		return fmt.Errorf("unknown command %q (try help)", name)
+	}
+}
+
+// save writes the changes of the session if there are any. Under the
+// ledger lock it loads the file again, applies the entries added, changed
+// or removed in the session and saves that, so changes other secled
+// processes made meanwhile are kept. A key changed on both sides takes the
+// session's version, with a warning.
+func (s *session) save() error {
+	if !s.dirty {
+		return nil
+	}
+	unlock, err := lockLedger(s.path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	current, err := loadLedger(s.path)
+	if err != nil {
+		return err
+	}
+	if err := verifyKey(current, s.masterKey); err != nil {
+		if errors.Is(err, errWrongPassword) {
+			return errors.New("the master password was changed outside this shell; changes not saved")
+		}
+		return err
+	}
+
+	for _, key := range sortedKeys(s.led.Entries) {
+		e := s.led.Entries[key]
+		old, inBase := s.base[key]
+		if inBase && sameEntry(old, e) {
+			continue
+		}
+		if c, ok := current.Entries[key]; ok && (!inBase || !sameEntry(c, old)) {
+			fmt.Fprintf(s.term, "Warning: %s was also changed outside this shell; keeping this session's value\n", key)
+		}
+		current.Entries[key] = e
+		delete(current.Deleted, key)
+	}
+	for _, key := range sortedKeys(s.base) {
+		if _, ok := s.led.Entries[key]; ok {
+			continue
+		}
+		if c, ok := current.Entries[key]; ok && !sameEntry(c, s.base[key]) {
+			fmt.Fprintf(s.term, "Warning: %s was also changed outside this shell; removing it anyway\n", key)
+		}
+		delete(current.Entries, key)
+		if at, ok := s.led.Deleted[key]; ok {
+			current.Deleted[key] = at
+		}
+	}
+
+	if err := saveLedger(s.path, current, s.masterKey); err != nil {
+		return err
+	}
+	pruneAttachments(s.path, current)
+	s.led = current
+	s.snapshot()
+	s.dirty = false
+	fmt.Fprintln(s.term, "Saved", s.path)
+	return nil
+}
+
+// snapshot makes the current entries the base of the next save.
+func (s *session) snapshot() {
+	s.base = make(map[string]entry, len(s.led.Entries))
+	for key, e := range s.led.Entries {
+		// expiry changes edit the metadata map in place
+		e.Meta = maps.Clone(e.Meta)
+		s.base[key] = e
+	}
+}
+
+func sameEntry(a, b entry) bool {
+	return bytes.Equal(a.Nonce, b.Nonce) && bytes.Equal(a.Ciphertext, b.Ciphertext) && maps.Equal(a.Meta, b.Meta)
+}
+
+func (s *session) readSecret(prompt string) ([]byte, error) {
+	value, err := s.term.ReadPassword(prompt)
+	if errors.Is(err, io.EOF) {
+		return nil, errors.New("cancelled")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		return nil, errors.New("empty input")
+	}
+	return []byte(value), nil
+}
+
+// prompter asks policy questions on the shell's terminal.
+func (s *session) prompter() prompter {
+	return prompter{
+		interactive: true,
+		readLine: func(prompt string) (string, error) {
+			s.term.SetPrompt(prompt)
+			line, err := s.term.ReadLine()
+			if errors.Is(err, io.EOF) {
+				return "", errors.New("cancelled")
+			}
+			return line, err
+		},
+		readPassword: s.term.ReadPassword,
+	}
+}
+
+func (s *session) list(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: list [prefix/]")
+	}
+	keys := sortedKeys(s.led.Entries)
+	if len(args) == 1 {
+		prefix := namespacePrefix(args[0])
+		if keys = listLevel(keys, prefix); len(keys) == 0 {
+			return fmt.Errorf("no keys under %s", prefix)
+		}
+	}
+	for _, k := range keys {
+		fmt.Fprintln(s.term, k)
+	}
+	return nil
+}
+
+func (s *session) tree(args []string) error {
+	if len(args) > 1 {
+		return errors.New("usage: tree [prefix/]")
+	}
+	prefix, root := "", "."
+	if len(args) == 1 {
+		prefix = namespacePrefix(args[0])
+		root = prefix
+	}
+	fmt.Fprintln(s.term, root)
+	writeTree(s.term, sortedKeys(s.led.Entries), prefix, "")
+	return nil
+}
+
+func (s *session) get(args []string) error {
+	key, field, err := parseGetArgs(args)
+	if err != nil {
+		return err
+	}
+	value, err := getValue(s.led, s.masterKey, key, field, s.prompter())
+	if err != nil {
+		return err
+	}
+	key, _ = resolveField(s.led.Entries, key, field)
+	if warning := expiryWarning(key, s.led.Entries[key], time.Now()); warning != "" {
+		fmt.Fprintln(s.term, warning)
+	}
+	if _, err := s.term.Write(value); err != nil {
+		return err
+	}
+	if len(value) > 0 && value[len(value)-1] != '\n' {
+		fmt.Fprintln(s.term)
+	}
+	return nil
+}
+
+func (s *session) add(args []string) error {
+	args, expiry, err := parseExpiryArgs(args, time.Now())
+	if err != nil {
+		return err
+	}
+	key, fieldArgs, err := parseKeyFieldArgs(args)
+	if err != nil {
+		return err
+	}
+	if key == reservedInitialKey {
+		return errors.New("key 'initial' is reserved")
+	}
+	if err := addValue(s.led, s.masterKey, key, fieldArgs, s.readSecret); err != nil {
+		return err
+	}
+	expiry.apply(s.led.Entries[key])
+	s.dirty = true
+	return nil
+}
+
+func (s *session) update(args []string) error {
+	args, expiry, err := parseExpiryArgs(args, time.Now())
+	if err != nil {
+		return err
+	}
+	key, fieldArgs, err := parseKeyFieldArgs(args)
+	if err != nil {
+		return err
+	}
+	if key == reservedInitialKey {
+		return errors.New("key 'initial' is reserved")
+	}
+	if err := updateValue(s.led, s.masterKey, key, fieldArgs, s.readSecret); err != nil {
+		return err
+	}
+	expiry.apply(s.led.Entries[key])
+	s.dirty = true
+	return nil
+}
+
+func (s *session) remove(args []string) error {
+	key, recursive, err := parseRemoveArgs(args)
+	if err != nil {
+		return err
+	}
+	if key == reservedInitialKey {
+		return errors.New("key 'initial' is reserved")
+	}
+	if err := removeKeys(s.led, key, recursive); err != nil {
+		return err
+	}
+	s.dirty = true
+	return nil
+}
+
+func (s *session) move(name string, args []string) error {
+	if len(args) != 2 {
+		return fmt.Errorf("usage: %s <from> <to>", name)
+	}
+	var moves []keyMove
+	if name == "mv" {
+		var err error
+		if moves, err = planMove(s.led.Entries, args[0], args[1]); err != nil {
+			return err
+		}
+	} else {
+		move, err := planRename(s.led.Entries, args[0], args[1])
+		if err != nil {
+			return err
+		}
+		moves = []keyMove{move}
+	}
+	if err := moveEntries(s.led, s.masterKey, moves, name == "copy-key"); err != nil {
+		return err
+	}
+	s.dirty = true
+	return nil
+}
+
+func (s *session) generate(args []string) error {
+	if len(args) == 0 || (args[0] != "uuid" && args[0] != "64hex") {
+		return errors.New("usage: gen uuid|64hex [-o] <key>")
+	}
+	rest, expiry, err := parseExpiryArgs(args[1:], time.Now())
+	if err != nil {
+		return err
+	}
+	key, output, err := parseGenerateArgs(rest)
+	if err != nil {
+		return err
+	}
+	if key == reservedInitialKey {
+		return errors.New("key 'initial' is reserved")
+	}
+	value, err := generateValue(s.led, s.masterKey, key, args[0])
+	if err != nil {
+		return err
+	}
+	expiry.apply(s.led.Entries[key])
+	s.dirty = true
+	if output {
+		fmt.Fprintln(s.term, value)
+	}
+	return nil
+}
+
+// complete is the Tab handler of the shell: it completes the command name
+// in the first word and key names after it. Several candidates are
+// completed to their common prefix and listed.
+func (s *session) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	start := wordStart(line[:pos])
+	word := line[start:pos]
+
+	var candidates []string
+	if strings.TrimSpace(line[:start]) == "" {
+		candidates = shellCommandNames
+	} else {
+		candidates = sortedKeys(s.led.Entries)
+	}
+	// A key being typed in quotes is matched without its opening quote.
+	typed := strings.TrimLeft(word, `'"`)
+	var matches []string
+	for _, c := range candidates {
+		if strings.HasPrefix(c, typed) {
+			matches = append(matches, c)
+		}
+	}
+	if len(matches) == 0 {
+		return "", 0, false
+	}
+
+	completed := commonPrefix(matches)
+	switch {
+	case len(matches) == 1:
+		completed = quoteWord(completed) + " "
+	case completed == typed:
+		sort.Strings(matches)
+		fmt.Fprintln(s.term, strings.Join(matches, "  "))
+		return "", 0, false
+	case typed != word:
+		completed = word[:len(word)-len(typed)] + completed
+	}
+	newLine := line[:start] + completed + line[pos:]
+	return newLine, start + len(completed), true
+}
+
+// wordStart returns where the last word of line begins; spaces inside
+// quotes do not end a word.
+func wordStart(line string) int {
+	start := 0
+	var quote rune
+	for i, r := range line {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == ' ' || r == '\t':
+			start = i + 1
+		}
+	}
+	return start
+}
+
+func commonPrefix(words []string) string {
+	prefix := words[0]
+	for _, w := range words[1:] {
+		for !strings.HasPrefix(w, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	return prefix
+}
+
+// quoteWord quotes a completed key the way splitWords reads it back.
+func quoteWord(w string) string {
+	if shellSafe(w) {
+		return w
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(w) + `"`
+}
+
+// splitWords splits a shell line into words. Single and double quotes
+// group words; inside double quotes and outside quotes a backslash escapes
+// the next character.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var cur strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+
+	for _, r := range line {
+		switch {
+		case escaped:
+			cur.WriteRune(r)
+			escaped = false
+		case quote == '\'':
+			if r == '\'' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\\':
+			escaped, inWord = true, true
+		case quote == '"':
+			if r == '"' {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inWord = r, true
+		case r == ' ' || r == '\t':
+			if inWord {
+				words = append(words, cur.String())
+				cur.Reset()
+				inWord = false
+			}
+		default:
+			cur.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, errors.New("unterminated quote")
+	}
+	if inWord {
+		words = append(words, cur.String())
+	}
+	return words, nil
+}
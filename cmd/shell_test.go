@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/term"
+)
+
+func TestSplitWords(t *testing.T) {
+	cases := map[string][]string{
+		`get key`:                   {"get", "key"},
+		`  get   'my key'  `:        {"get", "my key"},
+		`add "a \"b\"" --field x=1`: {"add", `a "b"`, "--field", "x=1"},
+		`get my\ key`:               {"get", "my key"},
+		`get ''`:                    {"get", ""},
+		``:                          nil,
+	}
+	for line, want := range cases {
+		got, err := splitWords(line)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Fatalf("splitWords(%q) = %q, %v; want %q", line, got, err, want)
+		}
+	}
+	for _, line := range []string{`get 'open`, `get "open`, `get \`} {
+		if _, err := splitWords(line); err == nil {
+			t.Fatalf("expected error for %q", line)
+		}
+	}
+}
+
+func TestQuoteWordRoundTrip(t *testing.T) {
+	for _, key := range []string{"plain", "my key", `quo"te`, `back\slash`, "it's"} {
+		words, err := splitWords("get " + quoteWord(key))
+		if err != nil || len(words) != 2 || words[1] != key {
+			t.Fatalf("round trip of %q gave %q, %v", key, words, err)
+		}
+	}
+}
+
+func newTestSession(t *testing.T, input string) (*session, *bytes.Buffer) {
+	t.Helper()
+	led, master := newTestLedger(t, map[string]string{"app/db": "v-app/db", "app/token": "v-app/token", "my key": "v-my key"})
+	var out bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(input), &out}
+	return &session{led: led, masterKey: master, term: term.NewTerminal(rw, "> ")}, &out
+}
+
+func TestSessionCommands(t *testing.T) {
+	s, out := newTestSession(t, "typed-secret\r")
+
+	if err := s.exec("get", []string{"my key"}); err != nil {
+		t.Fatalf("get failed: %v", err)
+	}
+	if !strings.Contains(out.String(), "v-my key") {
+		t.Fatalf("get printed %q", out.String())
+	}
+	if s.dirty {
+		t.Fatalf("get marked the session dirty")
+	}
+
+	if err := s.exec("add", []string{"new"}); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if got := mustValue(t, s.led, s.masterKey, "new"); got != "typed-secret" {
+		t.Fatalf("added value = %q", got)
+	}
+	if !s.dirty {
+		t.Fatalf("add did not mark the session dirty")
+	}
+
+	if err := s.exec("mv", []string{"app/", "old/"}); err != nil {
+		t.Fatalf("mv failed: %v", err)
+	}
+	if err := s.exec("rm", []string{"-r", "old/"}); err != nil {
+		t.Fatalf("rm -r failed: %v", err)
+	}
+	if err := s.exec("gen", []string{"64hex", "hex"}); err != nil {
+		t.Fatalf("gen failed: %v", err)
+	}
+	want := []string{"hex", "my key", "new"}
+	if got := sortedKeys(s.led.Entries); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys = %q, want %q", got, want)
+	}
+
+	if err := s.exec("add", []string{"initial"}); err == nil {
+		t.Fatalf("expected error for reserved key")
+	}
+	if err := s.exec("bogus", nil); err == nil {
+		t.Fatalf("expected error for unknown command")
+	}
+}
+
+func TestSessionComplete(t *testing.T) {
+	s, _ := newTestSession(t, "")
+
+	cases := []struct {
+		line, want string
+	}{
+		{"tr", "tree "},
+		{"get my", `get "my key" `},
+		{`get "my`, `get "my key" `},
+		{"get app/t", "get app/token "},
+		{"get ap", "get app/"},
+	}
+	for _, c := range cases {
+		line, pos, ok := s.complete(c.line, len(c.line), '\t')
+		if !ok || line != c.want || pos != len(c.want) {
+			t.Fatalf("complete(%q) = %q, %d, %v; want %q", c.line, line, pos, ok, c.want)
+		}
+	}
+	if _, _, ok := s.complete("get zz", 6, '\t'); ok {
+		t.Fatalf("completion without matches changed the line")
+	}
+	if _, _, ok := s.complete("get", 3, 'x'); ok {
+		t.Fatalf("completion ran for a key other than Tab")
+	}
+}
+
+func TestSessionSaveKeepsOtherWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	master := writeTestLedger(t, path, map[string]string{"a": "1", "b": "2"})
+	led, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	var out bytes.Buffer
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader("session-value\r"), &out}
+	s := &session{path: path, led: led, masterKey: master, term: term.NewTerminal(rw, "> ")}
+	s.snapshot()
+
+	if err := s.exec("add", []string{"mine"}); err != nil {
+		t.Fatalf("add failed: %v", err)
+	}
+	if err := s.exec("rm", []string{"a"}); err != nil {
+		t.Fatalf("rm failed: %v", err)
+	}
+
+	// the session holds no lock, so another process writes meanwhile
+	unlock, err := lockLedgerTimeout(path, 200*time.Millisecond)
+	if err != nil {
+		t.Fatalf("shell session holds the ledger lock: %v", err)
+	}
+	other, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	if err := storeEntry(other, master, "theirs", []byte("3")); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	if err := saveLedger(path, other, master); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	unlock()
+
+	if err := s.exec("save", nil); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	saved, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+	want := []string{"b", "initial", "mine", "theirs"}
+	if got := sortedKeys(saved.Entries); !reflect.DeepEqual(got, want) {
+		t.Fatalf("keys = %q, want %q", got, want)
+	}
+	if _, ok := saved.Deleted["a"]; !ok {
+		t.Fatalf("expected a tombstone for a")
+	}
+	if got := mustValue(t, saved, master, "mine"); got != "session-value" {
+		t.Fatalf("mine = %q", got)
+	}
+	if _, ok := s.led.Entries["theirs"]; !ok || s.dirty {
+		t.Fatalf("session did not pick up the saved ledger")
+	}
+}
@@ -0,0 +1,556 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"unicode"
+)
+
+// commonPasswordList holds the most used passwords, most common first.
+//
+//go:embed common-passwords.txt
+var commonPasswordList string
+
+// commonPasswords maps each of them to its rank, the number of guesses an
+// attacker needs.
+var commonPasswords = rankWords(commonPasswordList)
+
+// minStrongScore is the lowest score that is not reported as weak.
+const minStrongScore = 3
+
+// strength is the estimate for one password, in the style of zxcvbn: the
+// number of guesses a smart attacker needs, found as the cheapest way to
+// build the password from dictionary words, keyboard walks, repeats,
+// sequences, years and random characters.
+type strength struct {
+	Log10Guesses float64
+	Score        int      // 0 (too guessable) to 4 (very unguessable)
+	Patterns     []string // what made it guessable
+}
+
+// Bits is the estimate as entropy.
+func (s strength) Bits() float64 {
+	return s.Log10Guesses * math.Log2(10)
+}
+
+func (s strength) String() string {
+	text := fmt.Sprintf("score %d/4, ~%.0f bits", s.Score, s.Bits())
+	if len(s.Patterns) > 0 {
+		text += ": " + strings.Join(s.Patterns, ", ")
+	}
+	return text
+}
+
+// strengthMatch is a part of the password, password[i:j], that can be
+// guessed in 10^log10 guesses.
+type strengthMatch struct {
+	i, j    int
+	log10   float64
+	pattern string
+}
+
+// maxStrengthRunes bounds the work for long values (certificates, keys);
+// what follows adds guesses, so the estimate of the start is a lower bound.
+const maxStrengthRunes = 128
+
+// bruteforceLog10 is what each character not covered by a pattern costs,
+// as in zxcvbn.
+const bruteforceLog10 = 1
+
+// estimateStrength rates password; userWords (the key name, the user
+// name, ...) are guessed first, like the top of the dictionary.
+func estimateStrength(password string, userWords ...string) strength {
+	runes := []rune(password)
+	if len(runes) > maxStrengthRunes {
+		runes = runes[:maxStrengthRunes]
+	}
+	var matches []strengthMatch
+	matches = append(matches, dictionaryMatches(runes, commonPasswords, "common password")...)
+	matches = append(matches, dictionaryMatches(runes, rankWords(strings.Join(userWords, "\n")), "contains the key or user name")...)
+	matches = append(matches, spatialMatches(runes)...)
+	matches = append(matches, repeatMatches(runes)...)
+	matches = append(matches, sequenceMatches(runes)...)
+	matches = append(matches, yearMatches(runes)...)
+
+	// best[j] is the cheapest cover of runes[:j]; a cover of several
+	// patterns also costs the order in which they are tried.
+	n := len(runes)
+	best := make([]float64, n+1)
+	count := make([]int, n+1)
+	from := make([]*strengthMatch, n+1)
+	for j := 1; j <= n; j++ {
+		best[j] = best[j-1] + bruteforceLog10
+		count[j] = count[j-1]
+		if j == 1 || from[j-1] != nil {
+			count[j]++ // a run of random characters is one pattern
+		}
+		for k := range matches {
+			m := &matches[k]
+			if m.j != j {
+				continue
+			}
+			if cost := best[m.i] + m.log10; cost < best[j] {
+				best[j], count[j], from[j] = cost, count[m.i]+1, m
+			}
+		}
+	}
+
+	s := strength{Log10Guesses: best[n] + log10Factorial(count[n])}
+	if n == 0 {
+		s.Log10Guesses = 0
+	}
+	seen := make(map[string]bool)
+	for j := n; j > 0; {
+		m := from[j]
+		if m == nil {
+			j--
+			continue
+		}
+		if !seen[m.pattern] {
+			seen[m.pattern] = true
+			s.Patterns = append([]string{m.pattern}, s.Patterns...)
+		}
+		j = m.i
+	}
+	if n < 8 {
+		s.Patterns = append(s.Patterns, "shorter than 8 characters")
+	}
+
+	switch g := s.Log10Guesses; {
+	case g < 3:
+		s.Score = 0
+	case g < 6:
+		s.Score = 1
+	case g < 8:
+		s.Score = 2
+	case g < 10:
+		s.Score = 3
+	default:
+		s.Score = 4
+	}
+	return s
+}
+
+// log10Factorial is log10(n!), from the log-gamma function so it cannot
+// overflow.
+func log10Factorial(n int) float64 {
+	lg, _ := math.Lgamma(float64(n) + 1)
+	return lg / math.Ln10
+}
+
+// rankWords maps each lower-cased line of list to its 1-based rank.
+func rankWords(list string) map[string]int {
+	ranks := make(map[string]int)
+	for _, line := range strings.Split(list, "\n") {
+		word := strings.ToLower(strings.TrimSpace(line))
+		if len(word) >= 3 {
+			if _, ok := ranks[word]; !ok {
+				ranks[word] = len(ranks) + 1
+			}
+		}
+	}
+	return ranks
+}
+
+// leetSubstitutions undoes the usual letter replacements.
+var leetSubstitutions = map[rune]rune{
+	'4': 'a', '@': 'a', '8': 'b', '(': 'c', '3': 'e', '6': 'g', '1': 'i',
+	'!': 'i', '|': 'l', '0': 'o', '$': 's', '5': 's', '7': 't', '+': 't',
+	'2': 'z',
+}
+
+// dictionaryMatches finds words of dict in runes, also capitalized,
+// reversed or written in l33t.
+func dictionaryMatches(runes []rune, dict map[string]int, pattern string) []strengthMatch {
+	if len(dict) == 0 {
+		return nil
+	}
+	longest := 0
+	for word := range dict {
+		longest = max(longest, len(word))
+	}
+	var matches []strengthMatch
+	for i := 0; i < len(runes); i++ {
+		for j := i + 3; j <= min(len(runes), i+longest); j++ {
+			part := runes[i:j]
+			lower := strings.ToLower(string(part))
+			variants := map[string]float64{lower: 0}
+			if leet := unleet(lower); leet != lower {
+				variants[leet] = math.Log10(2)
+			}
+			if reversed := reverseString(lower); reversed != lower {
+				variants[reversed] = math.Log10(2)
+			}
+			for word, extra := range variants {
+				rank, ok := dict[word]
+				if !ok {
+					continue
+				}
+				if lower != string(part) {
+					extra += uppercaseLog10(part)
+				}
+				matches = append(matches, strengthMatch{i, j, math.Log10(float64(rank)) + extra, pattern})
+			}
+		}
+	}
+	return matches
+}
+
+func unleet(s string) string {
+	return strings.Map(func(r rune) rune {
+		if sub, ok := leetSubstitutions[r]; ok {
+			return sub
+		}
+		return r
+	}, s)
+}
+
+func reverseString(s string) string {
+	runes := []rune(s)
+	for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+		runes[i], runes[j] = runes[j], runes[i]
+	}
+	return string(runes)
+}
+
+// uppercaseLog10 is the cost of the capitalization of a word: a capital
+// first or last letter or all capitals double it, anything else counts
+// the ways to place that many capitals.
+func uppercaseLog10(word []rune) float64 {
+	upper, lower := 0, 0
+	for _, r := range word {
+		switch {
+		case unicode.IsUpper(r):
+			upper++
+		case unicode.IsLower(r):
+			lower++
+		}
+	}
+	if upper == 0 {
+		return 0
+	}
+	if lower == 0 || (upper == 1 && (unicode.IsUpper(word[0]) || unicode.IsUpper(word[len(word)-1]))) {
+		return math.Log10(2)
+	}
+	ways := 0.0
+	for k := 1; k <= min(upper, lower); k++ {
+		ways += binomial(upper+lower, k)
+	}
+	return math.Log10(ways)
+}
+
+func binomial(n, k int) float64 {
+	r := 1.0
+	for i := 1; i <= k; i++ {
+		r = r * float64(n-k+i) / float64(i)
+	}
+	return r
+}
+
+// keyboardRows is the US QWERTY layout, unshifted and shifted. Each row
+// is offset by the stagger of the keys, so adjacency is a distance test.
+var keyboardRows = []struct {
+	keys, shifted string
+	offset        float64
+}{
+	{"`1234567890-=", "~!@#$%^&*()_+", 0},
+	{"qwertyuiop[]\\", "QWERTYUIOP{}|", 1.5},
+	{"asdfghjkl;'", "ASDFGHJKL:\"", 1.75},
+	{"zxcvbnm,./", "ZXCVBNM<>?", 2.25},
+}
+
+type keyPosition struct {
+	row     int
+	x       float64
+	shifted bool
+}
+
+var keyboardPositions = func() map[rune]keyPosition {
+	positions := make(map[rune]keyPosition)
+	for row, r := range keyboardRows {
+		for col, key := range r.keys {
+			positions[key] = keyPosition{row, float64(col) + r.offset, false}
+		}
+		for col, key := range r.shifted {
+			positions[key] = keyPosition{row, float64(col) + r.offset, true}
+		}
+	}
+	return positions
+}()
+
+// keyboardDirection returns the direction from key a to a neighbouring
+// key b (0 to 5), or -1 when they are not neighbours.
+func keyboardDirection(a, b rune) int {
+	pa, okA := keyboardPositions[a]
+	pb, okB := keyboardPositions[b]
+	if !okA || !okB {
+		return -1
+	}
+	dx := pb.x - pa.x
+	switch pb.row - pa.row {
+	case 0:
+		if dx == 1 {
+			return 0
+		}
+		if dx == -1 {
+			return 1
+		}
+	case -1, 1:
+		if math.Abs(dx) < 1 {
+			d := 2
+			if pb.row > pa.row {
+				d = 4
+			}
+			if dx > 0 {
+				d++
+			}
+			return d
+		}
+	}
+	return -1
+}
+
+// spatialMatches finds walks over neighbouring keys (qwerty, 1qaz2wsx,
+// zxcvbn) of at least three keys. Like zxcvbn the guesses grow with the
+// length and with every turn of the walk.
+func spatialMatches(runes []rune) []strengthMatch {
+	const startingKeys, averageDegree = 94, 4.6
+	var matches []strengthMatch
+	for i := 0; i < len(runes)-2; {
+		j, turns, last, shifted := i+1, 0, -1, 0
+		if keyboardPositions[runes[i]].shifted {
+			shifted++
+		}
+		for ; j < len(runes); j++ {
+			d := keyboardDirection(runes[j-1], runes[j])
+			if d < 0 {
+				break
+			}
+			if d != last {
+				turns++
+				last = d
+			}
+			if keyboardPositions[runes[j]].shifted {
+				shifted++
+			}
+		}
+		if j-i < 3 {
+			i++
+			continue
+		}
+		length := j - i
+		guesses := 0.0
+		for l := 2; l <= length; l++ {
+			for t := 1; t <= min(turns, l-1); t++ {
+				guesses += binomial(l-1, t-1) * startingKeys * math.Pow(averageDegree, float64(t))
+			}
+		}
+		if shifted > 0 && shifted < length {
+			guesses *= binomial(length, min(shifted, length-shifted))
+		} else if shifted > 0 {
+			guesses *= 2
+		}
+		matches = append(matches, strengthMatch{i, j, math.Log10(guesses), "keyboard pattern"})
+		i = j - 1
+	}
+	return matches
+}
+
+// repeatMatches finds a character or a block repeated at least twice
+// (aaaa, abcabc). They cost the guesses of the block times the repeats.
+func repeatMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for i := 0; i < len(runes); i++ {
+		for size := 1; i+2*size <= len(runes); size++ {
+			block := string(runes[i : i+size])
+			end := i + size
+			for end+size <= len(runes) && string(runes[end:end+size]) == block {
+				end += size
+			}
+			repeats := (end - i) / size
+			if repeats < 2 || end-i < 3 {
+				continue
+			}
+			blockLog10 := float64(size) * bruteforceLog10
+			if size > 1 {
+				blockLog10 = estimateStrength(block).Log10Guesses
+			}
+			matches = append(matches, strengthMatch{i, end, blockLog10 + math.Log10(float64(repeats)), "repeated characters"})
+			break // the smallest block covers the longest run
+		}
+	}
+	return matches
+}
+
+// sequenceMatches finds runs like abcd, 13579 or 9876 with a constant step
+// of at most 5.
+func sequenceMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	for i := 0; i < len(runes)-2; {
+		step := runes[i+1] - runes[i]
+		j := i + 1
+		if step != 0 && step >= -5 && step <= 5 && sameClass(runes[i], runes[i+1]) {
+			for j+1 < len(runes) && runes[j+1]-runes[j] == step && sameClass(runes[j], runes[j+1]) {
+				j++
+			}
+		}
+		if j-i+1 < 3 {
+			i++
+			continue
+		}
+		start := runes[i]
+		base := 26.0
+		switch {
+		case strings.ContainsRune("aAzZ019", start):
+			base = 4
+		case unicode.IsDigit(start):
+			base = 10
+		}
+		guesses := base * float64(j-i+1)
+		if step < 0 {
+			guesses *= 2
+		}
+		matches = append(matches, strengthMatch{i, j + 1, math.Log10(guesses), "sequence"})
+		i = j
+	}
+	return matches
+}
+
+func sameClass(a, b rune) bool {
+	return (unicode.IsDigit(a) && unicode.IsDigit(b)) ||
+		(unicode.IsLower(a) && unicode.IsLower(b)) ||
+		(unicode.IsUpper(a) && unicode.IsUpper(b))
+}
+
+// yearMatches finds years from 1900 to 2099; recent ones are guessed
+// first.
+func yearMatches(runes []rune) []strengthMatch {
+	var matches []strengthMatch
+	now := time.Now().Year()
+	for i := 0; i+4 <= len(runes); i++ {
+		year, err := strconv.Atoi(string(runes[i : i+4]))
+		if err != nil || year < 1900 || year > 2099 || !unicode.IsDigit(runes[i]) {
+			continue
+		}
+		distance := math.Max(math.Abs(float64(year-now)), 20)
+		matches = append(matches, strengthMatch{i, i + 4, math.Log10(distance), "year"})
+	}
+	return matches
+}
+
+// strengthFinding is what audit-strength reports for one key or field.
+type strengthFinding struct {
+	Name     string
+	Strength strength
+	Reused   []string // other keys with the same value
+}
+
+// auditStrength rates every value of the ledger and finds values used
+// under more than one key. Keys whose policy does not allow reading them
+// now are returned in skipped.
+func auditStrength(led *ledger, masterKey []byte, p prompter) (findings []strengthFinding, skipped []string, err error) {
+	values, skipped, err := revealValues(led, masterKey, p, isSecretField)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer clearValues(values)
+
+	for _, group := range groupValues(values, nil) {
+		for _, v := range group {
+			f := strengthFinding{
+				Name:     v.Name(),
+				Strength: estimateStrength(string(v.Value), strings.Split(v.Key, namespaceSep)...),
+			}
+			for _, other := range group {
+				if other.Name() != f.Name {
+					f.Reused = append(f.Reused, other.Name())
+				}
+			}
+			findings = append(findings, f)
+		}
+	}
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Name < findings[j].Name })
+	return findings, skipped, nil
+}
+
+func cmdAuditStrength(args []string) error {
+	all := false
+	switch {
+	case len(args) == 0:
+	case len(args) == 1 && args[0] == "--all":
+		all = true
+	default:
+		return errors.New("usage: secled audit-strength [--all]")
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	masterKey, err := unlockLedger(led)
+	if err != nil {
+		return err
+	}
+
+	p := ttyPrompter()
+	defer p.close()
+	findings, skipped, err := auditStrength(led, masterKey, p.prompter)
+	if err != nil {
+		return err
+	}
+
+	problems := 0
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	for _, f := range findings {
+		var notes []string
+		if f.Strength.Score < minStrongScore {
+			notes = append(notes, "weak ("+f.Strength.String()+")")
+		}
+		if len(f.Reused) > 0 {
+			notes = append(notes, "reused (same value as "+strings.Join(f.Reused, ", ")+")")
+		}
+		if len(notes) > 0 {
+			problems++
+		} else if all {
+			notes = append(notes, fmt.Sprintf("ok (score %d/4, ~%.0f bits)", f.Strength.Score, f.Strength.Bits()))
+		}
+		if len(notes) > 0 {
+			fmt.Fprintf(tw, "%s\t%s\n", f.Name, strings.Join(notes, "; "))
+		}
+	}
+	for _, key := range skipped {
+		fmt.Fprintf(tw, "%s\tskipped (policy)\n", key)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if problems > 0 {
+		return fmt.Errorf("%d weak or reused secrets", problems)
+	}
+	return nil
+}
+
+// warnWeakMaster prints a warning when a new master password is easy to
+// guess.
+func warnWeakMaster(password string) {
+	var words []string
+	if host, err := os.Hostname(); err == nil {
+		words = append(words, host)
+	}
+	words = append(words, "secled", "ledger", os.Getenv("USER"), os.Getenv("USERNAME"))
+	if s := estimateStrength(password, words...); s.Score < minStrongScore {
+		fmt.Fprintf(os.Stderr, "Warning: weak master password (%s)\n", s)
+	}
+}
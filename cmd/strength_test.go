@@ -0,0 +1,108 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestEstimateStrength(t *testing.T) {
+	cases := []struct {
+		password string
+		maxScore int
+		minScore int
+		pattern  string
+	}{
+		{"password", 0, 0, "common password"},
+		{"P@ssw0rd", 0, 0, "common password"},
+		{"drowssap", 0, 0, "common password"},
+		{"1qaz2wsx3edc", 1, 0, ""},
+		{"qwertyuiop", 0, 0, "common password"},
+		{"zxcvbnm,./", 1, 0, "keyboard pattern"},
+		{"aaaaaaaaaaaa", 0, 0, "repeated characters"},
+		{"abcdefghij", 0, 0, "sequence"},
+		{"dragon1990", 1, 0, "year"},
+		{"prod-db-password", 2, 0, "contains the key or user name"},
+		{"xK9#mQ2pLw", 4, 3, ""},
+		{"correcthorsebatterystaple", 4, 4, ""},
+		{"8f14e45f-ceea-467f-a0e6-0b1c8e1a9f3d", 4, 4, ""},
+	}
+	for _, c := range cases {
+		s := estimateStrength(c.password, "prod", "db")
+		if s.Score > c.maxScore || s.Score < c.minScore {
+			t.Fatalf("%q: score %d, want %d..%d (%s)", c.password, s.Score, c.minScore, c.maxScore, s)
+		}
+		if c.pattern != "" && !strings.Contains(s.String(), c.pattern) {
+			t.Fatalf("%q: %s, want pattern %q", c.password, s, c.pattern)
+		}
+	}
+
+	if s := estimateStrength(""); s.Score != 0 {
+		t.Fatalf("empty password scored %d", s.Score)
+	}
+	if s := estimateStrength(strings.Repeat("ab", 5000)); s.Score > 1 {
+		t.Fatalf("long repeat scored %d", s.Score)
+	}
+}
+
+func TestKeyboardDirection(t *testing.T) {
+	for _, pair := range []string{"qw", "wq", "qa", "aq", "1q", "q2", "az", "sz", "!Q"} {
+		r := []rune(pair)
+		if keyboardDirection(r[0], r[1]) < 0 {
+			t.Fatalf("%q should be neighbours", pair)
+		}
+	}
+	for _, pair := range []string{"qe", "qs", "1a", "ql", "q?"} {
+		r := []rune(pair)
+		if keyboardDirection(r[0], r[1]) >= 0 {
+			t.Fatalf("%q should not be neighbours", pair)
+		}
+	}
+}
+
+func TestLog10Factorial(t *testing.T) {
+	for n, want := range map[int]float64{0: 0, 1: 0, 5: math.Log10(120), 20: math.Log10(2432902008176640000)} {
+		if got := log10Factorial(n); math.Abs(got-want) > 1e-9 {
+			t.Fatalf("log10Factorial(%d) = %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestAuditStrength(t *testing.T) {
+	led, master := newTestLedger(t, map[string]string{
+		"weak":   "letmein",
+		"strong": "8f14e45f-ceea-467f-a0e6-0b1c8e1a9f3d",
+		"copy":   "8f14e45f-ceea-467f-a0e6-0b1c8e1a9f3d",
+		"locked": "password",
+	})
+	led.Entries["locked"].Meta[metaPolicy] = "confirm"
+	fields := encodeFields(map[string][]byte{"username": []byte("bob"), "password": []byte("hunter2")})
+	if err := storeEntry(led, master, "ghcr", fields); err != nil {
+		t.Fatalf("store failed: %v", err)
+	}
+	led.Entries["ghcr"].Meta[metaType] = typeFields
+
+	findings, skipped, err := auditStrength(led, master, prompter{})
+	if err != nil {
+		t.Fatalf("audit failed: %v", err)
+	}
+	if strings.Join(skipped, ",") != "locked" {
+		t.Fatalf("skipped = %v", skipped)
+	}
+	got := make(map[string]strengthFinding)
+	for _, f := range findings {
+		got[f.Name] = f
+	}
+	if _, ok := got["ghcr.username"]; ok {
+		t.Fatal("user name was rated")
+	}
+	if got["ghcr.password"].Strength.Score >= minStrongScore || got["weak"].Strength.Score >= minStrongScore {
+		t.Fatalf("weak values not flagged: %+v", findings)
+	}
+	if got["strong"].Strength.Score < minStrongScore || strings.Join(got["strong"].Reused, ",") != "copy" {
+		t.Fatalf("strong = %+v", got["strong"])
+	}
+	if len(got["weak"].Reused) != 0 {
+		t.Fatalf("weak reused = %v", got["weak"].Reused)
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Failed unlocks are counted in a small state file next to the ledger.
+// After throttleFreeAttempts failures in a row every attempt has to wait,
+// twice as long after each further failure. With a lockout configured the
+// ledger refuses passwords after that many failures until secled recover
+// is run with the recovery code.
+//
+// Anyone who can edit files next to the ledger can reset the state (and
+// could copy the ledger to guess offline); the point is to slow down and
+// show guessing through secled itself.
+const (
+	throttleFreeAttempts = 3
+	throttleBaseDelay    = time.Second
+	throttleMaxDelay     = 15 * time.Minute
+)
+
+type unlockState struct {
+	Failures     int
+	LastFailure  time.Time
+	LockoutAfter int // 0: no lockout
+	Locked       bool
+	RecoveryHash string
+}
+
+func unlockStatePath(ledgerPath string) string {
+	return strings.TrimSuffix(ledgerPath, ".encrypted") + ".unlock"
+}
+
+func loadUnlockState(path string) (unlockState, error) {
+	var st unlockState
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return st, nil
+	}
+	if err != nil {
+		return st, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		name, value, ok := strings.Cut(scanner.Text(), " ")
+		if !ok {
+			continue
+		}
+		switch name {
+		case "failures":
+			st.Failures, _ = strconv.Atoi(value)
+		case "last_failure":
+			st.LastFailure, _ = time.Parse(time.RFC3339Nano, value)
+		case "lockout_after":
+			st.LockoutAfter, _ = strconv.Atoi(value)
+		case "locked":
+			st.Locked = value == "true"
+		case "recovery_sha256":
+			st.RecoveryHash = value
+		}
+	}
+	return st, nil
+}
+
+func saveUnlockState(path string, st unlockState) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "failures %d\n", st.Failures)
+	if !st.LastFailure.IsZero() {
+		fmt.Fprintf(&buf, "last_failure %s\n", st.LastFailure.UTC().Format(time.RFC3339Nano))
+	}
+	fmt.Fprintf(&buf, "lockout_after %d\n", st.LockoutAfter)
+	fmt.Fprintf(&buf, "locked %t\n", st.Locked)
+	if st.RecoveryHash != "" {
+		fmt.Fprintf(&buf, "recovery_sha256 %s\n", st.RecoveryHash)
+	}
+	return writeFileAtomic(path, 0o600, func(w io.Writer) error {
+		_, err := w.Write(buf.Bytes())
+		return err
+	})
+}
+
+// delay is how long after the last failure the next attempt must wait.
+func (st unlockState) delay() time.Duration {
+	if st.Failures < throttleFreeAttempts {
+		return 0
+	}
+	d := throttleBaseDelay
+	for i := throttleFreeAttempts; i < st.Failures && d < throttleMaxDelay; i++ {
+		d *= 2
+	}
+	return min(d, throttleMaxDelay)
+}
+
+// wait is how long until the next attempt is allowed.
+func (st unlockState) wait(now time.Time) time.Duration {
+	return max(st.LastFailure.Add(st.delay()).Sub(now), 0)
+}
+
+// checkThrottle refuses a password attempt while the ledger is locked out
+// or the delay after the last failure has not passed.
+func checkThrottle(ledgerPath string) error {
+	if ledgerPath == "" {
+		return nil
+	}
+	st, err := loadUnlockState(unlockStatePath(ledgerPath))
+	if err != nil {
+		return err
+	}
+	if st.Locked {
+		return fmt.Errorf("ledger is locked after %d failed unlock attempts (secled recover <recovery-code>)", st.Failures)
+	}
+	if wait := st.wait(time.Now()); wait > 0 {
+		return fmt.Errorf("too many failed unlock attempts (%d), try again in %s", st.Failures, wait.Round(time.Second))
+	}
+	return nil
+}
+
+// noteUnlock counts a failed password attempt or clears the counter after
+// a good one. Problems with the state file only print a warning.
+func noteUnlock(ledgerPath string, ok bool) {
+	if ledgerPath == "" {
+		return
+	}
+	if err := updateUnlockState(ledgerPath, func(st *unlockState) bool {
+		if ok {
+			if st.Failures == 0 {
+				return false
+			}
+			st.Failures = 0
+			return true
+		}
+		st.Failures++
+		st.LastFailure = time.Now().UTC()
+		if st.LockoutAfter > 0 && st.Failures >= st.LockoutAfter {
+			st.Locked = true
+		}
+		return true
+	}); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: cannot update unlock state:", err)
+	}
+}
+
+// updateUnlockState changes the state file under its own lock; change
+// returns false when there is nothing to write.
+func updateUnlockState(ledgerPath string, change func(*unlockState) bool) error {
+	path := unlockStatePath(ledgerPath)
+	unlock, err := lockLedger(path)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	st, err := loadUnlockState(path)
+	if err != nil {
+		return err
+	}
+	if !change(&st) {
+		return nil
+	}
+	return saveUnlockState(path, st)
+}
+
+func newRecoveryCode() (string, string, error) {
+	b := make([]byte, 15)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	code := base32.StdEncoding.EncodeToString(b)
+	groups := make([]string, 0, len(code)/4)
+	for i := 0; i < len(code); i += 4 {
+		groups = append(groups, code[i:i+4])
+	}
+	formatted := strings.Join(groups, "-")
+	return formatted, recoveryHash(formatted), nil
+}
+
+// recoveryHash ignores dashes, spaces and case so the code can be typed
+// loosely.
+func recoveryHash(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+func cmdLockout(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: secled lockout <attempts>|off")
+	}
+	after := 0
+	if args[0] != "off" {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < throttleFreeAttempts {
+			return fmt.Errorf("lockout needs a number of attempts of at least %d, or off", throttleFreeAttempts)
+		}
+		after = n
+	}
+
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		return err
+	}
+	if _, err := unlockLedger(led); err != nil {
+		return err
+	}
+
+	code, hash := "", ""
+	if after > 0 {
+		if code, hash, err = newRecoveryCode(); err != nil {
+			return err
+		}
+	}
+	if err := updateUnlockState(path, func(st *unlockState) bool {
+		st.LockoutAfter = after
+		st.RecoveryHash = hash
+		return true
+	}); err != nil {
+		return err
+	}
+
+	if after == 0 {
+		fmt.Fprintln(os.Stderr, "Lockout turned off (failed attempts are still slowed down)")
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "The ledger locks after %d failed unlock attempts in a row.\n", after)
+	fmt.Fprintln(os.Stderr, "Recovery code (shown once, store it away from the ledger):")
+	fmt.Fprintln(os.Stdout, code)
+	return nil
+}
+
+func cmdRecover(args []string) error {
+	if len(args) != 1 {
+		return errors.New("usage: secled recover <recovery-code>")
+	}
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	matched := false
+	if err := updateUnlockState(path, func(st *unlockState) bool {
+		if st.RecoveryHash == "" {
+			return false
+		}
+		matched = subtle.ConstantTimeCompare([]byte(recoveryHash(args[0])), []byte(st.RecoveryHash)) == 1
+		if !matched {
+			return false
+		}
+		st.Failures = 0
+		st.Locked = false
+		return true
+	}); err != nil {
+		return err
+	}
+	if !matched {
+		return errors.New("wrong recovery code")
+	}
+	fmt.Fprintln(os.Stderr, "Ledger unlocked, the failure counter is reset")
+	return nil
+}
+
+func cmdStatus(args []string) error {
+	if len(args) != 0 {
+		return errors.New("usage: secled status")
+	}
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	st, err := loadUnlockState(unlockStatePath(path))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "ledger: %s\n", path)
+	if led, err := loadLedger(path); err != nil {
+		fmt.Fprintf(os.Stdout, "ledger state: %v\n", err)
+	} else {
+		index := "public"
+		if led.Private {
+			index = "private"
+		}
+		fmt.Fprintf(os.Stdout, "format: %s version %d, %s index, generation %d\n", led.Format, led.Version, index, led.Generation)
+	}
+
+	login := "no"
+	if _, err := requirePassword(); err == nil {
+		login = "yes (SECLED_MASTER)"
+	}
+	fmt.Fprintf(os.Stdout, "logged in: %s\n", login)
+	agent := "not running"
+	if resp, err := agentCall(agentSocketPath(), agentRequest{Op: "status"}); err == nil {
+		agent = fmt.Sprintf("running for %s, idle timeout in %s", resp.Ledger, resp.Idle)
+	}
+	fmt.Fprintf(os.Stdout, "agent: %s\n", agent)
+
+	fmt.Fprintf(os.Stdout, "failed unlock attempts: %d\n", st.Failures)
+	if !st.LastFailure.IsZero() {
+		fmt.Fprintf(os.Stdout, "last failed attempt: %s\n", st.LastFailure.Local().Format(time.RFC3339))
+	}
+	if wait := st.wait(time.Now()); wait > 0 && !st.Locked {
+		fmt.Fprintf(os.Stdout, "next attempt allowed in: %s\n", wait.Round(time.Second))
+	}
+	lockout := "off"
+	if st.LockoutAfter > 0 {
+		lockout = fmt.Sprintf("after %d failed attempts", st.LockoutAfter)
+	}
+	fmt.Fprintf(os.Stdout, "lockout: %s\n", lockout)
+	if st.Locked {
+		fmt.Fprintln(os.Stdout, "LOCKED: run secled recover <recovery-code>")
+	}
+	return nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUnlockDelay(t *testing.T) {
+	cases := map[int]time.Duration{
+		0:   0,
+		2:   0,
+		3:   time.Second,
+		4:   2 * time.Second,
+		6:   8 * time.Second,
+		100: throttleMaxDelay,
+	}
+	for failures, want := range cases {
+		if got := (unlockState{Failures: failures}).delay(); got != want {
+			t.Fatalf("delay after %d failures = %v, want %v", failures, got, want)
+		}
+	}
+
+	now := time.Now()
+	st := unlockState{Failures: 4, LastFailure: now.Add(-time.Second)}
+	if got := st.wait(now); got != time.Second {
+		t.Fatalf("wait = %v, want 1s", got)
+	}
+	if got := st.wait(now.Add(time.Hour)); got != 0 {
+		t.Fatalf("wait after an hour = %v", got)
+	}
+}
+
+func TestUnlockStateRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.unlock")
+	want := unlockState{
+		Failures:     4,
+		LastFailure:  time.Date(2026, 1, 2, 3, 4, 5, 6, time.UTC),
+		LockoutAfter: 10,
+		Locked:       true,
+		RecoveryHash: recoveryHash("abcd-efgh"),
+	}
+	if err := saveUnlockState(path, want); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	got, err := loadUnlockState(path)
+	if err != nil || got != want {
+		t.Fatalf("load = %+v, %v; want %+v", got, err, want)
+	}
+}
+
+func TestVerifyPasswordThrottle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	writeTestLedger(t, path, map[string]string{})
+	if err := updateUnlockState(path, func(st *unlockState) bool {
+		st.LockoutAfter = 4
+		return true
+	}); err != nil {
+		t.Fatalf("set lockout failed: %v", err)
+	}
+	led, err := loadLedger(path)
+	if err != nil {
+		t.Fatalf("load failed: %v", err)
+	}
+
+	for i := 0; i < throttleFreeAttempts; i++ {
+		if _, err := verifyPassword(led, "wrong"); err != errWrongPassword {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+	}
+	if _, err := verifyPassword(led, "password"); err == nil || !strings.Contains(err.Error(), "try again") {
+		t.Fatalf("attempt during the delay was not refused: %v", err)
+	}
+
+	// Pretend the delay has passed; one more failure locks the ledger.
+	_ = updateUnlockState(path, func(st *unlockState) bool {
+		st.LastFailure = time.Now().Add(-time.Hour)
+		return true
+	})
+	if _, err := verifyPassword(led, "wrong"); err != errWrongPassword {
+		t.Fatalf("fourth attempt: %v", err)
+	}
+	if _, err := verifyPassword(led, "password"); err == nil || !strings.Contains(err.Error(), "locked") {
+		t.Fatalf("locked ledger accepted a password: %v", err)
+	}
+
+	_ = updateUnlockState(path, func(st *unlockState) bool {
+		st.Locked = false
+		st.LastFailure = time.Time{}
+		return true
+	})
+	if _, err := verifyPassword(led, "password"); err != nil {
+		t.Fatalf("good password after recovery: %v", err)
+	}
+	st, _ := loadUnlockState(unlockStatePath(path))
+	if st.Failures != 0 {
+		t.Fatalf("good password did not reset the counter: %d", st.Failures)
+	}
+}
+
+func TestRecoveryCode(t *testing.T) {
+	code, hash, err := newRecoveryCode()
+	if err != nil {
+		t.Fatalf("newRecoveryCode failed: %v", err)
+	}
+	if len(strings.Split(code, "-")) != 6 {
+		t.Fatalf("unexpected code format %q", code)
+	}
+	loose := strings.ToLower(strings.ReplaceAll(code, "-", " "))
+	if recoveryHash(loose) != hash {
+		t.Fatalf("code typed without dashes in lower case does not match")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	exitCorrupt   = 2
+	exitBadHeader = 3
+)
+
+func cmdVerify() error {
+	path, err := ledgerPath()
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return verifyLedger(os.Stdout, path, data, os.Getenv("SECLED_MASTER"))
+}
+
+// verifyLedger checks the structure of a ledger file and, when a password
+// is given, the whole-file MAC, every entry and every attachment stored
+// next to path. The report is written to w.
+// Damage is returned as an exitError: exitBadHeader when the header cannot
+// be read, exitCorrupt for anything after it.
+func verifyLedger(w io.Writer, path string, data []byte, password string) error {
+	led, err := parseLedger(data)
+	if errors.Is(err, errBadHeader) {
+		fmt.Fprintf(w, "header: FAILED (%v)\n", err)
+		return &exitError{code: exitBadHeader, err: err}
+	}
+	if err != nil {
+		fmt.Fprintln(w, "header: OK")
+		fmt.Fprintf(w, "structure: FAILED (%v)\n", err)
+		return &exitError{code: exitCorrupt, err: fmt.Errorf("%w (secled salvage can recover intact entries)", err)}
+	}
+
+	led.path = path
+
+	index := "public"
+	if led.Private {
+		index = "private"
+	}
+	fmt.Fprintf(w, "header: OK (%s version %d, generation %d, %s index, %d entries)\n", led.Format, led.Version, led.Generation, index, led.Count)
+
+	damaged := false
+	if led.trailing > 0 {
+		fmt.Fprintf(w, "structure: FAILED (%d trailing bytes after the last entry)\n", led.trailing)
+		damaged = true
+	} else {
+		fmt.Fprintln(w, "structure: OK")
+	}
+
+	if strings.TrimSpace(password) == "" {
+		fmt.Fprintln(w, "entries: not checked (login required)")
+		return damagedError(damaged, 0)
+	}
+
+	if err := checkThrottle(path); err != nil {
+		return err
+	}
+	masterKey := deriveKey(password, led.Params)
+	if err := unlockIndex(led, masterKey); err != nil {
+		if errors.Is(err, errWrongPassword) && !knownKey(led, masterKey) {
+			noteUnlock(path, false)
+			return err
+		}
+		// the password opened this ledger before, or the index decrypted
+		// and is malformed
+		fmt.Fprintf(w, "index: FAILED (%v)\n", indexError(err))
+		return &exitError{code: exitCorrupt, err: errors.New("ledger index is damaged (secled salvage cannot recover a private index)")}
+	}
+
+	var initial []byte
+	failed := 0
+	for _, key := range sortedKeys(led.Entries) {
+		plaintext, err := decryptEntry(masterKey, key, led.Entries[key])
+		if err != nil {
+			fmt.Fprintf(w, "entry %s: FAILED (%v)\n", strconv.Quote(key), err)
+			failed++
+			continue
+		}
+		if key == reservedInitialKey {
+			initial = plaintext
+		}
+		if isAttachment(led.Entries[key]) {
+			if err := verifyAttachment(path, led.Entries[key], plaintext); err != nil {
+				fmt.Fprintf(w, "attachment %s: FAILED (%v)\n", strconv.Quote(key), err)
+				failed++
+			}
+		}
+	}
+	if failed > 0 && failed == len(led.Entries) {
+		noteUnlock(path, false)
+		return errWrongPassword
+	}
+
+	if err := checkIntegrity(led, masterKey, initial); err != nil {
+		fmt.Fprintf(w, "integrity: FAILED (%v)\n", err)
+		damaged = true
+	} else if led.MAC == nil {
+		fmt.Fprintln(w, "integrity: none (version 1 file, added on the next change)")
+	} else {
+		fmt.Fprintln(w, "integrity: OK (MAC verified)")
+	}
+
+	fmt.Fprintf(w, "entries: %d OK, %d failed\n", len(led.Entries)-failed, failed)
+	return damagedError(damaged, failed)
+}
+
+// indexError words an index failure for the report: the sealed index of
+// a known key fails authentication because it was changed.
+func indexError(err error) error {
+	if errors.Is(err, errWrongPassword) {
+		return errors.New("sealed index fails authentication with the password that opened it before")
+	}
+	return err
+}
+
+func damagedError(damaged bool, failed int) error {
+	switch {
+	case failed > 0:
+		return &exitError{code: exitCorrupt, err: fmt.Errorf("%d corrupt entries", failed)}
+	case damaged:
+		return &exitError{code: exitCorrupt, err: errors.New("ledger is damaged")}
+	}
+	return nil
+}
+
+func verifyAttachment(path string, e entry, fileKey []byte) error {
+	blob, err := os.Open(attachmentPath(path, e))
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+	return decryptStream(io.Discard, blob, fileKey, e.Meta[metaAttachment])
+}
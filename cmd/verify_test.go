@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func verifyExitCode(err error) int {
+	var exitErr *exitError
+	if errors.As(err, &exitErr) {
+		return exitErr.code
+	}
+	if err != nil {
+		return 1
+	}
+	return 0
+}
+
+func TestVerifyLedger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	writeTestLedger(t, path, map[string]string{"alpha": "secret-alpha", "beta": "secret-beta"})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+
+	// Flip the last byte of the "beta" ciphertext: structure stays intact.
+	corrupt := bytes.Clone(data)
+	led, err := parseLedger(data)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	betaEnd := bytes.Index(data, led.Entries["beta"].Ciphertext) + len(led.Entries["beta"].Ciphertext)
+	corrupt[betaEnd-1] ^= 0xff
+
+	cases := []struct {
+		name     string
+		data     []byte
+		password string
+		wantCode int
+		wantOut  string
+	}{
+		{name: "healthy", data: data, password: "password", wantOut: "entries: 3 OK, 0 failed"},
+		{name: "healthy without login", data: data, wantOut: "entries: not checked"},
+		{name: "wrong password", data: data, password: "other", wantCode: 1},
+		{name: "bad header", data: []byte("NOTALEDGER"), wantCode: exitBadHeader},
+		{name: "truncated", data: data[:len(data)-40], wantCode: exitCorrupt, wantOut: "truncated"},
+		{name: "corrupt entry", data: corrupt, password: "password", wantCode: exitCorrupt, wantOut: `entry "beta": FAILED`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			err := verifyLedger(&out, path, tc.data, tc.password)
+			if code := verifyExitCode(err); code != tc.wantCode {
+				t.Fatalf("expected exit code %d, got %d (%v)\n%s", tc.wantCode, code, err, out.String())
+			}
+			if !strings.Contains(out.String(), tc.wantOut) {
+				t.Fatalf("expected output to contain %q, got:\n%s", tc.wantOut, out.String())
+			}
+		})
+	}
+}
+
+func TestVerifyDamagedPrivateIndex(t *testing.T) {
+	isolateUserConfig(t)
+	path := filepath.Join(t.TempDir(), "ledger.encrypted")
+	led, master := newTestLedger(t, map[string]string{reservedInitialKey: initialValue(), "alpha": "secret-alpha"})
+	led.Private = true
+	if err := saveLedger(path, led, master); err != nil {
+		t.Fatalf("save failed: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read failed: %v", err)
+	}
+	parsed, err := parseLedger(data)
+	if err != nil {
+		t.Fatalf("parse failed: %v", err)
+	}
+	corrupt := bytes.Clone(data)
+	corrupt[bytes.Index(data, parsed.sealedIndex)+nonceSize+3] ^= 0x01
+
+	var out bytes.Buffer
+	err = verifyLedger(&out, path, corrupt, "password")
+	if code := verifyExitCode(err); code != exitCorrupt {
+		t.Fatalf("expected exit code %d, got %d (%v)\n%s", exitCorrupt, code, err, out.String())
+	}
+	if !strings.Contains(out.String(), "index: FAILED") {
+		t.Fatalf("expected index failure in report, got:\n%s", out.String())
+	}
+
+	if err := verifyLedger(&out, path, corrupt, "other"); verifyExitCode(err) != 1 {
+		t.Fatalf("expected exit code 1 for a wrong password, got %v", err)
+	}
+}
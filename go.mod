@@ -4,7 +4,6 @@ go 1.25.3
 
 require (
 	golang.org/x/crypto v0.47.0
+	golang.org/x/sys v0.40.0
 	golang.org/x/term v0.39.0
 )
-
-require golang.org/x/sys v0.40.0 // indirect